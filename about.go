@@ -10,5 +10,6 @@ func AboutHandler(r *mux.Router) {
 }
 
 func PageAbout(w http.ResponseWriter, r *http.Request) {
-	http.ServeFile(w, r, "template/about.html")
+	tmpl := ParseTemplate(w, r, "about.html")
+	tmpl.Execute(w, nil)
 }
\ No newline at end of file
@@ -3,10 +3,12 @@ package main
 
 import (
 	"log"
+	"time"
+	"errors"
+	"strings"
+	"strconv"
 	"net/http"
-	"html/template"
 	"github.com/gorilla/mux"
-	"database/sql"
 )
 
 type PageAdminStruct struct {
@@ -15,6 +17,8 @@ type PageAdminStruct struct {
 	Email		string
 	Usergroup	string
 	Users		[]UserStruct
+	FailedIPs	[]LoginThrottle
+	Message		string
 }
 
 type UserStruct struct {
@@ -23,206 +27,713 @@ type UserStruct struct {
 	Email		string
 	Password	string
 	Usergroup	string
+	AuthSource	string
+	Disabled	bool
+	LastLogin	time.Time // zero when never logged in
+	Throttle	LoginThrottle
 }
 
-func AdminHandler(r *mux.Router) {
-	r.HandleFunc("/admin", PageAdmin)
-	r.HandleFunc("/admin/usermanagement", PageAdminUserManagement)
-	r.HandleFunc("/admin/usermanagement/newuser", PageAdminNewUser)
-	r.HandleFunc("/admin/usermanagement/newuser/submit", AdminNewUser)
-	r.HandleFunc("/admin/usermanagement/deleteuser/{id}", AdminDeleteUser)
+var (
+	ErrLastAdmin = errors.New("at least one enabled user must keep admin access")
+	ErrOwnAccount = errors.New("you cannot do this to your own account")
+	ErrPermissionExceeded = errors.New("you cannot manage or grant permissions you do not hold")
+)
+
+// admin is the "/admin" subrouter, which already requires access_admin
+func AdminHandler(admin *mux.Router, s *Store) {
+	admin.HandleFunc("", PageAdmin)
+	admin.HandleFunc("/usermanagement", PageAdminUserManagement)
+	admin.HandleFunc("/usermanagement/newuser", PageAdminNewUser)
+	admin.HandleFunc("/usermanagement/newuser/submit", AdminNewUser(s)).Methods("POST")
+	admin.HandleFunc("/usermanagement/deleteuser/{id}", AdminDeleteUser(s)).Methods("POST")
+	admin.HandleFunc("/usermanagement/unlockuser/{id}", AdminUnlockUser(s)).Methods("POST")
+	admin.HandleFunc("/usermanagement/edituser/{id}", PageAdminEditUser)
+	admin.HandleFunc("/usermanagement/edituser/{id}/submit", AdminEditUser).Methods("POST")
+	admin.HandleFunc("/usermanagement/disableuser/{id}", AdminDisableUser).Methods("POST")
+	admin.HandleFunc("/usermanagement/enableuser/{id}", AdminEnableUser).Methods("POST")
+	admin.HandleFunc("/usermanagement/resetpassword/{id}", Require("update_user_password", PageAdminResetPassword))
+	admin.HandleFunc("/usermanagement/resetpassword/{id}/submit", Require("update_user_password", AdminResetPassword)).Methods("POST")
+	admin.HandleFunc("/security", PageAdminSecurity)
+	admin.HandleFunc("/security/submit", AdminSecuritySubmit).Methods("POST")
 }
 
 func PageAdmin(w http.ResponseWriter, r *http.Request) {
-	if IsAuthenticated(w,r) {
-		session, _ := store.Get(r, "cookie-name")
-		username := session.Values["username"].(string)
-		if AccessAdmin(GetUsergroup(GetUserId(username))) {
-			data := Admin(username)
-			tmpl := template.Must(template.ParseFiles("template/admin/index.html"))
-			tmpl.Execute(w, data)
-		} else {
-			// assuming user came from "/user"
-			http.Redirect(w, r, "/user", 302)
-		}
-	} else {
-		http.Redirect(w, r, "/", 302)
+	user, _ := GetCurrentUser(r)
+	data, err := Admin(user.Username)
+	if err != nil {
+		HTTPError(w, r, err)
+		return
 	}
+	tmpl := ParseTemplate(w, r, "admin/index.html")
+	tmpl.Execute(w, data)
 }
 
 // "/admin/usermanagement"
 func PageAdminUserManagement(w http.ResponseWriter, r *http.Request) {
-	if IsAuthenticated(w,r) {
-		session, _ := store.Get(r, "cookie-name")
-		username := session.Values["username"].(string)
-		usergroup := GetUsergroup(GetUserId(username))
-		if AccessAdmin(usergroup) {
-			//data := AllUser()
-			data := PageAdminStruct{
-				"",
-				username,
-				"",
-				usergroup,
-				AllUser(),
-			}
-			tmpl := template.Must(template.ParseFiles("template/admin/usermanagement.html"))
-			tmpl.Execute(w, data)
-		} else {
-			// assuming user came from "/user"
-			http.Redirect(w, r, "/user", 302)
-		}
-	} else {
-		http.Redirect(w, r, "/", 302)
+	user, _ := GetCurrentUser(r)
+	renderUserManagement(w, r, user.Username, user.Usergroup, "")
+}
+
+func renderUserManagement(w http.ResponseWriter, r *http.Request, username string, usergroup string, message string) {
+	users, err := AllUser()
+	if err != nil {
+		HTTPError(w, r, err)
+		return
 	}
+	failed, err := FailedLoginIPs()
+	if err != nil {
+		HTTPError(w, r, err)
+		return
+	}
+
+	data := PageAdminStruct{
+		"",
+		username,
+		"",
+		usergroup,
+		users,
+		failed,
+		message,
+	}
+	tmpl := ParseTemplate(w, r, "admin/usermanagement.html")
+	tmpl.Execute(w, data)
 }
 
 // "/admin/usermanagement/newuser"
 func PageAdminNewUser(w http.ResponseWriter, r *http.Request) {
-	if IsAuthenticated(w,r) {
-		session, _ := store.Get(r, "cookie-name")
-		username := session.Values["username"].(string)
-		usergroup := GetUsergroup(GetUserId(username))
-		if AccessAdmin(usergroup) {
-			data := Admin(username)
-			tmpl := template.Must(template.ParseFiles("template/admin/newuser.html"))
-			tmpl.Execute(w, data)
-		} else {
-			http.Redirect(w, r, "/user", 302)
-		}
-	} else {
-		http.Redirect(w, r, "/", 302)
+	user, _ := GetCurrentUser(r)
+	data, err := Admin(user.Username)
+	if err != nil {
+		HTTPError(w, r, err)
+		return
 	}
+	tmpl := ParseTemplate(w, r, "admin/newuser.html")
+	tmpl.Execute(w, data)
 }
 
 func (p PageAdminStruct) UserPermission(permission string, usergroup string) bool {
 	return UsergroupPermission(permission, usergroup)
 }
 
-func Admin(username string) PageAdminStruct {
+func (p PageAdminStruct) PasswordPolicy() string {
+	return PasswordPolicyDescription()
+}
 
+func (p PageAdminStruct) Usergroups() ([]Usergroup, error) {
+	return GetUsergroups()
+}
 
+// function to get the details of the logged in admin shown on the admin pages
+func Admin(username string) (PageAdminStruct, error) {
 	data := PageAdminStruct{
 		"",
 		username,
 		"",
 		"",
 		[]UserStruct{}, // empty reserved for UserStruct
+		[]LoginThrottle{},
+		"",
 	}
 
-	// Connect to SQLite database
-	db, errOpen := sql.Open("sqlite3", "./database/core.db")
-	if errOpen != nil {
-		log.Fatal(errOpen)
-	}
-	defer db.Close()
-
 	query := `SELECT id, email, usergroup FROM user WHERE username = ?`
-	err := db.QueryRow(query, data.Username).Scan(&data.Id, &data.Email, &data.Usergroup)
+	err := coreDB().QueryRow(query, data.Username).Scan(&data.Id, &data.Email, &data.Usergroup)
 
-	if err == sql.ErrNoRows {
-		//fmt.Println("serious error")
-		//return false
-	} else if err != nil {
-		log.Fatal(err)
-		//return false
-	}
-
-	return data
+	return data, err
 }
 
-func AllUser() []UserStruct {
-	db, errOpen := sql.Open("sqlite3", "./database/core.db")
-	if errOpen != nil {
-		log.Fatal("error opening core.db ", errOpen)
+func AllUser() ([]UserStruct, error) {
+	userstruct, err := defaultStore.Users.All()
+	if err != nil {
+		return nil, err
 	}
-	defer db.Close()
 
-    var userstruct []UserStruct
-    row, err := db.Query("SELECT * FROM user")
-	
-	if err == sql.ErrNoRows {
-		log.Fatal("func AllUser() no rows ", err)
-	} else if err != nil {
-		log.Fatal("func AllUser() return err nil ", err)
+	for i := range userstruct {
+		userstruct[i].Throttle, err = GetLoginThrottle(throttleScopeUser, userstruct[i].Username)
+		if err != nil {
+			return nil, err
+		}
 	}
 
-    defer row.Close()
-    for row.Next() {
-        user := UserStruct{}
-        err := row.Scan(&user.Id, &user.Username, &user.Email, &user.Password, &user.Usergroup)
-        if err != nil {
-            log.Fatal(err)
-        }
-        userstruct = append(userstruct, user)
-    }
-
-    return userstruct
+	return userstruct, nil
 }
 
 // handle the form for new user submission
-func AdminNewUser(w http.ResponseWriter, r *http.Request) {
-	if IsAuthenticated(w,r) {
-		session, _ := store.Get(r, "cookie-name")
-		username := session.Values["username"].(string)
-		usergroup := GetUsergroup(GetUserId(username))
-		if AccessAdmin(usergroup) {
-			fusername := r.FormValue("username")
-			femail := r.FormValue("email")
-			fusergroup := r.FormValue("usergroup")
-			fpassword := r.FormValue("password")
-
-			db, errOpen := sql.Open("sqlite3", "./database/core.db")
-			if errOpen != nil {
-				log.Fatal(errOpen)
+func AdminNewUser(s *Store) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		user, _ := GetCurrentUser(r)
+		fusername := r.FormValue("username")
+		femail := r.FormValue("email")
+		fusergroup := r.FormValue("usergroup")
+		fpassword := r.FormValue("password")
+		fmustchange := r.FormValue("mustchange") == "1"
+
+		if errPolicy := PasswordPolicyCheck(fusername, fpassword); errPolicy != nil {
+			data, err := Admin(user.Username)
+			if err != nil {
+				HTTPError(w, r, err)
+				return
+			}
+			data.Message = "Error. " + errPolicy.Error() + "."
+			tmpl := ParseTemplate(w, r, "admin/newuser.html")
+			tmpl.Execute(w, data)
+			return
+		}
+
+		exists, err := UsergroupExist(fusergroup)
+		if err != nil {
+			HTTPError(w, r, err)
+			return
+		}
+		message := ""
+		if !exists {
+			message = "Error. Unknown usergroup " + fusergroup + "."
+		} else if !UsergroupCovers(user.Usergroup, fusergroup) {
+			message = "Error. " + ErrPermissionExceeded.Error() + "."
+		}
+		if message != "" {
+			data, err := Admin(user.Username)
+			if err != nil {
+				HTTPError(w, r, err)
+				return
 			}
-			defer db.Close()
+			data.Message = message
+			tmpl := ParseTemplate(w, r, "admin/newuser.html")
+			tmpl.Execute(w, data)
+			return
+		}
 
-			_, err := db.Exec(`INSERT INTO user (username, email, password, usergroup) VALUES (?, ?, ?, ?)`, fusername, femail, fpassword, fusergroup)
+		// password is filled in by SetPassword() below
+		lastid, err := s.Users.Create(fusername, femail, fusergroup)
 
+		if err != nil {
+			log.Println(err)
+			data, err := Admin(user.Username)
 			if err != nil {
-				log.Println(err)
-			} else {
-				// show success page
-				data := Admin(username)
-				tmpl := template.Must(template.ParseFiles("template/admin/newuserok.html"))
-				tmpl.Execute(w, data)
+				HTTPError(w, r, err)
+				return
 			}
+			data.Message = "Error. Unable to create user, the username may already exist."
+			tmpl := ParseTemplate(w, r, "admin/newuser.html")
+			tmpl.Execute(w, data)
 		} else {
-			http.Redirect(w, r, "/user", 302)
+			newid := strconv.FormatInt(lastid, 10)
+			err = SetPassword(newid, fpassword, fmustchange)
+			if err != nil {
+				HTTPError(w, r, err)
+				return
+			}
+			after, err := AuditUser(newid)
+			if err != nil {
+				HTTPError(w, r, err)
+				return
+			}
+			if err := AuditLog(r, user.Username, auditEntityUser, newid, auditActionCreate, nil, after); err != nil {
+				HTTPError(w, r, err)
+				return
+			}
+
+			// show success page
+			data, err := Admin(user.Username)
+			if err != nil {
+				HTTPError(w, r, err)
+				return
+			}
+			tmpl := ParseTemplate(w, r, "admin/newuserok.html")
+			tmpl.Execute(w, data)
 		}
-	} else {
-		http.Redirect(w, r, "/", 302)
 	}
 }
 
 // handle user deletion
-func AdminDeleteUser(w http.ResponseWriter, r *http.Request) {
-	if IsAuthenticated(w,r) {
-		session, _ := store.Get(r, "cookie-name")
-		username := session.Values["username"].(string)
-		usergroup := GetUsergroup(GetUserId(username))
-		if AccessAdmin(usergroup) {
-			vars := mux.Vars(r)
-			id := vars["id"]
-
-			db, errOpen := sql.Open("sqlite3", "./database/core.db")
-			if errOpen != nil {
-				log.Fatal(errOpen)
+func AdminDeleteUser(s *Store) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		user, _ := GetCurrentUser(r)
+		vars := mux.Vars(r)
+		id := vars["id"]
+
+		if err := CheckAdminChange(user.Id, id, "", true); adminChangeRefused(err) {
+			renderUserManagement(w, r, user.Username, user.Usergroup, "Error. " + err.Error() + ".")
+			return
+		} else if err != nil {
+			HTTPError(w, r, err)
+			return
+		}
+
+		before, err := AuditUser(id)
+		if err != nil {
+			HTTPError(w, r, err)
+			return
+		}
+		err = s.Users.Delete(id)
+
+		if err == nil {
+			// a session must not outlive its account
+			err = RevokeUserSessions(id, "")
+		}
+
+		if err != nil {
+			HTTPError(w, r, err)
+		} else {
+			if before != nil {
+				if err := AuditLog(r, user.Username, auditEntityUser, id, auditActionDelete, before, nil); err != nil {
+					HTTPError(w, r, err)
+					return
+				}
 			}
-			defer db.Close()
 
-			_, err := db.Exec(`DELETE FROM user WHERE id = ?`, id) // check err
+			// finish
+			http.Redirect(w, r, "/admin/usermanagement", 302)
+		}
+	}
+}
+
+// handle unlocking of account locked by failed logins, also clears its failure counter
+func AdminUnlockUser(s *Store) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		user, _ := GetCurrentUser(r)
+		vars := mux.Vars(r)
+		id := vars["id"]
 
-			if err != nil {
-				log.Println(err)
+		lockedusername, err := s.Users.Username(id)
+
+		if err != nil {
+			HTTPError(w, r, err)
+		} else if lockedusername == "" {
+			PageNotFound(w, r)
+		} else if err := LoginThrottleReset(throttleScopeUser, lockedusername); err != nil {
+			HTTPError(w, r, err)
+		} else if err := AuditLog(r, user.Username, auditEntityUser, id, "unlock", nil, nil); err != nil {
+			HTTPError(w, r, err)
+		} else {
+			http.Redirect(w, r, "/admin/usermanagement", 302)
+		}
+	}
+}
+
+type PageAdminEditStruct struct {
+	PageAdminStruct
+	Target	UserStruct
+}
+
+// "/admin/usermanagement/edituser/{id}"
+func PageAdminEditUser(w http.ResponseWriter, r *http.Request) {
+	user, _ := GetCurrentUser(r)
+	target, err := GetUserById(mux.Vars(r)["id"])
+	if err != nil {
+		HTTPError(w, r, err)
+		return
+	}
+	admin, err := Admin(user.Username)
+	if err != nil {
+		HTTPError(w, r, err)
+		return
+	}
+
+	data := PageAdminEditStruct{admin, target}
+	tmpl := ParseTemplate(w, r, "admin/edituser.html")
+	tmpl.Execute(w, data)
+}
+
+// handle the form on "/admin/usermanagement/edituser/{id}"
+// username of accounts from LDAP or single sign-on stays as the directory has it
+func AdminEditUser(w http.ResponseWriter, r *http.Request) {
+	user, _ := GetCurrentUser(r)
+	target, err := GetUserById(mux.Vars(r)["id"])
+	if err != nil {
+		HTTPError(w, r, err)
+		return
+	}
+
+	fusername := strings.TrimSpace(r.FormValue("username"))
+	femail := strings.TrimSpace(r.FormValue("email"))
+	fusergroup := r.FormValue("usergroup")
+	if target.AuthSource != authSourceLocal {
+		fusername = target.Username
+	}
+
+	admin, err := Admin(user.Username)
+	if err != nil {
+		HTTPError(w, r, err)
+		return
+	}
+	taken := false
+	if fusername != target.Username {
+		taken, err = UsernameExist(fusername)
+		if err != nil {
+			HTTPError(w, r, err)
+			return
+		}
+	}
+	known, err := UsergroupExist(fusergroup)
+	if err != nil {
+		HTTPError(w, r, err)
+		return
+	}
+
+	data := PageAdminEditStruct{admin, target}
+	self := target.Id == admin.Id
+	errChange := CheckAdminChange(admin.Id, target.Id, fusergroup, false)
+	if errChange != nil && !adminChangeRefused(errChange) {
+		HTTPError(w, r, errChange)
+		return
+	}
+
+	if fusername == "" {
+		data.Message = "Error. Username is required."
+	} else if taken {
+		data.Message = "Error. Username " + fusername + " already exists."
+	} else if !known {
+		data.Message = "Error. Unknown usergroup " + fusergroup + "."
+	} else if errChange != nil {
+		data.Message = "Error. " + errChange.Error() + "."
+	} else {
+		before, err := AuditUser(target.Id)
+		if err != nil {
+			HTTPError(w, r, err)
+			return
+		}
+		if err := UpdateUser(target.Id, fusername, femail, fusergroup); err != nil {
+			HTTPError(w, r, err)
+			return
+		}
+
+		if fusername != target.Username {
+			// cookie sessions refer to the user by username, so the old ones cannot be kept
+			if self {
+				session, _ := store.Get(r, "cookie-name")
+				session.Values["username"] = fusername
+				session.Save(r, w)
+				err = RevokeUserSessions(target.Id, CurrentSessionId(r))
+				user.Username = fusername
 			} else {
-				// finish
-				http.Redirect(w, r, "/admin/usermanagement", 302)
+				err = RevokeUserSessions(target.Id, "")
 			}
-		} else {
-			http.Redirect(w, r, "/user", 302)
+			if err != nil {
+				HTTPError(w, r, err)
+				return
+			}
+			if err := LoginThrottleReset(throttleScopeUser, target.Username); err != nil {
+				HTTPError(w, r, err)
+				return
+			}
+		}
+
+		after, err := AuditUser(target.Id)
+		if err != nil {
+			HTTPError(w, r, err)
+			return
 		}
+		if err := AuditLog(r, user.Username, auditEntityUser, target.Id, auditActionUpdate, before, after); err != nil {
+			HTTPError(w, r, err)
+			return
+		}
+
+		data.PageAdminStruct, err = Admin(user.Username)
+		if err != nil {
+			HTTPError(w, r, err)
+			return
+		}
+		data.Target, err = GetUserById(target.Id)
+		if err != nil {
+			HTTPError(w, r, err)
+			return
+		}
+		data.Message = "User updated"
+	}
+
+	tmpl := ParseTemplate(w, r, "admin/edituser.html")
+	tmpl.Execute(w, data)
+}
+
+// handle disabling of an account, which keeps its data but blocks login and ends its sessions
+func AdminDisableUser(w http.ResponseWriter, r *http.Request) {
+	adminSetDisabled(w, r, true)
+}
+
+// handle re-enabling of a disabled account
+func AdminEnableUser(w http.ResponseWriter, r *http.Request) {
+	adminSetDisabled(w, r, false)
+}
+
+func adminSetDisabled(w http.ResponseWriter, r *http.Request, disabled bool) {
+	user, _ := GetCurrentUser(r)
+	id := mux.Vars(r)["id"]
+
+	if _, err := GetUserById(id); err != nil {
+		HTTPError(w, r, err)
+		return
+	}
+
+	if disabled {
+		if err := CheckAdminChange(user.Id, id, "", true); adminChangeRefused(err) {
+			renderUserManagement(w, r, user.Username, user.Usergroup, "Error. " + err.Error() + ".")
+			return
+		} else if err != nil {
+			HTTPError(w, r, err)
+			return
+		}
+	}
+
+	if err := SetUserDisabled(id, disabled); err != nil {
+		HTTPError(w, r, err)
+		return
+	}
+	if disabled {
+		if err := RevokeUserSessions(id, ""); err != nil {
+			HTTPError(w, r, err)
+			return
+		}
+		if err := AuditLog(r, user.Username, auditEntityUser, id, "disable", nil, nil); err != nil {
+			HTTPError(w, r, err)
+			return
+		}
+	} else {
+		if err := AuditLog(r, user.Username, auditEntityUser, id, "enable", nil, nil); err != nil {
+			HTTPError(w, r, err)
+			return
+		}
+	}
+
+	http.Redirect(w, r, "/admin/usermanagement", 302)
+}
+
+// function to check that changing target user leaves the system manageable and gives the actor nothing it does not hold
+// removing is true for deletion or disabling, otherwise newUsergroup is the usergroup about to be assigned
+// returns ErrOwnAccount, ErrLastAdmin or ErrPermissionExceeded to refuse the change, any other error is from looking up the users
+func CheckAdminChange(actorId string, targetId string, newUsergroup string, removing bool) error {
+	actor, err := GetUserById(actorId)
+	if err != nil {
+		return err
+	}
+	target, err := GetUserById(targetId)
+	if err != nil {
+		return err
+	}
+
+	if !UsergroupCovers(actor.Usergroup, target.Usergroup) {
+		return ErrPermissionExceeded
+	}
+	if !removing && !UsergroupCovers(actor.Usergroup, newUsergroup) {
+		return ErrPermissionExceeded
+	}
+
+	if removing && actorId == targetId {
+		return ErrOwnAccount
+	}
+	if !removing && actorId == targetId && !AccessAdmin(newUsergroup) {
+		return ErrOwnAccount
+	}
+
+	losesAdmin := removing || !AccessAdmin(newUsergroup)
+	if losesAdmin && AccessAdmin(target.Usergroup) && !target.Disabled {
+		count, err := ActiveAdminCount(targetId)
+		if err != nil {
+			return err
+		}
+		if count == 0 {
+			return ErrLastAdmin
+		}
+	}
+
+	return nil
+}
+
+// determines whether err is CheckAdminChange() refusing the change
+func adminChangeRefused(err error) bool {
+	return err == ErrOwnAccount || err == ErrLastAdmin || err == ErrPermissionExceeded
+}
+
+// function to count enabled users with admin access, not counting user id except
+func ActiveAdminCount(except string) (int, error) {
+	users, err := AllUser()
+	if err != nil {
+		return 0, err
+	}
+
+	count := 0
+	for _, user := range users {
+		if user.Id != except && !user.Disabled && AccessAdmin(user.Usergroup) {
+			count++
+		}
+	}
+	return count, nil
+}
+
+// function to count enabled users with admin access who are not in usergroup
+func ActiveAdminCountOutside(usergroup string) (int, error) {
+	users, err := AllUser()
+	if err != nil {
+		return 0, err
+	}
+
+	count := 0
+	for _, user := range users {
+		if user.Usergroup != usergroup && !user.Disabled && AccessAdmin(user.Usergroup) {
+			count++
+		}
+	}
+	return count, nil
+}
+
+// function to update the editable details of user id
+func UpdateUser(id string, username string, email string, usergroup string) error {
+	return defaultStore.Users.Update(id, username, email, usergroup)
+}
+
+// function to set disabled status of user id
+func SetUserDisabled(id string, disabled bool) error {
+	return defaultStore.Users.SetDisabled(id, disabled)
+}
+
+type PageAdminPasswordStruct struct {
+	PageAdminStruct
+	Target	UserStruct
+}
+
+// "/admin/usermanagement/resetpassword/{id}"
+func PageAdminResetPassword(w http.ResponseWriter, r *http.Request) {
+	user, _ := GetCurrentUser(r)
+	target, err := GetUserById(mux.Vars(r)["id"])
+	if err != nil {
+		HTTPError(w, r, err)
+		return
+	}
+	if target.AuthSource != authSourceLocal {
+		http.Redirect(w, r, "/admin/usermanagement", 302)
+		return
+	}
+	admin, err := Admin(user.Username)
+	if err != nil {
+		HTTPError(w, r, err)
+		return
+	}
+
+	data := PageAdminPasswordStruct{admin, target}
+	tmpl := ParseTemplate(w, r, "admin/resetpassword.html")
+	tmpl.Execute(w, data)
+}
+
+// handle the form on "/admin/usermanagement/resetpassword/{id}"
+// the user is signed out everywhere and, unless unticked, has to choose a new password on next login
+func AdminResetPassword(w http.ResponseWriter, r *http.Request) {
+	user, _ := GetCurrentUser(r)
+	target, err := GetUserById(mux.Vars(r)["id"])
+	if err != nil {
+		HTTPError(w, r, err)
+		return
+	}
+	if target.AuthSource != authSourceLocal {
+		http.Redirect(w, r, "/admin/usermanagement", 302)
+		return
+	}
+	admin, err := Admin(user.Username)
+	if err != nil {
+		HTTPError(w, r, err)
+		return
+	}
+
+	newpassword := r.FormValue("newpassword")
+	confirmpassword := r.FormValue("confirmpassword")
+	mustchange := r.FormValue("mustchange") == "1"
+
+	data := PageAdminPasswordStruct{admin, target}
+
+	if !UsergroupCovers(user.Usergroup, target.Usergroup) {
+		data.Message = "Error. " + ErrPermissionExceeded.Error() + "."
+	} else if newpassword != confirmpassword {
+		data.Message = "Error. Invalid password confirmation."
+	} else if errPolicy := PasswordPolicyCheck(target.Username, newpassword); errPolicy != nil {
+		data.Message = "Error. " + errPolicy.Error() + "."
 	} else {
-		http.Redirect(w, r, "/", 302)
+		if err := SetPassword(target.Id, newpassword, mustchange); err != nil {
+			HTTPError(w, r, err)
+			return
+		}
+		if err := RevokeUserSessions(target.Id, ""); err != nil {
+			HTTPError(w, r, err)
+			return
+		}
+		if err := LoginThrottleReset(throttleScopeUser, target.Username); err != nil {
+			HTTPError(w, r, err)
+			return
+		}
+		if err := AuditLog(r, user.Username, auditEntityUser, target.Id, "password reset", nil, nil); err != nil {
+			HTTPError(w, r, err)
+			return
+		}
+
+		data.Message = "Password of " + target.Username + " has been reset"
 	}
-}
\ No newline at end of file
+
+	tmpl := ParseTemplate(w, r, "admin/resetpassword.html")
+	tmpl.Execute(w, data)
+}
+
+// function to get a user by id, sql.ErrNoRows if there is no such user
+func GetUserById(id string) (UserStruct, error) {
+	return defaultStore.Users.ById(id)
+}
+
+type PageAdminSecurityStruct struct {
+	PageAdminStruct
+	Require2FAAdmin	bool
+	Message			string
+}
+
+// "/admin/security"
+func PageAdminSecurity(w http.ResponseWriter, r *http.Request) {
+	user, _ := GetCurrentUser(r)
+	admin, err := Admin(user.Username)
+	if err != nil {
+		HTTPError(w, r, err)
+		return
+	}
+	require, err := GetSettingBool(settingRequire2FAAdmin)
+	if err != nil {
+		HTTPError(w, r, err)
+		return
+	}
+
+	data := PageAdminSecurityStruct{
+		admin,
+		require,
+		"",
+	}
+	tmpl := ParseTemplate(w, r, "admin/security.html")
+	tmpl.Execute(w, data)
+}
+
+// handle the form on "/admin/security"
+func AdminSecuritySubmit(w http.ResponseWriter, r *http.Request) {
+	user, _ := GetCurrentUser(r)
+	before, err := GetSettingBool(settingRequire2FAAdmin)
+	if err != nil {
+		HTTPError(w, r, err)
+		return
+	}
+	after := r.FormValue("require_2fa_admin") == "1"
+	if err := SetSettingBool(settingRequire2FAAdmin, after); err != nil {
+		HTTPError(w, r, err)
+		return
+	}
+	if after != before {
+		if err := AuditLog(r, user.Username, auditEntitySetting, settingRequire2FAAdmin, auditActionUpdate, before, after); err != nil {
+			HTTPError(w, r, err)
+			return
+		}
+	}
+
+	admin, err := Admin(user.Username)
+	if err != nil {
+		HTTPError(w, r, err)
+		return
+	}
+
+	data := PageAdminSecurityStruct{
+		admin,
+		after,
+		"Setting saved",
+	}
+	tmpl := ParseTemplate(w, r, "admin/security.html")
+	tmpl.Execute(w, data)
+}
@@ -0,0 +1,124 @@
+package main
+
+import (
+	"strings"
+	"testing"
+	"database/sql"
+	"net/url"
+	"net/http/httptest"
+	"github.com/gorilla/mux"
+)
+
+// function to add usergroup name granting permissions
+func testUsergroup(t *testing.T, name string, permissions ...string) {
+	t.Helper()
+	if err := CreateUsergroup(name, ""); err != nil {
+		t.Fatal(err)
+	}
+	granted := map[string]bool{}
+	for _, p := range permissions {
+		granted[p] = true
+	}
+	if err := SetUsergroupPermissions(name, "", granted); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestCheckAdminChange(t *testing.T) {
+	s := testStore(t)
+	testUsergroup(t, "helpdesk", "access_admin", "update_own_password")
+	admin := testUser(t, s, "alice", "admin")
+	helpdesk := testUser(t, s, "bob", "helpdesk")
+	normal := testUser(t, s, "carol", "normal")
+
+	tests := []struct {
+		actor		string
+		target		string
+		usergroup	string
+		removing	bool
+		want		error
+	}{
+		{admin, normal, "helpdesk", false, nil},
+		{helpdesk, normal, "helpdesk", false, nil},
+		{helpdesk, normal, "admin", false, ErrPermissionExceeded},
+		{helpdesk, helpdesk, "admin", false, ErrPermissionExceeded},
+		{helpdesk, admin, "normal", false, ErrPermissionExceeded},
+		{helpdesk, admin, "", true, ErrPermissionExceeded},
+		{helpdesk, normal, "", true, nil},
+		{admin, admin, "normal", false, ErrOwnAccount},
+	}
+
+	for _, test := range tests {
+		if err := CheckAdminChange(test.actor, test.target, test.usergroup, test.removing); err != test.want {
+			t.Errorf("CheckAdminChange(%s, %s, %q, %v) = %v, want %v", test.actor, test.target, test.usergroup, test.removing, err, test.want)
+		}
+	}
+}
+
+// function to post the permissions of usergroup name as user, returns the page
+func testUsergroupUpdate(t *testing.T, user CurrentUser, name string, permissions ...string) string {
+	t.Helper()
+	r := httptest.NewRequest("POST", "/admin/usergroup/update/" + name, strings.NewReader(url.Values{"permission": permissions}.Encode()))
+	r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	r = testAsUser(mux.SetURLVars(r, map[string]string{"name": name}), user)
+	w := httptest.NewRecorder()
+	AdminUsergroupUpdate(w, r)
+	return w.Body.String()
+}
+
+func TestAdminUsergroupUpdate(t *testing.T) {
+	s := testStore(t)
+	testUsergroup(t, "helpdesk", "access_admin", "update_own_password")
+	// holds everything like admin, but has no users
+	testUsergroup(t, "root", "update_own_password", "update_user_password", "access_admin", "access_itdb", "itdb_read_sibu", "itdb_write_sibu", "itdb_delete_sibu", "itdb_read_kapit", "itdb_write_kapit", "itdb_delete_kapit")
+	admin := CurrentUser{testUser(t, s, "alice", "admin"), "alice", "admin"}
+	helpdesk := CurrentUser{testUser(t, s, "bob", "helpdesk"), "bob", "helpdesk"}
+
+	// granting more than the actor holds, to its own usergroup or another one
+	testUsergroupUpdate(t, helpdesk, "helpdesk", "access_admin", "update_user_password")
+	testUsergroupUpdate(t, helpdesk, "normal", "update_own_password", "access_itdb")
+	if UsergroupPermission("update_user_password", "helpdesk") || UsergroupPermission("access_itdb", "normal") {
+		t.Errorf("helpdesk granted permissions it does not hold")
+	}
+
+	// changing a usergroup holding more than the actor
+	testUsergroupUpdate(t, helpdesk, "admin", "access_admin")
+	if !UsergroupPermission("update_user_password", "admin") {
+		t.Errorf("helpdesk removed permissions from admin")
+	}
+
+	// at least one enabled user keeps admin access
+	testUsergroupUpdate(t, admin, "helpdesk", "update_own_password")
+	if UsergroupPermission("access_admin", "helpdesk") {
+		t.Errorf("access_admin not removed from helpdesk")
+	}
+	root := CurrentUser{"", "dave", "root"}
+	testUsergroupUpdate(t, root, "admin", "update_own_password")
+	if !UsergroupPermission("access_admin", "admin") {
+		t.Errorf("access_admin removed from the last usergroup with an enabled admin")
+	}
+}
+
+func TestDeleteUsergroup(t *testing.T) {
+	s := testStore(t)
+	testUsergroup(t, "helpdesk", "access_admin")
+	testUsergroup(t, "retired", "access_itdb")
+	testUser(t, s, "bob", "helpdesk")
+
+	if err := DeleteUsergroup("helpdesk"); err != ErrUsergroupInUse {
+		t.Errorf("DeleteUsergroup(helpdesk) error = %v, want ErrUsergroupInUse", err)
+	}
+	if err := DeleteUsergroup("nonexistent"); err != sql.ErrNoRows {
+		t.Errorf("DeleteUsergroup(nonexistent) error = %v, want sql.ErrNoRows", err)
+	}
+
+	if err := DeleteUsergroup("retired"); err != nil {
+		t.Fatal(err)
+	}
+	if exists, err := UsergroupExist("retired"); err != nil || exists {
+		t.Errorf("UsergroupExist(retired) = %v, %v after delete", exists, err)
+	}
+	if UsergroupPermission("access_itdb", "retired") {
+		t.Errorf("permissions of retired kept after delete")
+	}
+}
@@ -0,0 +1,275 @@
+// personal API tokens for scripted access (table api_token)
+// a request carrying "Authorization: Bearer <token>" is handled as if the owner of the token was logged in,
+// so every handler applies the same usergroup permissions. only a hash of the token is stored
+package main
+
+import (
+	"log"
+	"time"
+	"context"
+	"strconv"
+	"strings"
+	"net/http"
+	"database/sql"
+	"crypto/sha256"
+	"encoding/hex"
+	"github.com/gorilla/mux"
+)
+
+// prefix of every token, makes them easy to recognise in scripts and secret scanners
+const apiTokenPrefix = "frg_"
+
+type apiContextKey struct{}
+
+type APIToken struct {
+	Id			string
+	UserId		string
+	Username	string
+	Name		string
+	Created		time.Time
+	Expires		time.Time // zero when the token never expires
+	LastUsed	time.Time // zero when never used
+}
+
+type PageAPITokenStruct struct {
+	Username	string
+	Usergroup	string
+	Tokens		[]APIToken
+	NewToken	string // shown once, right after creation
+	Message		string
+}
+
+func APITokenHandler(user *mux.Router) {
+	user.HandleFunc("/account/tokens", SessionOnly(PageAPITokens))
+	user.HandleFunc("/account/tokens/create", SessionOnly(APITokenCreate)).Methods("POST")
+	user.HandleFunc("/account/tokens/revoke/{id}", SessionOnly(APITokenRevoke)).Methods("POST")
+}
+
+func (p PageAPITokenStruct) UserPermission(permission string, usergroup string) bool {
+	return UsergroupPermission(permission, usergroup)
+}
+
+func (t APIToken) Expired() bool {
+	return !t.Expires.IsZero() && time.Now().After(t.Expires)
+}
+
+// "/user/account/tokens"
+func PageAPITokens(w http.ResponseWriter, r *http.Request) {
+	user, _ := GetCurrentUser(r)
+	tokens, err := GetAPITokens(user.Id)
+	if err != nil {
+		HTTPError(w, r, err)
+		return
+	}
+	data := PageAPITokenStruct{
+		user.Username,
+		user.Usergroup,
+		tokens,
+		"",
+		"",
+	}
+	tmpl := ParseTemplate(w, r, "user/tokens.html")
+	tmpl.Execute(w, data)
+}
+
+// handle the new token form on "/user/account/tokens"
+// tokens cannot be minted with a token, otherwise a leaked one could be turned into a permanent one
+func APITokenCreate(w http.ResponseWriter, r *http.Request) {
+	user, _ := GetCurrentUser(r)
+
+	name := strings.TrimSpace(r.FormValue("name"))
+	days, errDays := strconv.Atoi(r.FormValue("expiry"))
+
+	data := PageAPITokenStruct{Username: user.Username, Usergroup: user.Usergroup}
+
+	if name == "" {
+		data.Message = "Error. Token name is required."
+	} else if errDays != nil || days < 0 {
+		data.Message = "Error. Invalid expiry."
+	} else {
+		token, err := CreateAPIToken(user.Id, name, days)
+		if err != nil {
+			HTTPError(w, r, err)
+			return
+		}
+		data.NewToken = token
+		data.Message = "Token created. Copy it now, it will not be shown again."
+		log.Println("api token", name, "created for", user.Username)
+	}
+
+	tokens, err := GetAPITokens(user.Id)
+	if err != nil {
+		HTTPError(w, r, err)
+		return
+	}
+	data.Tokens = tokens
+	tmpl := ParseTemplate(w, r, "user/tokens.html")
+	tmpl.Execute(w, data)
+}
+
+// handle revoking one of own tokens
+func APITokenRevoke(w http.ResponseWriter, r *http.Request) {
+	user, _ := GetCurrentUser(r)
+	if err := RevokeAPIToken(mux.Vars(r)["id"], user.Id); err != nil {
+		HTTPError(w, r, err)
+		return
+	}
+	http.Redirect(w, r, "/user/account/tokens", 302)
+}
+
+// Functions that handles process and procedures and does not involve returning HTML page
+//
+//
+
+func apiTokenHash(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+// function to return the token in the Authorization header, empty if there is none
+func bearerToken(r *http.Request) string {
+	header := r.Header.Get("Authorization")
+	if len(header) > 7 && strings.EqualFold(header[:7], "Bearer ") {
+		return strings.TrimSpace(header[7:])
+	}
+	return ""
+}
+
+// determines whether the request was authenticated with an API token, see APITokenMiddleware
+func APIRequest(r *http.Request) bool {
+	_, ok := r.Context().Value(apiContextKey{}).(APIToken)
+	return ok
+}
+
+// middleware authenticating requests carrying a bearer token
+// the owner is put into the (unsaved) session of this request only, so handlers need no special treatment
+func APITokenMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		token := bearerToken(r)
+		if token == "" {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		t, ok, err := LookupAPIToken(token)
+		if err != nil {
+			HTTPError(w, r, err)
+			return
+		}
+		if !ok {
+			log.Println("invalid api token from", ClientIP(r))
+			w.Header().Set("WWW-Authenticate", `Bearer error="invalid_token"`)
+			http.Error(w, "Unauthorized - invalid or expired token", http.StatusUnauthorized)
+			return
+		}
+
+		session, _ := store.Get(r, "cookie-name")
+		session.Values["authenticated"] = true
+		session.Values["id"] = t.UserId
+		session.Values["username"] = t.Username
+		session.Values["loggedon"] = time.Now().Format(time.RFC822)
+		session.Values["sid"] = ""
+		session.Values["must_change_password"] = false
+
+		next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), apiContextKey{}, t)))
+	})
+}
+
+// function to create a token for user id, expiring after days (0 never expires)
+// returns the token itself, which is not stored anywhere
+func CreateAPIToken(id string, name string, days int) (string, error) {
+	db := coreDB()
+
+	token := apiTokenPrefix + randomToken()
+	now := time.Now()
+	var expires int64
+	if days > 0 {
+		expires = now.AddDate(0, 0, days).Unix()
+	}
+
+	query := `INSERT INTO api_token (user_id, name, token_hash, created, expires, last_used) VALUES (?, ?, ?, ?, ?, 0)`
+	_, err := db.Exec(query, id, name, apiTokenHash(token), now.Unix(), expires)
+	if err != nil {
+		return "", err
+	}
+
+	return token, nil
+}
+
+// function to find the valid token matching token, recording its use
+func LookupAPIToken(token string) (APIToken, bool, error) {
+	if !strings.HasPrefix(token, apiTokenPrefix) {
+		return APIToken{}, false, nil
+	}
+
+	db := coreDB()
+
+	t := APIToken{}
+	var created, expires, lastUsed int64
+	query := `SELECT t.id, t.user_id, u.username, t.name, t.created, t.expires, t.last_used FROM api_token t JOIN user u ON u.id = t.user_id WHERE t.token_hash = ? AND u.disabled = 0`
+	err := db.QueryRow(query, apiTokenHash(token)).Scan(&t.Id, &t.UserId, &t.Username, &t.Name, &created, &expires, &lastUsed)
+	if err == sql.ErrNoRows {
+		return APIToken{}, false, nil
+	} else if err != nil {
+		return APIToken{}, false, err
+	}
+	t.Created = time.Unix(created, 0)
+	if expires > 0 {
+		t.Expires = time.Unix(expires, 0)
+	}
+	if t.Expired() {
+		return APIToken{}, false, nil
+	}
+
+	now := time.Now()
+	t.LastUsed = now
+	if now.Sub(time.Unix(lastUsed, 0)) > sessionTouchInterval {
+		_, err = db.Exec(`UPDATE api_token SET last_used = ? WHERE id = ?`, now.Unix(), t.Id)
+		if err != nil {
+			return APIToken{}, false, err
+		}
+	}
+
+	return t, true, nil
+}
+
+// function to list tokens of user id, newest first
+func GetAPITokens(id string) ([]APIToken, error) {
+	db := coreDB()
+
+	var tokens []APIToken
+
+	query := `SELECT id, user_id, name, created, expires, last_used FROM api_token WHERE user_id = ? ORDER BY created DESC`
+	row, err := db.Query(query, id)
+	if err != nil {
+		return nil, err
+	}
+
+	defer row.Close()
+	for row.Next() {
+		t := APIToken{}
+		var created, expires, lastUsed int64
+		err := row.Scan(&t.Id, &t.UserId, &t.Name, &created, &expires, &lastUsed)
+		if err != nil {
+			return nil, err
+		}
+		t.Created = time.Unix(created, 0)
+		if expires > 0 {
+			t.Expires = time.Unix(expires, 0)
+		}
+		if lastUsed > 0 {
+			t.LastUsed = time.Unix(lastUsed, 0)
+		}
+		tokens = append(tokens, t)
+	}
+
+	return tokens, row.Err()
+}
+
+// function to delete token id, as long as it belongs to user id
+func RevokeAPIToken(tokenId string, id string) error {
+	db := coreDB()
+
+	_, err := db.Exec(`DELETE FROM api_token WHERE id = ? AND user_id = ?`, tokenId, id)
+	return err
+}
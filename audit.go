@@ -0,0 +1,236 @@
+// append-only audit trail of changes to users, usergroups, PCs, printers and settings (table audit_log)
+// each entry records who changed what and when, with the entity before and after the change as JSON
+package main
+
+import (
+	"time"
+	"strconv"
+	"net/http"
+	"database/sql"
+	"encoding/json"
+	"github.com/gorilla/mux"
+)
+
+// values of audit_log.entity
+const (
+	auditEntityUser = "user"
+	auditEntityPC = "pc"
+	auditEntityPrinter = "printer"
+	auditEntitySetting = "setting"
+	auditEntityUsergroup = "usergroup"
+)
+
+// values of audit_log.action
+const (
+	auditActionCreate = "create"
+	auditActionUpdate = "update"
+	auditActionDelete = "delete"
+)
+
+// entries shown at most on "/admin/audit"
+const auditPageLimit = 500
+
+type AuditEntry struct {
+	Id			int
+	Created		time.Time
+	Actor		string
+	Ip			string
+	Entity		string
+	EntityId	string
+	Action		string
+	Before		string
+	After		string
+}
+
+type AuditFilter struct {
+	Actor	string
+	Entity	string
+	From	string // date as yyyy-mm-dd, inclusive
+	To		string // date as yyyy-mm-dd, inclusive
+}
+
+type PageAuditStruct struct {
+	Username	string
+	Usergroup	string
+	Filter		AuditFilter
+	Entities	[]string
+	Entries		[]AuditEntry
+	Limit		int
+}
+
+func AuditHandler(admin *mux.Router) {
+	admin.HandleFunc("/audit", PageAdminAudit)
+}
+
+func (p PageAuditStruct) UserPermission(permission string, usergroup string) bool {
+	return UsergroupPermission(permission, usergroup)
+}
+
+// "/admin/audit?actor=&entity=&from=&to="
+func PageAdminAudit(w http.ResponseWriter, r *http.Request) {
+	user, _ := GetCurrentUser(r)
+	filter := AuditFilter{
+		r.FormValue("actor"),
+		r.FormValue("entity"),
+		r.FormValue("from"),
+		r.FormValue("to"),
+	}
+	entries, err := GetAuditEntries(filter, auditPageLimit)
+	if err != nil {
+		HTTPError(w, r, err)
+		return
+	}
+	data := PageAuditStruct{
+		user.Username,
+		user.Usergroup,
+		filter,
+		[]string{auditEntityUser, auditEntityUsergroup, auditEntityPC, auditEntityPrinter, auditEntitySetting},
+		entries,
+		auditPageLimit,
+	}
+	tmpl := ParseTemplate(w, r, "admin/audit.html")
+	tmpl.Execute(w, data)
+}
+
+// Functions that handles process and procedures and does not involve returning HTML page
+//
+//
+
+// function to record a change made by actor, before or after is nil for create and delete respectively
+// failing to write the audit trail does not undo the change, the caller reports the error
+// changes made while impersonating are recorded as "<admin> as <user>", see impersonate.go
+func AuditLog(r *http.Request, actor string, entity string, entityId string, action string, before interface{}, after interface{}) error {
+	if admin, impersonating := Impersonator(r); impersonating && admin != actor {
+		actor = admin + " as " + actor
+	}
+
+	beforeJSON, err := auditJSON(before)
+	if err != nil {
+		return err
+	}
+	afterJSON, err := auditJSON(after)
+	if err != nil {
+		return err
+	}
+
+	db := coreDB()
+
+	query := `INSERT INTO audit_log (created, actor, ip, entity, entity_id, action, before, after) VALUES (?, ?, ?, ?, ?, ?, ?, ?)`
+	_, err = db.Exec(query, time.Now().Unix(), actor, ClientIP(r), entity, entityId, action, beforeJSON, afterJSON)
+	return err
+}
+
+func auditJSON(value interface{}) (string, error) {
+	if value == nil {
+		return "", nil
+	}
+	b, err := json.Marshal(value)
+	if err != nil {
+		return "", err
+	}
+	return string(b), nil
+}
+
+// function to list audit entries matching filter, newest first
+func GetAuditEntries(filter AuditFilter, limit int) ([]AuditEntry, error) {
+	db := coreDB()
+
+	var entries []AuditEntry
+
+	query := `SELECT id, created, actor, ip, entity, entity_id, action, before, after FROM audit_log WHERE 1=1`
+	args := []interface{}{}
+	if filter.Actor != "" {
+		query += ` AND actor = ?`
+		args = append(args, filter.Actor)
+	}
+	if filter.Entity != "" {
+		query += ` AND entity = ?`
+		args = append(args, filter.Entity)
+	}
+	if from, err := time.ParseInLocation("2006-01-02", filter.From, time.Local); err == nil {
+		query += ` AND created >= ?`
+		args = append(args, from.Unix())
+	}
+	if to, err := time.ParseInLocation("2006-01-02", filter.To, time.Local); err == nil {
+		query += ` AND created < ?`
+		args = append(args, to.AddDate(0, 0, 1).Unix())
+	}
+	query += ` ORDER BY id DESC LIMIT ` + strconv.Itoa(limit)
+
+	row, err := db.Query(query, args...)
+	if err != nil {
+		return nil, err
+	}
+
+	defer row.Close()
+	for row.Next() {
+		e := AuditEntry{}
+		var created int64
+		err := row.Scan(&e.Id, &created, &e.Actor, &e.Ip, &e.Entity, &e.EntityId, &e.Action, &e.Before, &e.After)
+		if err != nil {
+			return nil, err
+		}
+		e.Created = time.Unix(created, 0)
+		entries = append(entries, e)
+	}
+
+	return entries, row.Err()
+}
+
+// function to return the audited values of user id, nil if there is no such user
+// the password is deliberately left out
+func AuditUser(id string) (interface{}, error) {
+	db := coreDB()
+
+	var username, email, usergroup, source, displayName, phoneExt string
+	var disabled bool
+	query := `SELECT username, email, usergroup, auth_source, disabled, display_name, phone_ext FROM user WHERE id = ?`
+	err := db.QueryRow(query, id).Scan(&username, &email, &usergroup, &source, &disabled, &displayName, &phoneExt)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+
+	return map[string]interface{}{
+		"username": username,
+		"email": email,
+		"usergroup": usergroup,
+		"auth_source": source,
+		"disabled": disabled,
+		"display_name": displayName,
+		"phone_ext": phoneExt,
+	}, nil
+}
+
+// function to return the audited values of PC id in office, nil if there is no such PC
+func AuditPC(office string, id int) (interface{}, error) {
+	pc, err := defaultStore.PCs.ById(office, id)
+	if err == sql.ErrNoRows || err == ErrUnknownOffice {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	return pc, nil
+}
+
+// function to return the audited values of printer rowid in office, nil if there is no such printer
+func AuditPrinter(office string, rowid int) (interface{}, error) {
+	p, err := defaultStore.Printers.ByRowid(office, rowid)
+	if err == sql.ErrNoRows || err == ErrUnknownOffice {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+
+	return map[string]interface{}{
+		"office": p.Office,
+		"rowid": p.Rowid,
+		"printermodel": p.Printermodel,
+		"printerno": p.Printerno,
+		"printertype": p.Printertype,
+		"notes": p.Notes.String,
+		"host": p.Host.Int64,
+		"nickname": p.Nickname,
+	}, nil
+}
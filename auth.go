@@ -0,0 +1,159 @@
+// access control of the "/user", "/admin" and "/itdb" subrouters (see main.go)
+// RequireLogin loads the logged in user once into the request context, the area permission is declared on the
+// subrouter with RequirePermission() and routes needing more declare it with Require() or RequireOffice()
+package main
+
+import (
+	"context"
+	"strings"
+	"net/url"
+	"net/http"
+	"github.com/gorilla/mux"
+)
+
+// the user a request is made by, see RequireLogin
+type CurrentUser struct {
+	Id			string
+	Username	string
+	Usergroup	string
+}
+
+type currentUserKey struct{}
+
+// session key holding where to go after login, see LoginNext
+const loginNextKey = "login_next"
+
+// middleware to let only logged in users through, with the user loaded into the request context
+// anonymous users are sent to login, which brings them back to the page they asked for
+func RequireLogin(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		authenticated, err := IsAuthenticated(w,r)
+		if err != nil {
+			HTTPError(w, r, err)
+			return
+		}
+		if !authenticated {
+			if r.Method == http.MethodGet || r.Method == http.MethodHead {
+				http.Redirect(w, r, "/?next=" + url.QueryEscape(r.URL.RequestURI()), 302)
+			} else {
+				http.Redirect(w, r, "/", 302)
+			}
+			return
+		}
+
+		session, _ := store.Get(r, "cookie-name")
+		username, _ := session.Values["username"].(string)
+		id, err := GetUserId(username)
+		if err != nil {
+			HTTPError(w, r, err)
+			return
+		}
+		usergroup, err := GetUsergroup(id)
+		if err != nil {
+			HTTPError(w, r, err)
+			return
+		}
+
+		user := CurrentUser{id, username, usergroup}
+		next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), currentUserKey{}, user)))
+	})
+}
+
+// function to return the user loaded by RequireLogin, false outside of the protected subrouters
+func GetCurrentUser(r *http.Request) (CurrentUser, bool) {
+	user, ok := r.Context().Value(currentUserKey{}).(CurrentUser)
+	return user, ok
+}
+
+// middleware to refuse users whose usergroup lacks permission, for use on a subrouter after RequireLogin
+func RequirePermission(permission string) mux.MiddlewareFunc {
+	return func(next http.Handler) http.Handler {
+		return Require(permission, next.ServeHTTP)
+	}
+}
+
+// function to let only users whose usergroup has permission through to h
+func Require(permission string, h http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		user, _ := GetCurrentUser(r)
+		if !UsergroupPermission(permission, user.Usergroup) {
+			PageForbidden(w, r)
+			return
+		}
+		h(w, r)
+	}
+}
+
+// function to let only users with level (itdbRead, itdbWrite or itdbDelete) on the {office} of the route through to h
+func RequireOffice(level string, h http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		office := mux.Vars(r)["office"]
+		if _, err := pcTable(office); err != nil {
+			HTTPError(w, r, err)
+			return
+		}
+
+		user, _ := GetCurrentUser(r)
+		if !ITDBOfficeAccess(user.Usergroup, office, level) {
+			PageForbidden(w, r)
+			return
+		}
+		h(w, r)
+	}
+}
+
+// function to keep h to browser sessions, an API token must not manage tokens or identities
+func SessionOnly(h http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if APIRequest(r) {
+			PageForbidden(w, r)
+			return
+		}
+		h(w, r)
+	}
+}
+
+// function to remember where to go after login, anything but a local path forgets it
+func SetLoginNext(w http.ResponseWriter, r *http.Request, next string) {
+	session, _ := store.Get(r, "cookie-name")
+	if localPath(next) {
+		session.Values[loginNextKey] = next
+	} else {
+		delete(session.Values, loginNextKey)
+	}
+	session.Save(r, w)
+}
+
+// function to take the page remembered by SetLoginNext, "/user" if there is none
+func LoginNext(w http.ResponseWriter, r *http.Request) string {
+	session, _ := store.Get(r, "cookie-name")
+	next, _ := session.Values[loginNextKey].(string)
+	if next == "" {
+		return "/user"
+	}
+	delete(session.Values, loginNextKey)
+	session.Save(r, w)
+	return next
+}
+
+// determines whether path stays on this server, so that a login link cannot send the user elsewhere
+// browsers drop tabs and newlines and read a backslash as a slash, so "/\t/evil.example" would leave too. the same is
+// refused percent-encoded, in case something on the way decodes it
+func localPath(path string) bool {
+	u, err := url.Parse(path)
+	if err != nil || u.Scheme != "" || u.Host != "" {
+		return false
+	}
+
+	for _, p := range []string{path, u.Path} {
+		if !strings.HasPrefix(p, "/") || strings.HasPrefix(p, "//") || strings.ContainsRune(p, '\\') {
+			return false
+		}
+		for _, c := range p {
+			if c < 0x20 || c == 0x7f {
+				return false
+			}
+		}
+	}
+	return true
+}
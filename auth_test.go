@@ -0,0 +1,31 @@
+package main
+
+import (
+	"testing"
+)
+
+func TestLocalPath(t *testing.T) {
+	tests := map[string]bool{
+		"/user": true,
+		"/itdb/sibu/pc?sort=name": true,
+		"/user/account#email": true,
+		"": false,
+		"user": false,
+		"//evil.example": false,
+		"/\\evil.example": false,
+		"/\t/evil.example": false,
+		"/%09/evil.example": false,
+		"/\n/evil.example": false,
+		"/user\\..\\": false,
+		"https://evil.example/": false,
+		"/\x7f/evil.example": false,
+		"/%5Cevil.example": false,
+		"/%2F/evil.example": false,
+	}
+
+	for path, want := range tests {
+		if got := localPath(path); got != want {
+			t.Errorf("localPath(%q) = %v, want %v", path, got, want)
+		}
+	}
+}
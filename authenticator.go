@@ -0,0 +1,246 @@
+// authentication backends
+// each backend verifies a username & password pair; UserLogin tries them in order until one accepts.
+// users coming from an external backend are provisioned into the local user table on first login
+package main
+
+import (
+	"log"
+	"fmt"
+	"errors"
+	"strings"
+	"database/sql"
+	"github.com/go-ldap/ldap/v3"
+)
+
+// values of user.auth_source
+const (
+	authSourceLocal = "local"
+	authSourceLDAP = "ldap"
+	authSourceOIDC = "oidc"
+)
+
+var ErrInvalidCredentials = errors.New("invalid username or password")
+
+// identity returned by a backend once credentials are accepted
+type AuthIdentity struct {
+	Username	string
+	Email		string
+	Usergroup	string
+	Source		string
+	Issuer		string // single sign-on only, together with Subject what the account is matched on
+	Subject		string
+}
+
+// a directory group whose members get usergroup, see MapUsergroup
+type GroupMapping struct {
+	Group		string	`toml:"group"`
+	Usergroup	string	`toml:"usergroup"`
+}
+
+type Authenticator interface {
+	Name() string
+	Authenticate(username string, password string) (AuthIdentity, error)
+}
+
+// active backends, populated by InitAuthenticators() in main()
+var authenticators []Authenticator
+
+// function to build the list of backends from config
+func InitAuthenticators() {
+	authenticators = []Authenticator{LocalAuthenticator{}}
+
+	if config.LDAP.URL != "" {
+		authenticators = append(authenticators, LDAPAuthenticator{config.LDAP})
+	}
+}
+
+// function to try every backend in order, returns the identity of first one accepting the credentials
+// ErrInvalidCredentials means every backend refused them, otherwise the error is that of a failing backend
+func Authenticate(username string, password string) (AuthIdentity, error) {
+	if username == "" || password == "" {
+		return AuthIdentity{}, ErrInvalidCredentials
+	}
+
+	var failure error
+	for _, a := range authenticators {
+		identity, err := a.Authenticate(username, password)
+		if err == nil {
+			return identity, nil
+		}
+		if !errors.Is(err, ErrInvalidCredentials) && failure == nil {
+			// backend failure, e.g. directory unreachable, should not prevent the other backends
+			failure = fmt.Errorf("%s: %w", a.Name(), err)
+		}
+	}
+
+	if failure != nil {
+		return AuthIdentity{}, failure
+	}
+	return AuthIdentity{}, ErrInvalidCredentials
+}
+
+// local password stored in core.db
+type LocalAuthenticator struct{}
+
+func (LocalAuthenticator) Name() string {
+	return authSourceLocal
+}
+
+func (LocalAuthenticator) Authenticate(username string, password string) (AuthIdentity, error) {
+	exists, err := UsernameExist(username)
+	if err != nil {
+		return AuthIdentity{}, err
+	}
+	if !exists {
+		return AuthIdentity{}, ErrInvalidCredentials
+	}
+	source, err := GetUserAuthSource(username)
+	if err != nil {
+		return AuthIdentity{}, err
+	}
+	if source != authSourceLocal {
+		return AuthIdentity{}, ErrInvalidCredentials
+	}
+
+	valid, err := PasswordIsValid(username, password)
+	if err != nil {
+		return AuthIdentity{}, err
+	}
+	if !valid {
+		return AuthIdentity{}, ErrInvalidCredentials
+	}
+
+	// rehash legacy plaintext password now that we know it
+	if err := PasswordUpgrade(username, password); err != nil {
+		return AuthIdentity{}, err
+	}
+
+	return AuthIdentity{Username: username, Source: authSourceLocal}, nil
+}
+
+// function to get backend which owns the account
+func GetUserAuthSource(username string) (string, error) {
+	db := coreDB()
+
+	source := ""
+	err := db.QueryRow(`SELECT auth_source FROM user WHERE username = ?`, username).Scan(&source)
+	if err == sql.ErrNoRows {
+		return "", nil
+	}
+
+	return source, err
+}
+
+// function to create or refresh local row of an externally authenticated user, returns its username
+// an existing account owned by another backend is never taken over
+func ProvisionUser(identity AuthIdentity) (string, error) {
+	db := coreDB()
+
+	if identity.Subject != "" {
+		return provisionSubject(db, identity)
+	}
+
+	source := ""
+	err := db.QueryRow(`SELECT auth_source FROM user WHERE username = ?`, identity.Username).Scan(&source)
+
+	if err == sql.ErrNoRows {
+		// first login, local password is left empty so it can never be used
+		query := `INSERT INTO user (username, email, password, usergroup, auth_source) VALUES (?, ?, '', ?, ?)`
+		_, err = db.Exec(query, identity.Username, identity.Email, identity.Usergroup, identity.Source)
+		if err == nil {
+			log.Println("provisioned user", identity.Username, "from", identity.Source)
+		}
+		return identity.Username, err
+	} else if err != nil {
+		return "", err
+	}
+
+	if source != identity.Source {
+		return "", errors.New("user " + identity.Username + " already exists with auth source " + source)
+	}
+
+	// keep email and usergroup in sync with the backend
+	_, err = db.Exec(`UPDATE user SET email = ?, usergroup = ? WHERE username = ?`, identity.Email, identity.Usergroup, identity.Username)
+	return identity.Username, err
+}
+
+// function to provision a single sign-on user, matched on issuer and subject
+// the username claim can often be changed by the user, so it only names a new account and never finds an existing
+// one. an account provisioned before subjects were kept has none and must be deleted to be provisioned again
+func provisionSubject(db *sql.DB, identity AuthIdentity) (string, error) {
+	username := ""
+	err := db.QueryRow(`SELECT username FROM user WHERE oidc_issuer = ? AND oidc_subject = ?`, identity.Issuer, identity.Subject).Scan(&username)
+
+	if err == sql.ErrNoRows {
+		exists, err := UsernameExist(identity.Username)
+		if err != nil {
+			return "", err
+		}
+		if exists {
+			return "", fmt.Errorf("user %s already exists and is not linked to subject %s of %s", identity.Username, identity.Subject, identity.Issuer)
+		}
+
+		query := `INSERT INTO user (username, email, password, usergroup, auth_source, oidc_issuer, oidc_subject) VALUES (?, ?, '', ?, ?, ?, ?)`
+		_, err = db.Exec(query, identity.Username, identity.Email, identity.Usergroup, identity.Source, identity.Issuer, identity.Subject)
+		if err == nil {
+			log.Println("provisioned user", identity.Username, "from", identity.Source)
+		}
+		return identity.Username, err
+	} else if err != nil {
+		return "", err
+	}
+
+	// keep email and usergroup in sync with the backend
+	_, err = db.Exec(`UPDATE user SET email = ?, usergroup = ? WHERE oidc_issuer = ? AND oidc_subject = ?`, identity.Email, identity.Usergroup, identity.Issuer, identity.Subject)
+	return username, err
+}
+
+// function to map groups reported by an external backend to a usergroup, the first matching mapping wins
+// returns fallback when no group matches. a usergroup which does not exist (any more) is skipped, so that a
+// deleted usergroup cannot end up on a provisioned account
+func MapUsergroup(groups []string, mappings []GroupMapping, fallback string) (string, error) {
+	for _, m := range mappings {
+		if !groupMember(groups, []string{m.Group}) {
+			continue
+		}
+		exists, err := UsergroupExist(m.Usergroup)
+		if err != nil {
+			return "", err
+		}
+		if exists {
+			return m.Usergroup, nil
+		}
+		log.Println("MapUsergroup() group", m.Group, "is mapped to unknown usergroup", m.Usergroup)
+	}
+
+	if fallback == "" {
+		return "", nil
+	}
+	exists, err := UsergroupExist(fallback)
+	if err != nil {
+		return "", err
+	}
+	if !exists {
+		log.Println("MapUsergroup() default usergroup", fallback, "does not exist")
+		return "", nil
+	}
+	return fallback, nil
+}
+
+// determines whether any of groups is listed in wanted
+// wanted may contain full DNs or just the group name (first RDN value), compared case-insensitively
+func groupMember(groups []string, wanted []string) bool {
+	for _, group := range groups {
+		name := group
+		if dn, err := ldap.ParseDN(group); err == nil && len(dn.RDNs) > 0 && len(dn.RDNs[0].Attributes) > 0 {
+			name = dn.RDNs[0].Attributes[0].Value
+		}
+
+		for _, w := range wanted {
+			if strings.EqualFold(w, group) || strings.EqualFold(w, name) {
+				return true
+			}
+		}
+	}
+	return false
+}
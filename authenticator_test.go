@@ -0,0 +1,153 @@
+package main
+
+import (
+	"errors"
+	"strings"
+	"testing"
+	"net/url"
+	"net/http"
+	"net/http/httptest"
+)
+
+// backend answering every login with identity and err
+type testAuthenticator struct {
+	identity	AuthIdentity
+	err			error
+}
+
+func (testAuthenticator) Name() string {
+	return "test"
+}
+
+func (a testAuthenticator) Authenticate(username string, password string) (AuthIdentity, error) {
+	return a.identity, a.err
+}
+
+// function to use backends for the rest of the test
+func testAuthenticators(t *testing.T, backends ...Authenticator) {
+	previous := authenticators
+	authenticators = backends
+	t.Cleanup(func() { authenticators = previous })
+}
+
+// function to post username and password to UserLogin, returns the status code
+func testLogin(t *testing.T, username string, password string) int {
+	t.Helper()
+	r := httptest.NewRequest("POST", "/user/login", strings.NewReader(url.Values{"username": {username}, "password": {password}}.Encode()))
+	r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	w := httptest.NewRecorder()
+	UserLogin(w, r)
+	return w.Code
+}
+
+func TestGroupMember(t *testing.T) {
+	groups := []string{"CN=Fragment Admins,OU=Groups,DC=example,DC=local", "fragment-users"}
+
+	tests := []struct {
+		wanted	[]string
+		want	bool
+	}{
+		{[]string{"Fragment Admins"}, true}, // first RDN of a DN
+		{[]string{"fragment admins"}, true}, // case-insensitive
+		{[]string{"cn=fragment admins,ou=groups,dc=example,dc=local"}, true}, // full DN
+		{[]string{"Fragment-Users"}, true}, // not a DN at all
+		{[]string{"Groups"}, false}, // only the first RDN counts
+		{[]string{"example"}, false},
+		{[]string{"Other", "fragment-users"}, true},
+		{nil, false},
+	}
+
+	for _, test := range tests {
+		if got := groupMember(groups, test.wanted); got != test.want {
+			t.Errorf("groupMember(%v) = %v, want %v", test.wanted, got, test.want)
+		}
+	}
+	if groupMember(nil, []string{"Fragment Admins"}) {
+		t.Errorf("member without any group")
+	}
+}
+
+func TestMapUsergroup(t *testing.T) {
+	testStore(t)
+	if err := CreateUsergroup("helpdesk", ""); err != nil {
+		t.Fatal(err)
+	}
+
+	mappings := []GroupMapping{
+		{"Fragment Admins", "admin"},
+		{"Helpdesk", "helpdesk"},
+		{"Retired", "retired"}, // usergroup does not exist
+		{"Fragment Users", "normal"},
+	}
+
+	tests := []struct {
+		groups		[]string
+		fallback	string
+		want		string
+	}{
+		{[]string{"CN=Fragment Admins,DC=example,DC=local"}, "normal", "admin"},
+		{[]string{"fragment users", "fragment admins"}, "", "admin"}, // first mapping wins, not first group
+		{[]string{"Helpdesk"}, "", "helpdesk"},
+		{[]string{"Retired"}, "", ""},
+		{[]string{"Retired", "Fragment Users"}, "", "normal"},
+		{[]string{"Somebody Else"}, "viewer", "viewer"},
+		{[]string{"Somebody Else"}, "", ""},
+		{[]string{"Somebody Else"}, "nonexistent", ""},
+		{nil, "normal", "normal"},
+	}
+
+	for _, test := range tests {
+		if got, err := MapUsergroup(test.groups, mappings, test.fallback); err != nil || got != test.want {
+			t.Errorf("MapUsergroup(%v, %q) = %q, %v, want %q", test.groups, test.fallback, got, err, test.want)
+		}
+	}
+}
+
+// a backend failing is not the same as every backend refusing the credentials
+func TestAuthenticate(t *testing.T) {
+	testStore(t)
+	unreachable := errors.New("directory unreachable")
+
+	testAuthenticators(t, LocalAuthenticator{}, testAuthenticator{err: unreachable})
+	if _, err := Authenticate("nobody", "secret"); !errors.Is(err, unreachable) {
+		t.Errorf("Authenticate() error = %v, want %v", err, unreachable)
+	}
+
+	testAuthenticators(t, LocalAuthenticator{}, testAuthenticator{err: ErrInvalidCredentials})
+	if _, err := Authenticate("nobody", "secret"); err != ErrInvalidCredentials {
+		t.Errorf("Authenticate() error = %v, want ErrInvalidCredentials", err)
+	}
+}
+
+// failures are counted on the username as typed, in whatever case, and a login clears that very counter
+func TestUserLoginThrottle(t *testing.T) {
+	s := testStore(t)
+	testUser(t, s, "bob", "normal")
+	ip := ClientIP(httptest.NewRequest("POST", "/user/login", nil))
+
+	testAuthenticators(t, testAuthenticator{err: errors.New("directory unreachable")})
+	if code := testLogin(t, "Bob", "secret"); code != http.StatusInternalServerError {
+		t.Errorf("login with failing backend returned %d", code)
+	}
+	if throttle, err := GetLoginThrottle(throttleScopeUser, "bob"); err != nil || throttle.Failures != 0 {
+		t.Errorf("failing backend counted as failed login, %+v, %v", throttle, err)
+	}
+
+	testAuthenticators(t, testAuthenticator{err: ErrInvalidCredentials})
+	testLogin(t, "Bob", "wrong")
+	if throttle, err := GetLoginThrottle(throttleScopeUser, "bob"); err != nil || throttle.Failures != 1 {
+		t.Errorf("GetLoginThrottle() = %+v, %v after failed login", throttle, err)
+	}
+
+	// a directory returns the username as it knows it
+	testAuthenticators(t, testAuthenticator{identity: AuthIdentity{Username: "bob", Source: authSourceLDAP}})
+	if code := testLogin(t, " BOB", "secret"); code != http.StatusFound {
+		t.Errorf("login returned %d", code)
+	}
+	if throttle, err := GetLoginThrottle(throttleScopeUser, "Bob"); err != nil || throttle.Failures != 0 {
+		t.Errorf("GetLoginThrottle() = %+v, %v after login", throttle, err)
+	}
+	if wait, err := LoginThrottled("bob", ip); err != nil || wait > 0 {
+		t.Errorf("LoginThrottled() = %v, %v after login", wait, err)
+	}
+}
@@ -0,0 +1,227 @@
+// server configuration, loaded once at startup
+// order of precedence: defaults < config file < FRAGMENT_* environment variables < command line flags
+package main
+
+import (
+	"os"
+	"flag"
+	"errors"
+	"strconv"
+	"github.com/BurntSushi/toml"
+)
+
+type Config struct {
+	Listen		string	`toml:"listen"`
+	SessionKey	string	`toml:"session_key"`
+	SessionDir	string	`toml:"session_dir"`
+	Dev			bool	`toml:"dev"` // read templates and assets from disk, see template.go
+	TemplateDir	string	`toml:"template_dir"`
+	AssetDir	string	`toml:"asset_dir"`
+	CoreDB		string	`toml:"core_db"`
+	ITDBDB		string	`toml:"itdb_db"`
+
+	// login throttling, see throttle.go
+	LoginMaxFailures	int	`toml:"login_max_failures"`
+	LoginLockoutMinutes	int	`toml:"login_lockout_minutes"`
+
+	// password policy, see password.go
+	PasswordMinLength	int		`toml:"password_min_length"`
+	PasswordMinClasses	int		`toml:"password_min_classes"` // of lowercase, uppercase, digits, symbols
+	PasswordHistory		int		`toml:"password_history"`
+	PasswordMaxAgeDays	int		`toml:"password_max_age_days"` // 0 disables expiry
+	PasswordBannedFile	string	`toml:"password_banned_file"`
+
+	// session timeouts, see usersession.go. 0 disables
+	SessionIdleMinutes		int	`toml:"session_idle_minutes"`
+	SessionAbsoluteHours	int	`toml:"session_absolute_hours"`
+
+	// public address of the server, used for links sent by email
+	BaseURL	string	`toml:"base_url"`
+
+	// self-service password reset, see reset.go
+	PasswordResetMinutes	int	`toml:"password_reset_minutes"`
+
+	// outgoing email, see mail.go
+	SMTP	SMTPConfig	`toml:"smtp"`
+
+	// directory authentication, see ldap.go
+	LDAP	LDAPConfig	`toml:"ldap"`
+
+	// single sign-on, see oidc.go
+	OIDC	OIDCConfig	`toml:"oidc"`
+}
+
+// active configuration, populated by LoadConfig() in main()
+var config = DefaultConfig()
+
+// session key of DefaultConfig(), it is published and only accepted in dev mode
+const defaultSessionKey = "super-secret-key"
+
+// returns the configuration used when nothing else is specified
+func DefaultConfig() Config {
+	return Config{
+		Listen: ":8000",
+		SessionKey: defaultSessionKey,
+		SessionDir: "./session",
+		TemplateDir: "./template",
+		AssetDir: "./asset",
+		CoreDB: "./database/core.db",
+		ITDBDB: "./database/itdb.db",
+		LoginMaxFailures: 5,
+		LoginLockoutMinutes: 15,
+		PasswordMinLength: 8,
+		PasswordMinClasses: 3,
+		PasswordHistory: 5,
+		SessionIdleMinutes: 60,
+		SessionAbsoluteHours: 12,
+		BaseURL: "http://localhost:8000",
+		PasswordResetMinutes: 30,
+		SMTP: SMTPConfig{
+			Port: 25,
+			From: "fragment@localhost",
+		},
+		LDAP: LDAPConfig{
+			UserFilter: "(&(objectClass=person)(sAMAccountName=%s))",
+			UsernameAttribute: "sAMAccountName",
+			EmailAttribute: "mail",
+			GroupAttribute: "memberOf",
+			DefaultUsergroup: "normal",
+		},
+		OIDC: OIDCConfig{
+			Scopes: []string{"profile", "email"},
+			UsernameClaim: "preferred_username",
+			EmailClaim: "email",
+			GroupsClaim: "groups",
+			DefaultUsergroup: "normal",
+		},
+	}
+}
+
+// function to build the configuration from file, environment and flags
+func LoadConfig(args []string) (Config, error) {
+	cfg := DefaultConfig()
+
+	fs := flag.NewFlagSet("fragment", flag.ContinueOnError)
+	configFile := fs.String("config", envOr("FRAGMENT_CONFIG", "fragment.toml"), "path to TOML configuration file")
+	listen := fs.String("listen", "", "address to listen on, e.g. :8000")
+	sessionKey := fs.String("session-key", "", "key signing session cookies and emailed links (at least 16 bytes)")
+	sessionDir := fs.String("session-dir", "", "directory for storing session files")
+	dev := fs.Bool("dev", false, "serve templates and assets from disk, reloading templates when they change")
+	templateDir := fs.String("template-dir", "", "directory containing HTML templates, used with -dev")
+	assetDir := fs.String("asset-dir", "", "directory containing static assets, used with -dev")
+	coreDB := fs.String("core-db", "", "path to core.db")
+	itdbDB := fs.String("itdb-db", "", "path to itdb.db")
+	if err := fs.Parse(args); err != nil {
+		return cfg, err
+	}
+
+	// config file is optional, unless explicitly asked for
+	meta, err := toml.DecodeFile(*configFile, &cfg)
+	if err != nil {
+		if !errors.Is(err, os.ErrNotExist) || isFlagSet(fs, "config") || os.Getenv("FRAGMENT_CONFIG") != "" {
+			return cfg, err
+		}
+	}
+	// ignoring these would quietly take admin rights away from directory users
+	for _, section := range []string{"ldap", "oidc"} {
+		if meta.IsDefined(section, "admin_groups") || meta.IsDefined(section, "normal_groups") {
+			return cfg, errors.New(section + ": admin_groups and normal_groups were replaced by [[" + section + ".groups]], see fragment.toml.example")
+		}
+	}
+
+	// environment overrides
+	cfg.Listen = envOr("FRAGMENT_LISTEN", cfg.Listen)
+	cfg.SessionKey = envOr("FRAGMENT_SESSION_KEY", cfg.SessionKey)
+	cfg.SessionDir = envOr("FRAGMENT_SESSION_DIR", cfg.SessionDir)
+	cfg.Dev = envBoolOr("FRAGMENT_DEV", cfg.Dev)
+	cfg.TemplateDir = envOr("FRAGMENT_TEMPLATE_DIR", cfg.TemplateDir)
+	cfg.AssetDir = envOr("FRAGMENT_ASSET_DIR", cfg.AssetDir)
+	cfg.CoreDB = envOr("FRAGMENT_CORE_DB", cfg.CoreDB)
+	cfg.ITDBDB = envOr("FRAGMENT_ITDB_DB", cfg.ITDBDB)
+	cfg.LoginMaxFailures = envIntOr("FRAGMENT_LOGIN_MAX_FAILURES", cfg.LoginMaxFailures)
+	cfg.LoginLockoutMinutes = envIntOr("FRAGMENT_LOGIN_LOCKOUT_MINUTES", cfg.LoginLockoutMinutes)
+	cfg.PasswordMinLength = envIntOr("FRAGMENT_PASSWORD_MIN_LENGTH", cfg.PasswordMinLength)
+	cfg.PasswordMinClasses = envIntOr("FRAGMENT_PASSWORD_MIN_CLASSES", cfg.PasswordMinClasses)
+	cfg.PasswordHistory = envIntOr("FRAGMENT_PASSWORD_HISTORY", cfg.PasswordHistory)
+	cfg.PasswordMaxAgeDays = envIntOr("FRAGMENT_PASSWORD_MAX_AGE_DAYS", cfg.PasswordMaxAgeDays)
+	cfg.PasswordBannedFile = envOr("FRAGMENT_PASSWORD_BANNED_FILE", cfg.PasswordBannedFile)
+	cfg.SessionIdleMinutes = envIntOr("FRAGMENT_SESSION_IDLE_MINUTES", cfg.SessionIdleMinutes)
+	cfg.SessionAbsoluteHours = envIntOr("FRAGMENT_SESSION_ABSOLUTE_HOURS", cfg.SessionAbsoluteHours)
+	cfg.BaseURL = envOr("FRAGMENT_BASE_URL", cfg.BaseURL)
+	cfg.PasswordResetMinutes = envIntOr("FRAGMENT_PASSWORD_RESET_MINUTES", cfg.PasswordResetMinutes)
+	cfg.SMTP.Host = envOr("FRAGMENT_SMTP_HOST", cfg.SMTP.Host)
+	cfg.SMTP.Port = envIntOr("FRAGMENT_SMTP_PORT", cfg.SMTP.Port)
+	cfg.SMTP.Username = envOr("FRAGMENT_SMTP_USERNAME", cfg.SMTP.Username)
+	cfg.SMTP.Password = envOr("FRAGMENT_SMTP_PASSWORD", cfg.SMTP.Password)
+	cfg.SMTP.From = envOr("FRAGMENT_SMTP_FROM", cfg.SMTP.From)
+	cfg.LDAP.URL = envOr("FRAGMENT_LDAP_URL", cfg.LDAP.URL)
+	cfg.LDAP.BindDN = envOr("FRAGMENT_LDAP_BIND_DN", cfg.LDAP.BindDN)
+	cfg.LDAP.BindPassword = envOr("FRAGMENT_LDAP_BIND_PASSWORD", cfg.LDAP.BindPassword)
+	cfg.LDAP.BaseDN = envOr("FRAGMENT_LDAP_BASE_DN", cfg.LDAP.BaseDN)
+	cfg.OIDC.Issuer = envOr("FRAGMENT_OIDC_ISSUER", cfg.OIDC.Issuer)
+	cfg.OIDC.ClientID = envOr("FRAGMENT_OIDC_CLIENT_ID", cfg.OIDC.ClientID)
+	cfg.OIDC.ClientSecret = envOr("FRAGMENT_OIDC_CLIENT_SECRET", cfg.OIDC.ClientSecret)
+	cfg.OIDC.RedirectURL = envOr("FRAGMENT_OIDC_REDIRECT_URL", cfg.OIDC.RedirectURL)
+
+	// command line overrides
+	cfg.Listen = flagOr(*listen, cfg.Listen)
+	cfg.SessionKey = flagOr(*sessionKey, cfg.SessionKey)
+	cfg.SessionDir = flagOr(*sessionDir, cfg.SessionDir)
+	cfg.Dev = cfg.Dev || *dev
+	cfg.TemplateDir = flagOr(*templateDir, cfg.TemplateDir)
+	cfg.AssetDir = flagOr(*assetDir, cfg.AssetDir)
+	cfg.CoreDB = flagOr(*coreDB, cfg.CoreDB)
+	cfg.ITDBDB = flagOr(*itdbDB, cfg.ITDBDB)
+
+	// anyone knowing the key can forge password reset links, see reset.go
+	if cfg.SessionKey == defaultSessionKey && !cfg.Dev {
+		return cfg, errors.New("session_key is the built-in default, set a random one, e.g. from openssl rand -base64 32")
+	}
+	if len(cfg.SessionKey) < 16 {
+		return cfg, errors.New("session_key must be at least 16 bytes long")
+	}
+
+	return cfg, nil
+}
+
+func envOr(key string, fallback string) string {
+	if value, ok := os.LookupEnv(key); ok && value != "" {
+		return value
+	}
+	return fallback
+}
+
+func envIntOr(key string, fallback int) int {
+	if value, ok := os.LookupEnv(key); ok && value != "" {
+		if n, err := strconv.Atoi(value); err == nil {
+			return n
+		}
+	}
+	return fallback
+}
+
+func envBoolOr(key string, fallback bool) bool {
+	if value, ok := os.LookupEnv(key); ok && value != "" {
+		if b, err := strconv.ParseBool(value); err == nil {
+			return b
+		}
+	}
+	return fallback
+}
+
+func flagOr(value string, fallback string) string {
+	if value != "" {
+		return value
+	}
+	return fallback
+}
+
+func isFlagSet(fs *flag.FlagSet, name string) bool {
+	found := false
+	fs.Visit(func(f *flag.Flag) {
+		if f.Name == name {
+			found = true
+		}
+	})
+	return found
+}
@@ -0,0 +1,36 @@
+package main
+
+import (
+	"os"
+	"testing"
+	"path/filepath"
+)
+
+func TestLoadConfigExample(t *testing.T) {
+	t.Setenv("FRAGMENT_SESSION_KEY", "0123456789abcdef0123456789abcdef")
+	cfg, err := LoadConfig([]string{"-config", "fragment.toml.example"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	want := GroupMapping{"Fragment Admins", "admin"}
+	if len(cfg.LDAP.Groups) != 2 || cfg.LDAP.Groups[0] != want {
+		t.Errorf("ldap groups = %v", cfg.LDAP.Groups)
+	}
+	if len(cfg.OIDC.Groups) != 2 {
+		t.Errorf("oidc groups = %v", cfg.OIDC.Groups)
+	}
+}
+
+// admin_groups and normal_groups are no longer read, a config still using them must not start
+func TestLoadConfigLegacyGroups(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "fragment.toml")
+	content := "session_key = \"0123456789abcdef0123456789abcdef\"\n[ldap]\nadmin_groups = [\"Fragment Admins\"]\n"
+	if err := os.WriteFile(path, []byte(content), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := LoadConfig([]string{"-config", path}); err == nil {
+		t.Errorf("admin_groups accepted")
+	}
+}
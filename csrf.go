@@ -0,0 +1,111 @@
+// cross-site request forgery protection
+// every session carries a random token which must be echoed back by state-changing requests,
+// either as the "csrf_token" form field or the "X-CSRF-Token" header
+package main
+
+import (
+	"log"
+	"net/http"
+	"html/template"
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/base64"
+)
+
+const (
+	csrfSessionKey = "csrf"
+	csrfFormField = "csrf_token"
+	csrfHeader = "X-CSRF-Token"
+)
+
+// function to return the csrf token of current session, creating one if needed
+// must be called before anything is written to w, since it may update the session cookie
+func CSRFToken(w http.ResponseWriter, r *http.Request) string {
+	// requests authenticated by API token have no cookie session to keep it in
+	if APIRequest(r) {
+		return ""
+	}
+
+	session, _ := store.Get(r, "cookie-name")
+
+	if token, ok := session.Values[csrfSessionKey].(string); ok && token != "" {
+		return token
+	}
+
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		log.Panic(err)
+	}
+	token := base64.RawURLEncoding.EncodeToString(b)
+
+	session.Values[csrfSessionKey] = token
+	session.Save(r, w)
+
+	return token
+}
+
+// function to validate csrf token submitted with the request against the session
+func CSRFValid(r *http.Request) bool {
+	session, _ := store.Get(r, "cookie-name")
+
+	expected, ok := session.Values[csrfSessionKey].(string)
+	if !ok || expected == "" {
+		return false
+	}
+
+	given := r.Header.Get(csrfHeader)
+	if given == "" {
+		given = r.FormValue(csrfFormField)
+	}
+
+	return subtle.ConstantTimeCompare([]byte(expected), []byte(given)) == 1
+}
+
+// middleware rejecting state-changing requests without a valid csrf token
+// requests authenticated by API token are exempt, as browsers never attach the Authorization header on their own
+func CSRFMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.Method {
+		case http.MethodGet, http.MethodHead, http.MethodOptions:
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		if APIRequest(r) {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		if !CSRFValid(r) {
+			http.Error(w, "Forbidden - invalid CSRF token", http.StatusForbidden)
+			return
+		}
+
+		next.ServeHTTP(w, r)
+	})
+}
+
+// function to return a template, parsed at startup (see template.go), with the csrf helpers bound to current request
+// within templates, use {{csrfField}} inside every form that submits with POST
+// {{impersonationBanner}} is shown by the layout, see impersonate.go
+func ParseTemplate(w http.ResponseWriter, r *http.Request, name string) *template.Template {
+	token := CSRFToken(w, r)
+
+	funcs := template.FuncMap{
+		"csrfToken": func() string {
+			return token
+		},
+		"csrfField": func() template.HTML {
+			return template.HTML(`<input type="hidden" name="` + csrfFormField + `" value="` + template.HTMLEscapeString(token) + `"/>`)
+		},
+		"impersonationBanner": func() template.HTML {
+			return ImpersonationBanner(r, token)
+		},
+	}
+
+	tmpl, err := lookupTemplate(name)
+	if err != nil {
+		log.Panic("ParseTemplate() ", err)
+	}
+	return tmpl.Funcs(funcs)
+}
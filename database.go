@@ -0,0 +1,480 @@
+// schema of core.db and itdb.db, kept up to date by versioned migrations
+// each migration runs once, in order of version and inside a transaction, and is then recorded in the
+// schema_migrations table of its database. MigrateDatabases() runs at startup and as "fragment migrate"
+// an empty (or missing) file is bootstrapped into a working installation. the first migrations create what
+// used to be made by hand and use IF NOT EXISTS and addColumn(), so that databases from before
+// schema_migrations, which already have some of it, end up the same
+package main
+
+import (
+	"os"
+	"log"
+	"fmt"
+	"time"
+	"errors"
+	"path/filepath"
+	"database/sql"
+)
+
+// file next to core.db holding the password of the first admin account, see bootstrapAdmin()
+const adminPasswordFile = "admin-password"
+
+// a change of schema or data, never edit one that has been released, add a new version instead
+type Migration struct {
+	Version		int
+	Description	string
+	Up			func(tx *sql.Tx) error
+}
+
+// migrations of core.db
+var coreMigrations = []Migration{
+	{1, "user table", execAll(
+		`CREATE TABLE IF NOT EXISTS user (
+			id			INTEGER PRIMARY KEY AUTOINCREMENT,
+			username	TEXT UNIQUE,
+			email		TEXT,
+			password	TEXT,
+			usergroup	TEXT
+		)`,
+	)},
+	// see throttle.go
+	{2, "failed login counters", execAll(
+		`CREATE TABLE IF NOT EXISTS login_throttle (
+			scope			TEXT NOT NULL,
+			subject			TEXT NOT NULL,
+			failures		INTEGER NOT NULL DEFAULT 0,
+			last_failure	INTEGER NOT NULL DEFAULT 0,
+			locked_until	INTEGER NOT NULL DEFAULT 0,
+			PRIMARY KEY (scope, subject)
+		)`,
+	)},
+	// see setting.go
+	{3, "runtime settings", execAll(
+		`CREATE TABLE IF NOT EXISTS setting (
+			name	TEXT PRIMARY KEY,
+			value	TEXT NOT NULL
+		)`,
+	)},
+	// see twofactor.go
+	{4, "TOTP two-factor authentication", execAll(
+		`CREATE TABLE IF NOT EXISTS user_totp (
+			user_id		INTEGER PRIMARY KEY,
+			secret		TEXT NOT NULL,
+			last_step	INTEGER NOT NULL DEFAULT 0,
+			created		INTEGER NOT NULL
+		)`,
+		`CREATE TABLE IF NOT EXISTS user_recovery_code (
+			user_id		INTEGER NOT NULL,
+			code_hash	TEXT NOT NULL,
+			used		INTEGER NOT NULL DEFAULT 0
+		)`,
+	)},
+	// see password.go
+	{5, "password history and expiry", steps(
+		execAll(
+			`CREATE TABLE IF NOT EXISTS password_history (
+				user_id			INTEGER NOT NULL,
+				password_hash	TEXT NOT NULL,
+				created			INTEGER NOT NULL
+			)`,
+		),
+		addColumns("user", [][2]string{
+			{"password_changed_at", "INTEGER NOT NULL DEFAULT 0"},
+			{"must_change_password", "INTEGER NOT NULL DEFAULT 0"},
+		}),
+	)},
+	// see usersession.go
+	{6, "logged in sessions", execAll(
+		`CREATE TABLE IF NOT EXISTS user_session (
+			id			TEXT PRIMARY KEY,
+			user_id		INTEGER NOT NULL,
+			username	TEXT NOT NULL,
+			ip			TEXT NOT NULL,
+			user_agent	TEXT NOT NULL,
+			created		INTEGER NOT NULL,
+			last_seen	INTEGER NOT NULL
+		)`,
+	)},
+	// see apitoken.go
+	{7, "personal API tokens", execAll(
+		`CREATE TABLE IF NOT EXISTS api_token (
+			id			INTEGER PRIMARY KEY AUTOINCREMENT,
+			user_id		INTEGER NOT NULL,
+			name		TEXT NOT NULL,
+			token_hash	TEXT NOT NULL UNIQUE,
+			created		INTEGER NOT NULL,
+			expires		INTEGER NOT NULL DEFAULT 0,
+			last_used	INTEGER NOT NULL DEFAULT 0
+		)`,
+	)},
+	// see audit.go. the triggers keep it append-only
+	{8, "audit trail", execAll(
+		`CREATE TABLE IF NOT EXISTS audit_log (
+			id			INTEGER PRIMARY KEY AUTOINCREMENT,
+			created		INTEGER NOT NULL,
+			actor		TEXT NOT NULL,
+			ip			TEXT NOT NULL,
+			entity		TEXT NOT NULL,
+			entity_id	TEXT NOT NULL,
+			action		TEXT NOT NULL,
+			before		TEXT NOT NULL DEFAULT '',
+			after		TEXT NOT NULL DEFAULT ''
+		)`,
+		`CREATE TRIGGER IF NOT EXISTS audit_log_no_update BEFORE UPDATE ON audit_log
+		BEGIN
+			SELECT RAISE(ABORT, 'audit_log is append-only');
+		END`,
+		`CREATE TRIGGER IF NOT EXISTS audit_log_no_delete BEFORE DELETE ON audit_log
+		BEGIN
+			SELECT RAISE(ABORT, 'audit_log is append-only');
+		END`,
+	)},
+	// see authenticator.go
+	{9, "directory and single sign-on accounts", addColumns("user", [][2]string{
+		{"auth_source", "TEXT NOT NULL DEFAULT 'local'"},
+	})},
+	// see usergroup.go
+	{10, "usergroups and permissions", execAll(
+		`CREATE TABLE IF NOT EXISTS usergroup (
+			name		TEXT PRIMARY KEY,
+			description	TEXT NOT NULL DEFAULT ''
+		)`,
+		`CREATE TABLE IF NOT EXISTS usergroup_permission (
+			usergroup	TEXT NOT NULL,
+			permission	TEXT NOT NULL,
+			PRIMARY KEY (usergroup, permission)
+		)`,
+	)},
+	{11, "default usergroups", seedUsergroups},
+	// see reset.go
+	{12, "emailed password reset links", execAll(
+		`CREATE TABLE IF NOT EXISTS password_reset (
+			nonce_hash	TEXT PRIMARY KEY,
+			user_id		INTEGER NOT NULL,
+			expires		INTEGER NOT NULL,
+			used		INTEGER NOT NULL DEFAULT 0
+		)`,
+	)},
+	// see admin.go
+	{13, "disabled accounts", addColumns("user", [][2]string{
+		{"disabled", "INTEGER NOT NULL DEFAULT 0"},
+	})},
+	// see loginevent.go
+	{14, "login history", execAll(
+		`CREATE TABLE IF NOT EXISTS login_events (
+			id			INTEGER PRIMARY KEY AUTOINCREMENT,
+			created		INTEGER NOT NULL,
+			user_id		INTEGER,
+			username	TEXT NOT NULL,
+			ip			TEXT NOT NULL,
+			user_agent	TEXT NOT NULL,
+			success		INTEGER NOT NULL,
+			method		TEXT NOT NULL
+		)`,
+		`CREATE INDEX IF NOT EXISTS login_events_user ON login_events (user_id, id)`,
+	)},
+	// see profile.go
+	{15, "user profile and confirmed email changes", steps(
+		addColumns("user", [][2]string{
+			{"display_name", "TEXT NOT NULL DEFAULT ''"},
+			{"phone_ext", "TEXT NOT NULL DEFAULT ''"},
+		}),
+		execAll(
+			`CREATE TABLE IF NOT EXISTS email_change (
+				nonce_hash	TEXT PRIMARY KEY,
+				user_id		INTEGER NOT NULL,
+				email		TEXT NOT NULL,
+				expires		INTEGER NOT NULL,
+				used		INTEGER NOT NULL DEFAULT 0
+			)`,
+		),
+	)},
+	{16, "first admin account", bootstrapAdmin},
+	// see authenticator.go, single sign-on accounts are matched on issuer and subject instead of username
+	{17, "single sign-on subjects", steps(
+		addColumns("user", [][2]string{
+			{"oidc_issuer", "TEXT NOT NULL DEFAULT ''"},
+			{"oidc_subject", "TEXT NOT NULL DEFAULT ''"},
+		}),
+		execAll(
+			`CREATE UNIQUE INDEX IF NOT EXISTS user_oidc_subject ON user (oidc_issuer, oidc_subject) WHERE oidc_subject != ''`,
+		),
+	)},
+}
+
+// migrations of itdb.db
+// a new office needs a new migration for its tables, version 1 only covers the offices there were back then
+var itdbMigrations = []Migration{
+	{1, "PC and printer tables of sibu and kapit", itdbOfficeTables("sibu", "kapit")},
+}
+
+// usergroups created once, normal and admin match what used to be hardcoded in usergroup.go
+// deleting one of them later does not bring it back
+var defaultUsergroups = []struct {
+	Name		string
+	Description	string
+	Permissions	[]string
+}{
+	{"normal", "Common user and is allowed to access most features that does not involve users management and system management", []string{"update_own_password"}},
+	{"admin", "Powerful user with extended privileges and able to manage other users, subsystem, and many more", []string{"update_own_password", "update_user_password", "access_admin", "access_itdb", "itdb_read_sibu", "itdb_write_sibu", "itdb_delete_sibu", "itdb_read_kapit", "itdb_write_kapit", "itdb_delete_kapit"}},
+	{"viewer", "Read-only access to the IT inventory of every office", []string{"update_own_password", "access_itdb", "itdb_read_sibu", "itdb_read_kapit"}},
+}
+
+// function to bring core.db and itdb.db of s up to date, called from main() before anything else uses them
+func MigrateDatabases(s *Store) error {
+	databases := []struct {
+		Name		string
+		DB			*sql.DB
+		Migrations	[]Migration
+	}{
+		{"core.db", s.Core, coreMigrations},
+		{"itdb.db", s.ITDB, itdbMigrations},
+	}
+
+	for _, d := range databases {
+		applied, err := Migrate(d.DB, d.Migrations)
+		for _, m := range applied {
+			log.Println(d.Name, "migration", m.Version, "applied:", m.Description)
+		}
+		if err != nil {
+			return fmt.Errorf("%s: %w", d.Name, err)
+		}
+	}
+
+	return nil
+}
+
+// function to apply the migrations not yet recorded in schema_migrations of db, returns the ones applied
+// a failing migration is rolled back entirely and stops the ones after it
+func Migrate(db *sql.DB, migrations []Migration) ([]Migration, error) {
+	_, err := db.Exec(`CREATE TABLE IF NOT EXISTS schema_migrations (
+		version		INTEGER PRIMARY KEY,
+		description	TEXT NOT NULL,
+		applied		INTEGER NOT NULL
+	)`)
+	if err != nil {
+		return nil, err
+	}
+
+	done, err := appliedMigrations(db)
+	if err != nil {
+		return nil, err
+	}
+
+	var applied []Migration
+	previous := 0
+	for _, m := range migrations {
+		if m.Version <= previous {
+			return applied, fmt.Errorf("migration %d is out of order", m.Version)
+		}
+		previous = m.Version
+
+		if done[m.Version] {
+			continue
+		}
+		if err := migrate(db, m); err != nil {
+			return applied, fmt.Errorf("migration %d (%s): %w", m.Version, m.Description, err)
+		}
+		applied = append(applied, m)
+	}
+
+	return applied, nil
+}
+
+func migrate(db *sql.DB, m Migration) error {
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if err := m.Up(tx); err != nil {
+		return err
+	}
+
+	query := `INSERT INTO schema_migrations (version, description, applied) VALUES (?, ?, ?)`
+	if _, err := tx.Exec(query, m.Version, m.Description, time.Now().Unix()); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// function to return the versions recorded in schema_migrations of db
+func appliedMigrations(db *sql.DB) (map[int]bool, error) {
+	row, err := db.Query(`SELECT version FROM schema_migrations`)
+	if err != nil {
+		return nil, err
+	}
+	defer row.Close()
+
+	done := map[int]bool{}
+	for row.Next() {
+		var version int
+		if err := row.Scan(&version); err != nil {
+			return nil, err
+		}
+		done[version] = true
+	}
+	return done, row.Err()
+}
+
+// function returning a migration step that runs queries one after another
+func execAll(queries ...string) func(tx *sql.Tx) error {
+	return func(tx *sql.Tx) error {
+		for _, query := range queries {
+			if _, err := tx.Exec(query); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+}
+
+// function returning a migration step that adds columns (name, definition) to table, skipping existing ones
+func addColumns(table string, columns [][2]string) func(tx *sql.Tx) error {
+	return func(tx *sql.Tx) error {
+		for _, c := range columns {
+			if err := addColumn(tx, table, c[0], c[1]); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+}
+
+// function returning a migration step made of several
+func steps(all ...func(tx *sql.Tx) error) func(tx *sql.Tx) error {
+	return func(tx *sql.Tx) error {
+		for _, step := range all {
+			if err := step(tx); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+}
+
+// function to add column to table unless it already exists
+func addColumn(tx *sql.Tx, table string, column string, definition string) error {
+	var count int
+	query := `SELECT COUNT(*) FROM pragma_table_info(?) WHERE name = ?`
+	err := tx.QueryRow(query, table, column).Scan(&count)
+	if err != nil {
+		return err
+	}
+	if count > 0 {
+		return nil
+	}
+
+	_, err = tx.Exec(`ALTER TABLE ` + table + ` ADD COLUMN ` + column + ` ` + definition)
+	return err
+}
+
+// function to create defaultUsergroups
+// grants are only written for a newly inserted usergroup, an existing one is left as the admin configured it
+func seedUsergroups(tx *sql.Tx) error {
+	for _, g := range defaultUsergroups {
+		result, err := tx.Exec(`INSERT OR IGNORE INTO usergroup (name, description) VALUES (?, ?)`, g.Name, g.Description)
+		if err != nil {
+			return err
+		}
+		if inserted, _ := result.RowsAffected(); inserted == 1 {
+			for _, p := range g.Permissions {
+				_, err := tx.Exec(`INSERT INTO usergroup_permission (usergroup, permission) VALUES (?, ?)`, g.Name, p)
+				if err != nil {
+					return err
+				}
+			}
+		}
+	}
+
+	return nil
+}
+
+// function to create user "admin" on a new installation, so that there is someone to log in with
+// the random password is written to adminPasswordFile, readable by the owner only, and has to be changed at
+// first login. it is kept out of the log, which is read by more people and kept for longer
+func bootstrapAdmin(tx *sql.Tx) error {
+	var count int
+	if err := tx.QueryRow(`SELECT COUNT(*) FROM user`).Scan(&count); err != nil {
+		return err
+	}
+	if count > 0 {
+		return nil
+	}
+
+	password := randomToken()
+	hash, err := HashPassword(password)
+	if err != nil {
+		return err
+	}
+
+	query := `INSERT INTO user (username, email, password, usergroup, password_changed_at, must_change_password) VALUES ('admin', '', ?, 'admin', ?, 1)`
+	if _, err := tx.Exec(query, hash, time.Now().Unix()); err != nil {
+		return err
+	}
+
+	var file string
+	if err := tx.QueryRow(`SELECT file FROM pragma_database_list WHERE name = 'main'`).Scan(&file); err != nil {
+		return err
+	}
+	if file == "" {
+		return errors.New("no file to write the admin password next to")
+	}
+	path := filepath.Join(filepath.Dir(file), adminPasswordFile)
+	if err := os.WriteFile(path, []byte(password + "\n"), 0600); err != nil {
+		return err
+	}
+	// WriteFile keeps the mode of a file left from an earlier attempt
+	if err := os.Chmod(path, 0600); err != nil {
+		return err
+	}
+
+	log.Println("created user admin, its password is in", path, "- it has to be changed at first login, then delete the file")
+	return nil
+}
+
+// function returning a migration step that creates the PC and printer tables of offices
+// the printer host column holds the id of the PC it is attached to
+func itdbOfficeTables(offices ...string) func(tx *sql.Tx) error {
+	return func(tx *sql.Tx) error {
+		for _, office := range offices {
+			pcs, err := pcTable(office)
+			if err != nil {
+				return err
+			}
+			printers, err := printerTable(office)
+			if err != nil {
+				return err
+			}
+
+			err = execAll(
+				`CREATE TABLE IF NOT EXISTS ` + pcs + ` (
+					id				INTEGER PRIMARY KEY AUTOINCREMENT,
+					hostname		TEXT,
+					ip				TEXT,
+					cpu_model		TEXT,
+					cpu_no			TEXT,
+					monitor_model	TEXT,
+					monitor_no		TEXT,
+					printer			TEXT,
+					user			TEXT,
+					department		TEXT,
+					notes			TEXT
+				)`,
+				`CREATE TABLE IF NOT EXISTS ` + printers + ` (
+					printermodel	TEXT,
+					printerno		TEXT,
+					printertype		TEXT,
+					notes			TEXT,
+					host			INTEGER,
+					nickname		TEXT
+				)`,
+			)(tx)
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+}
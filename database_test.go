@@ -0,0 +1,38 @@
+package main
+
+import (
+	"os"
+	"strings"
+	"testing"
+	"path/filepath"
+)
+
+// the password of the first admin goes to a file only its owner can read
+func TestBootstrapAdmin(t *testing.T) {
+	s := testOpenStore(t)
+	var file string
+	if err := s.Core.QueryRow(`SELECT file FROM pragma_database_list WHERE name = 'main'`).Scan(&file); err != nil {
+		t.Fatal(err)
+	}
+	path := filepath.Join(filepath.Dir(file), adminPasswordFile)
+
+	info, err := os.Stat(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if mode := info.Mode().Perm(); mode != 0600 {
+		t.Errorf("%s has mode %v, want 0600", adminPasswordFile, mode)
+	}
+
+	password, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	hash, err := s.Users.PasswordHash("admin")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !PasswordMatch(hash, strings.TrimSpace(string(password))) {
+		t.Errorf("password in %s does not match user admin", adminPasswordFile)
+	}
+}
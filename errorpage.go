@@ -0,0 +1,84 @@
+// error pages (template/error.html) and recovery from panics, so one bad request can never stop the server
+// handlers pass the error of a failed lookup to HTTPError(), which picks the status from it
+package main
+
+import (
+	"log"
+	"errors"
+	"net/http"
+	"runtime/debug"
+	"database/sql"
+)
+
+var ErrBadRequest = errors.New("bad request")
+
+type PageErrorStruct struct {
+	Status	int
+	Title	string
+	Message	string
+}
+
+// function to return the error page with status
+func PageError(w http.ResponseWriter, r *http.Request, status int, message string) {
+	// requests authenticated by API token expect no HTML
+	if APIRequest(r) {
+		http.Error(w, message, status)
+		return
+	}
+
+	// parsed before writing the status, the CSRF token may still have to be saved in the session cookie
+	tmpl := ParseTemplate(w, r, "error.html")
+	w.WriteHeader(status)
+	data := PageErrorStruct{
+		status,
+		http.StatusText(status),
+		message,
+	}
+	tmpl.Execute(w, data)
+}
+
+// function to answer a request that failed with err
+// a missing row or unknown office is 404, ErrBadRequest is 400, anything else is logged and 500
+func HTTPError(w http.ResponseWriter, r *http.Request, err error) {
+	switch {
+	case errors.Is(err, sql.ErrNoRows), errors.Is(err, ErrUnknownOffice):
+		PageError(w, r, http.StatusNotFound, "The page you are looking for does not exist or has been removed.")
+	case errors.Is(err, ErrBadRequest):
+		PageError(w, r, http.StatusBadRequest, "The request could not be understood, please check the address or form.")
+	default:
+		log.Println(r.Method, r.URL.Path, err)
+		PageError(w, r, http.StatusInternalServerError, "Something went wrong on our side, please try again later.")
+	}
+}
+
+// "not found" page for addresses no route matches
+func PageNotFound(w http.ResponseWriter, r *http.Request) {
+	PageError(w, r, http.StatusNotFound, "The page you are looking for does not exist or has been removed.")
+}
+
+// "forbidden" page for logged in users lacking the permission of a route, see auth.go
+func PageForbidden(w http.ResponseWriter, r *http.Request) {
+	PageError(w, r, http.StatusForbidden, "You do not have permission to access this page.")
+}
+
+// middleware to answer a panicking request with the 500 page, the server keeps running for everyone else
+// wraps the whole router in main() so that the other middlewares are covered too
+func RecoveryMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		defer func() {
+			v := recover()
+			if v == nil {
+				return
+			}
+			// net/http uses this one to abort a response on purpose
+			if v == http.ErrAbortHandler {
+				panic(v)
+			}
+
+			log.Printf("panic serving %s %s: %v\n%s", r.Method, r.URL.Path, v, debug.Stack())
+			PageError(w, r, http.StatusInternalServerError, "Something went wrong on our side, please try again later.")
+		}()
+
+		next.ServeHTTP(w, r)
+	})
+}
@@ -0,0 +1,141 @@
+// admin impersonation ("view as user"), for seeing exactly what another user sees
+// the session takes the identity of the user while the admin is remembered in "impersonator_id" and
+// "impersonator_username", every page shows a banner to leave again, and start and stop are audited
+package main
+
+import (
+	"log"
+	"net/http"
+	"html/template"
+	"github.com/gorilla/mux"
+)
+
+func ImpersonationHandler(user *mux.Router, admin *mux.Router) {
+	admin.HandleFunc("/usermanagement/impersonate/{id}", SessionOnly(AdminImpersonate)).Methods("POST")
+	user.HandleFunc("/impersonate/exit", ImpersonateExit).Methods("POST")
+}
+
+// handle the impersonate button on "/admin/usermanagement"
+func AdminImpersonate(w http.ResponseWriter, r *http.Request) {
+	user, _ := GetCurrentUser(r)
+	if _, impersonating := Impersonator(r); impersonating {
+		renderUserManagement(w, r, user.Username, user.Usergroup, "Error. Exit the current impersonation first.")
+		return
+	}
+
+	target, err := GetUserById(mux.Vars(r)["id"])
+	if err != nil {
+		HTTPError(w, r, err)
+		return
+	}
+	if target.Id == user.Id {
+		renderUserManagement(w, r, user.Username, user.Usergroup, "Error. You cannot impersonate yourself.")
+		return
+	} else if target.Disabled {
+		renderUserManagement(w, r, user.Username, user.Usergroup, "Error. Disabled users cannot be impersonated.")
+		return
+	} else if !UsergroupCovers(user.Usergroup, target.Usergroup) {
+		// acting as the target would grant permissions the admin does not hold
+		renderUserManagement(w, r, user.Username, user.Usergroup, "Error. You cannot impersonate a user with permissions you do not hold.")
+		return
+	}
+
+	session, _ := store.Get(r, "cookie-name")
+	session.Values["impersonator_id"] = user.Id
+	session.Values["impersonator_username"] = user.Username
+	session.Values["id"] = target.Id
+	session.Values["username"] = target.Username
+	session.Values["must_change_password"] = false
+	session.Save(r, w)
+
+	if err := AuditLog(r, user.Username, auditEntityUser, target.Id, "impersonate start", nil, nil); err != nil {
+		HTTPError(w, r, err)
+		return
+	}
+	log.Println(user.Username, "started impersonating", target.Username)
+
+	http.Redirect(w, r, "/user", 302)
+}
+
+// handle the exit button of the impersonation banner
+func ImpersonateExit(w http.ResponseWriter, r *http.Request) {
+	if _, impersonating := Impersonator(r); impersonating {
+		if err := endImpersonation(w, r); err != nil {
+			HTTPError(w, r, err)
+			return
+		}
+		http.Redirect(w, r, "/admin/usermanagement", 302)
+		return
+	}
+	http.Redirect(w, r, "/user", 302)
+}
+
+// Functions that handles process and procedures and does not involve returning HTML page
+//
+//
+
+// function to return the admin behind the current session, if it is an impersonation
+func Impersonator(r *http.Request) (string, bool) {
+	session, _ := store.Get(r, "cookie-name")
+	admin, _ := session.Values["impersonator_username"].(string)
+	return admin, admin != ""
+}
+
+// function to give the session back to the impersonating admin
+func endImpersonation(w http.ResponseWriter, r *http.Request) error {
+	session, _ := store.Get(r, "cookie-name")
+	adminId, _ := session.Values["impersonator_id"].(string)
+	admin, _ := session.Values["impersonator_username"].(string)
+	id, _ := session.Values["id"].(string)
+	username, _ := session.Values["username"].(string)
+
+	mustChange, err := PasswordChangeRequired(adminId)
+	if err != nil {
+		return err
+	}
+
+	session.Values["id"] = adminId
+	session.Values["username"] = admin
+	session.Values["must_change_password"] = mustChange
+	delete(session.Values, "impersonator_id")
+	delete(session.Values, "impersonator_username")
+	session.Save(r, w)
+
+	if err := AuditLog(r, admin, auditEntityUser, id, "impersonate stop", nil, nil); err != nil {
+		return err
+	}
+	log.Println(admin, "stopped impersonating", username)
+	return nil
+}
+
+// middleware keeping impersonation read-only, an impersonating admin views what the user sees
+// but changes nothing as the user, leaving the impersonation being the only request allowed
+func ImpersonationMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet && r.Method != http.MethodHead && r.URL.Path != "/user/impersonate/exit" {
+			if admin, impersonating := Impersonator(r); impersonating {
+				log.Println("blocked", r.URL.Path, "while", admin, "is impersonating")
+				http.Error(w, "Forbidden - not available while impersonating", http.StatusForbidden)
+				return
+			}
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// function to render the banner shown on top of every page during impersonation, see ParseTemplate
+func ImpersonationBanner(r *http.Request, token string) template.HTML {
+	admin, impersonating := Impersonator(r)
+	if !impersonating {
+		return ""
+	}
+
+	session, _ := store.Get(r, "cookie-name")
+	username, _ := session.Values["username"].(string)
+
+	return template.HTML(`<div style="position:sticky;top:0;z-index:10;padding:8px;background-color:#b91c1c;color:white;text-align:center;">` +
+		template.HTMLEscapeString(admin) + ` is viewing as <b>` + template.HTMLEscapeString(username) + `</b>` +
+		`<form method="post" action="/user/impersonate/exit" style="display:inline;margin-left:15px;">` +
+		`<input type="hidden" name="` + csrfFormField + `" value="` + template.HTMLEscapeString(token) + `"/>` +
+		`<button type="submit">exit impersonation</button></form></div>`)
+}
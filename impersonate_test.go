@@ -0,0 +1,75 @@
+package main
+
+import (
+	"testing"
+	"net/http"
+	"net/http/httptest"
+	"github.com/gorilla/mux"
+)
+
+// function to impersonate the user target as admin, returns the values of the session afterwards
+func testImpersonate(t *testing.T, admin CurrentUser, target string) map[interface{}]interface{} {
+	t.Helper()
+	r := httptest.NewRequest("POST", "/admin/usermanagement/impersonate/" + target, nil)
+	r = testAsUser(mux.SetURLVars(r, map[string]string{"id": target}), admin)
+	w := httptest.NewRecorder()
+	AdminImpersonate(w, r)
+	return testSessionValues(t, w, r)
+}
+
+func TestAdminImpersonatePermissions(t *testing.T) {
+	s := testStore(t)
+	if err := CreateUsergroup("helpdesk", ""); err != nil {
+		t.Fatal(err)
+	}
+	if err := SetUsergroupPermissions("helpdesk", "", map[string]bool{"access_admin": true, "update_own_password": true}); err != nil {
+		t.Fatal(err)
+	}
+	helpdesk := CurrentUser{testUser(t, s, "alice", "helpdesk"), "alice", "helpdesk"}
+	admin := testUser(t, s, "bob", "admin")
+	normal := testUser(t, s, "carol", "normal")
+
+	if values := testImpersonate(t, helpdesk, admin); values["impersonator_id"] != nil {
+		t.Errorf("helpdesk impersonated admin, session %v", values)
+	}
+	if values := testImpersonate(t, helpdesk, normal); values["id"] != normal || values["impersonator_id"] != helpdesk.Id {
+		t.Errorf("helpdesk did not impersonate normal, session %v", values)
+	}
+}
+
+func TestImpersonationMiddleware(t *testing.T) {
+	testStore(t)
+	cookies := testSession(t, map[interface{}]interface{}{
+		"id": "2",
+		"username": "carol",
+		"impersonator_id": "1",
+		"impersonator_username": "alice",
+	})
+	next := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {})
+
+	tests := []struct {
+		method	string
+		path	string
+		want	int
+	}{
+		{"GET", "/itdb/sibu/pc", http.StatusOK},
+		{"HEAD", "/user", http.StatusOK},
+		{"POST", "/user/impersonate/exit", http.StatusOK},
+		{"POST", "/user/password/update", http.StatusForbidden},
+		{"POST", "/admin/usermanagement/deleteuser/3", http.StatusForbidden},
+		{"POST", "/itdb/sibu/pc/new/submit", http.StatusForbidden},
+		{"DELETE", "/api/pc/1", http.StatusForbidden},
+	}
+
+	for _, test := range tests {
+		r := httptest.NewRequest(test.method, test.path, nil)
+		for _, c := range cookies {
+			r.AddCookie(c)
+		}
+		w := httptest.NewRecorder()
+		ImpersonationMiddleware(next).ServeHTTP(w, r)
+		if w.Code != test.want {
+			t.Errorf("%s %s = %d, want %d", test.method, test.path, w.Code, test.want)
+		}
+	}
+}
@@ -1,11 +1,10 @@
 package main
 
 import (
-	"log"
+	"fmt"
 	"strconv"
 	"net/http"
 	"strings"
-	"html/template"
 	"github.com/gorilla/mux"
 	"database/sql"
 )
@@ -17,6 +16,16 @@ const (
 	printerkapit = "printerkapit1"
 )
 
+// offices having their own PC and printer tables
+var itdbOffices = []string{"sibu", "kapit"}
+
+// levels of office-scoped grants, see ITDBOfficeAccess()
+const (
+	itdbRead = "read"
+	itdbWrite = "write"
+	itdbDelete = "delete"
+)
+
 // since we cannot modify existing struct, we can embed a struct into another struct
 // https://stackoverflow.com/a/29019923
 type PageITDBAddPC struct {
@@ -29,11 +38,14 @@ type PageITDBAddPC struct {
 type PCList struct {
 	Office	string
 	PCs	[]PC
+	CanWrite	bool
+	CanDelete	bool
 }
 
 type PrinterList struct {
 	Office string
 	Printers []Printer
+	CanWrite	bool
 }
 
 type PageITDBStruct struct {
@@ -69,522 +81,322 @@ type Printer struct {
 	Nickname		string
 }
 
-func ITDBHandler(r *mux.Router) {
-	r.HandleFunc("/itdb", PageITDB)
-	r.HandleFunc("/itdb/setting", PageITDBSetting)
-	r.HandleFunc("/itdb/pc/{office}", PageITDBPC)
-	r.HandleFunc("/itdb/pc/{office}/add", PageITDBPCAdd)
-	r.HandleFunc("/itdb/pc/{office}/add/submit", ITDBPCAddSubmit)
-	r.HandleFunc("/itdb/pc/{office}/edit/{id}", PageITDBPCEdit) // PC Edit
-	r.HandleFunc("/itdb/pc/{office}/edit/{id}/submit", ITDBPCEditSubmit)
-	r.HandleFunc("/itdb/pc/{office}/view/{id}", PageITDBPCView)
-	r.HandleFunc("/itdb/pc/{office}/delete/{id}", ITDBPCDelete)
-	r.HandleFunc("/itdb/printer/{office}", PageITDBPrinter)
-	r.HandleFunc("/itdb/printer/{office}/add", PageITDBPrinterAdd)
-	r.HandleFunc("/itdb/printer/{office}/add/submit", ITDBPrinterAddSubmit)
-	r.HandleFunc("/itdb/printer/{office}/edit/{rowid}", PageITDBPrinterEdit)
-	r.HandleFunc("/itdb/printer/{office}/edit/{rowid}/submit", ITDBPrinterEditSubmit)
+// itdb is the "/itdb" subrouter, which already requires access_itdb
+func ITDBHandler(itdb *mux.Router, s *Store) {
+	itdb.HandleFunc("", PageITDB)
+	itdb.HandleFunc("/setting", PageITDBSetting)
+	itdb.HandleFunc("/pc/{office}", RequireOffice(itdbRead, PageITDBPC(s)))
+	itdb.HandleFunc("/pc/{office}/add", RequireOffice(itdbWrite, PageITDBPCAdd(s)))
+	itdb.HandleFunc("/pc/{office}/add/submit", RequireOffice(itdbWrite, ITDBPCAddSubmit(s))).Methods("POST")
+	itdb.HandleFunc("/pc/{office}/edit/{id}", RequireOffice(itdbWrite, PageITDBPCEdit(s))) // PC Edit
+	itdb.HandleFunc("/pc/{office}/edit/{id}/submit", RequireOffice(itdbWrite, ITDBPCEditSubmit(s))).Methods("POST")
+	itdb.HandleFunc("/pc/{office}/view/{id}", RequireOffice(itdbRead, PageITDBPCView(s)))
+	itdb.HandleFunc("/pc/{office}/delete/{id}", RequireOffice(itdbDelete, ITDBPCDelete(s))).Methods("POST")
+	itdb.HandleFunc("/printer/{office}", RequireOffice(itdbRead, PageITDBPrinter(s)))
+	itdb.HandleFunc("/printer/{office}/add", RequireOffice(itdbWrite, PageITDBPrinterAdd))
+	itdb.HandleFunc("/printer/{office}/add/submit", RequireOffice(itdbWrite, ITDBPrinterAddSubmit(s))).Methods("POST")
+	itdb.HandleFunc("/printer/{office}/edit/{rowid}", RequireOffice(itdbWrite, PageITDBPrinterEdit(s)))
+	itdb.HandleFunc("/printer/{office}/edit/{rowid}/submit", RequireOffice(itdbWrite, ITDBPrinterEditSubmit(s))).Methods("POST")
+}
+
+func (p PageITDBStruct) UserPermission(permission string, username string) (bool, error) {
+	usergroup, err := GetUsergroupByUsername(username)
+	if err != nil {
+		return false, err
+	}
+	return UsergroupPermission(permission, usergroup), nil
 }
 
-func (p PageITDBStruct) UserPermission(permission string, username string) bool {
-	usergroup := GetUsergroup(GetUserId(username))
-	return UsergroupPermission(permission, usergroup)
+func (p PageITDBStruct) OfficeAccess(office string) (bool, error) {
+	usergroup, err := GetUsergroupByUsername(p.Username)
+	if err != nil {
+		return false, err
+	}
+	return ITDBOfficeAccess(usergroup, office, itdbRead), nil
 }
 
 func PageITDB(w http.ResponseWriter, r *http.Request) {
-	if IsAuthenticated(w,r) {
-		username, usergroup := GetUserSession(r)
-		if AccessITDB(usergroup) {
-			data := PageITDBStruct {
-				"",
-				username,
-				"",
-				"",
-			}
-			tmpl := template.Must(template.ParseFiles("template/itdb/index.html"))
-			tmpl.Execute(w, data)
-		} else {
-			http.Redirect(w, r, "/user", 302)
-		}
-	} else {
-		http.Redirect(w, r, "/", 302)
+	user, _ := GetCurrentUser(r)
+	data := PageITDBStruct {
+		"",
+		user.Username,
+		"",
+		"",
 	}
+	tmpl := ParseTemplate(w, r, "itdb/index.html")
+	tmpl.Execute(w, data)
 }
 
 func PageITDBSetting(w http.ResponseWriter, r *http.Request) {
-	if IsAuthenticated(w,r) {
-		username, usergroup := GetUserSession(r)
-		if AccessITDB(usergroup) {
-			data := PageITDBStruct {
-				"",
-				username,
-				"",
-				"",
-			}
-			tmpl := template.Must(template.ParseFiles("template/itdb/setting.html"))
-			tmpl.Execute(w, data)
-		} else {
-			http.Redirect(w, r, "/user", 302)
-		}
-	} else {
-		http.Redirect(w, r, "/", 302)
+	user, _ := GetCurrentUser(r)
+	data := PageITDBStruct {
+		"",
+		user.Username,
+		"",
+		"",
 	}
+	tmpl := ParseTemplate(w, r, "itdb/setting.html")
+	tmpl.Execute(w, data)
 }
 
 // "/itdb/pc/{office}"
-func PageITDBPC(w http.ResponseWriter, r *http.Request) {
-	if IsAuthenticated(w,r) {
-		_, usergroup := GetUserSession(r)
-		if AccessITDB(usergroup) {
-			office := mux.Vars(r)["office"]
-			data := PCList {
-				Office: office,
-				PCs: GetPC(office),
-			}
+func PageITDBPC(s *Store) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		user, _ := GetCurrentUser(r)
+		office := mux.Vars(r)["office"]
+		pcs, err := s.PCs.All(office)
+		if err != nil {
+			HTTPError(w, r, err)
+			return
+		}
 
-			tmpl := template.Must(template.ParseFiles("template/itdb/pclist.html"))
-			tmpl.Execute(w, data)
-		} else {
-			http.Redirect(w, r, "/user", 302)
+		data := PCList {
+			Office: office,
+			PCs: pcs,
+			CanWrite: ITDBOfficeAccess(user.Usergroup, office, itdbWrite),
+			CanDelete: ITDBOfficeAccess(user.Usergroup, office, itdbDelete),
 		}
-	} else {
-		http.Redirect(w, r, "/", 302)
+
+		tmpl := ParseTemplate(w, r, "itdb/pclist.html")
+		tmpl.Execute(w, data)
 	}
 }
 
 // "/itdb/pc/{office}/add"
-func PageITDBPCAdd(w http.ResponseWriter, r *http.Request) {
-	if IsAuthenticated(w,r) {
-		username, usergroup := GetUserSession(r)
-		if AccessITDB(usergroup) {
-			office := mux.Vars(r)["office"]
-
-			userbasic := PageITDBStruct {
-				"",
-				username,
-				"",
-				usergroup,
-			}
-			data := PageITDBAddPC {
-				Office: office,
-				PageITDBStruct: userbasic,
-				Printers: GetPrinterNoHost(office),
-			}
+func PageITDBPCAdd(s *Store) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		user, _ := GetCurrentUser(r)
+		office := mux.Vars(r)["office"]
+
+		userbasic := PageITDBStruct {
+			"",
+			user.Username,
+			"",
+			user.Usergroup,
+		}
+		printers, err := s.Printers.Unhosted(office)
+		if err != nil {
+			HTTPError(w, r, err)
+			return
+		}
 
-			tmpl := template.Must(template.ParseFiles("template/itdb/addpc.html"))
-			tmpl.Execute(w, data)		
-		} else {
-			http.Redirect(w, r, "/user", 302)
+		data := PageITDBAddPC {
+			Office: office,
+			PageITDBStruct: userbasic,
+			Printers: printers,
 		}
-	} else {
-		http.Redirect(w, r, "/", 302)
+
+		tmpl := ParseTemplate(w, r, "itdb/addpc.html")
+		tmpl.Execute(w, data)		
 	}
 }
 
 // "/itdb/pc/{office}/edit/{id}"
-func PageITDBPCEdit(w http.ResponseWriter, r *http.Request) {
-	if IsAuthenticated(w,r) {
-		username, usergroup := GetUserSession(r)
-		if AccessITDB(usergroup) {
-			office := mux.Vars(r)["office"]
-			id := mux.Vars(r)["id"] // because pc tables use id instead of rowid
-			idInt,_ := strconv.Atoi(id)
-
-			userbasic := PageITDBStruct {
-				"",
-				username,
-				"",
-				usergroup,
-			}
-
-			data := struct{
-				Office string
-				PageITDBStruct PageITDBStruct
-				PC	PC
-				Printers []Printer
-			}{
-				office,
-				userbasic,
-				GetPCById(office, idInt),
-				//GetPrinter(office),
-				append(GetPrinterNoHost(office), HostedPrinters(office,idInt)...),
-			}
-
-			tmpl := template.Must(template.ParseFiles("template/itdb/editpc.html"))
-			tmpl.Execute(w, data)
-		} else{
-			http.Redirect(w, r, "/user", 302)
+func PageITDBPCEdit(s *Store) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		user, _ := GetCurrentUser(r)
+		office := mux.Vars(r)["office"]
+		idInt, err := itdbId(mux.Vars(r)["id"]) // because pc tables use id instead of rowid
+		if err != nil {
+			HTTPError(w, r, err)
+			return
 		}
-	} else {
-		http.Redirect(w, r, "/", 302)
-	}
-}
 
-// page just to display PC in tabular form for easier view
-func PageITDBPCView(w http.ResponseWriter, r *http.Request) {
-	if IsAuthenticated(w,r) {
-		username, usergroup := GetUserSession(r)
-		if AccessITDB(usergroup) {
-			office := mux.Vars(r)["office"]
-			id := mux.Vars(r)["id"] // because pc tables use id instead of rowid
-			idInt,_ := strconv.Atoi(id)
-
-			userbasic := PageITDBStruct {
-				"",
-				username,
-				"",
-				usergroup,
-			}
-
-			data := struct{
-				Office string
-				PageITDBStruct PageITDBStruct
-				PC	PC
-				Printers []Printer
-			}{
-				office,
-				userbasic,
-				GetPCById(office, idInt),
-				GetPrinterNoHost(office),
-			}
-
-			tmpl := template.Must(template.ParseFiles("template/itdb/viewpc.html"))
-			tmpl.Execute(w, data)
-		} else {
-			http.Redirect(w, r, "/user", 302)
+		userbasic := PageITDBStruct {
+			"",
+			user.Username,
+			"",
+			user.Usergroup,
 		}
-	} else {
-		http.Redirect(w, r, "/", 302)
-	}
-}
 
-// /itdb/printer/{office}
-func PageITDBPrinter(w http.ResponseWriter, r *http.Request) {
-	if IsAuthenticated(w,r) {
-		_, usergroup := GetUserSession(r)
-		if AccessITDB(usergroup) {
-			office := mux.Vars(r)["office"]
-			data := PrinterList {
-				Office: office,
-				Printers: GetPrinter(office),
-			}
-
-			tmpl := template.Must(template.ParseFiles("template/itdb/printerlist.html"))
-			tmpl.Execute(w, data)
-		} else {
-			http.Redirect(w, r, "/user", 302)
+		pc, err := s.PCs.ById(office, idInt)
+		if err != nil {
+			HTTPError(w, r, err)
+			return
 		}
-	} else{
-		http.Redirect(w, r, "/", 302)
-	}
-}
-
-// "/itdb/printer/{office}/add"
-func PageITDBPrinterAdd(w http.ResponseWriter, r *http.Request) {
-	if IsAuthenticated(w,r) {
-		username, usergroup := GetUserSession(r)
-		if AccessITDB(usergroup) {
-			office := mux.Vars(r)["office"]
-
-			userbasic := PageITDBStruct {
-				"",
-				username,
-				"",
-				usergroup,
-			}
-
-			data := struct {
-				Office string
-				PageITDBStruct PageITDBStruct
-			}{
-				office,
-				userbasic,
-			}
-
-			tmpl := template.Must(template.ParseFiles("template/itdb/addprinter.html"))
-			tmpl.Execute(w, data)
-		} else {
-			http.Redirect(w, r, "/user", 302)
+		unhosted, err := s.Printers.Unhosted(office)
+		if err != nil {
+			HTTPError(w, r, err)
+			return
 		}
-	} else {
-		http.Redirect(w, r, "/", 302)
-	}
-}
-
-// /itdb/printer/{office}/edit/{rowid}
-func PageITDBPrinterEdit(w http.ResponseWriter, r *http.Request) {
-	if IsAuthenticated(w,r) {
-		username, usergroup := GetUserSession(r)
-		if AccessITDB(usergroup) {
-			office := mux.Vars(r)["office"]
-			rowid := mux.Vars(r)["rowid"] // because pc tables use id instead of rowid
-			rowidInt,_ := strconv.Atoi(rowid)
-
-			userbasic := PageITDBStruct {
-				"",
-				username,
-				"",
-				usergroup,
-			}
-
-			data := struct{
-				Office string
-				PageITDBStruct PageITDBStruct
-				Printer	Printer
-			}{
-				office,
-				userbasic,
-				GetPrinterByRowid(office, rowidInt),
-			}
-
-			tmpl := template.Must(template.ParseFiles("template/itdb/editprinter.html"))
-			tmpl.Execute(w, data)
-		} else{
-			http.Redirect(w, r, "/user", 302)
+		hosted, err := s.Printers.HostedBy(office, idInt)
+		if err != nil {
+			HTTPError(w, r, err)
+			return
 		}
-	} else {
-		http.Redirect(w, r, "/", 302)
-	}
-}
-
-// Functions that handles process and procedures and does not involve returning HTML page
-//
-//
-
-// function to return all printers that has no host
-func GetPrinterNoHost(office string) []Printer {
-	db, errOpen := sql.Open("sqlite3", "./database/itdb.db")
-	if errOpen != nil {
-		log.Fatal("error opening itdb.db ", errOpen)
-	}
-	defer db.Close()
 
-    var printerstruct []Printer
-
-	query := ""
-
-	switch(office) {
-	case "sibu":
-		query = "SELECT rowid, * FROM printersibu1 WHERE host IS null OR host=''"
-	case "kapit":
-		query = "SELECT rowid, * FROM printerkapit1 WHERE host IS null OR host=''"
-	}
+		data := struct{
+			Office string
+			PageITDBStruct PageITDBStruct
+			PC	PC
+			Printers []Printer
+		}{
+			office,
+			userbasic,
+			pc,
+			//GetPrinter(office),
+			append(unhosted, hosted...),
+		}
 
-    row, err := db.Query(query)
-	
-	if err == sql.ErrNoRows {
-		log.Fatal("GetPrinterNoHost() no rows ", err)
-	} else if err != nil {
-		log.Fatal("func GetPrinterNoHost() return err nil ", err)
+		tmpl := ParseTemplate(w, r, "itdb/editpc.html")
+		tmpl.Execute(w, data)
 	}
-
-    defer row.Close()
-    for row.Next() {
-        printer := Printer{}
-		printer.Office = office
-        err := row.Scan(&printer.Rowid, &printer.Printermodel, &printer.Printerno, &printer.Printertype, &printer.Notes, &printer.Host, &printer.Nickname)
-        if err != nil {
-            log.Fatal(err)
-        }
-        printerstruct = append(printerstruct, printer)
-    }
-
-    return printerstruct
 }
 
+// page just to display PC in tabular form for easier view
+func PageITDBPCView(s *Store) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		user, _ := GetCurrentUser(r)
+		office := mux.Vars(r)["office"]
+		idInt, err := itdbId(mux.Vars(r)["id"]) // because pc tables use id instead of rowid
+		if err != nil {
+			HTTPError(w, r, err)
+			return
+		}
 
-func HostedPrinters(office string, id int) []Printer {
-	db, errOpen := sql.Open("sqlite3", "./database/itdb.db")
-	if errOpen != nil {
-		log.Fatal("error opening itdb.db ", errOpen)
-	}
-	defer db.Close()
-
-    var printerstruct []Printer
+		userbasic := PageITDBStruct {
+			"",
+			user.Username,
+			"",
+			user.Usergroup,
+		}
 
-	query := ""
+		pc, err := s.PCs.ById(office, idInt)
+		if err != nil {
+			HTTPError(w, r, err)
+			return
+		}
+		printers, err := s.Printers.Unhosted(office)
+		if err != nil {
+			HTTPError(w, r, err)
+			return
+		}
 
-	switch(office) {
-	case "sibu":
-		query = "SELECT rowid, * FROM " + printersibu + " WHERE host=?"
-	case "kapit":
-		query = "SELECT rowid, * FROM " + printerkapit + " WHERE host=?"
-	}
+		data := struct{
+			Office string
+			PageITDBStruct PageITDBStruct
+			PC	PC
+			Printers []Printer
+			CanWrite bool
+		}{
+			office,
+			userbasic,
+			pc,
+			printers,
+			ITDBOfficeAccess(user.Usergroup, office, itdbWrite),
+		}
 
-    row, err := db.Query(query, id)
-	
-	if err == sql.ErrNoRows {
-		log.Fatal("HostedPrinters() no rows ", err)
-	} else if err != nil {
-		log.Fatal("HostedPrinters() return err nil ", err)
+		tmpl := ParseTemplate(w, r, "itdb/viewpc.html")
+		tmpl.Execute(w, data)
 	}
-
-    defer row.Close()
-    for row.Next() {
-        printer := Printer{}
-		printer.Office = office
-        err := row.Scan(&printer.Rowid, &printer.Printermodel, &printer.Printerno, &printer.Printertype, &printer.Notes, &printer.Host, &printer.Nickname)
-        if err != nil {
-            log.Fatal(err)
-        }
-        printerstruct = append(printerstruct, printer)
-    }
-
-    return printerstruct
 }
 
-// function to get all PCs as per office
-func GetPC(office string) []PC {
-	db, errOpen := sql.Open("sqlite3", "./database/itdb.db")
-	if errOpen != nil {
-		log.Fatal("error opening itdb.db ", errOpen)
-	}
-	defer db.Close()
-
-    var pcstruct []PC
-
-	query := ""
+// /itdb/printer/{office}
+func PageITDBPrinter(s *Store) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		user, _ := GetCurrentUser(r)
+		office := mux.Vars(r)["office"]
+		printers, err := s.Printers.All(office)
+		if err != nil {
+			HTTPError(w, r, err)
+			return
+		}
 
-	switch(office) {
-	case "sibu":
-		query = "SELECT * FROM " + pcsibu 
-	case "kapit":
-		query = "SELECT * FROM " + pckapit
-	}
+		data := PrinterList {
+			Office: office,
+			Printers: printers,
+			CanWrite: ITDBOfficeAccess(user.Usergroup, office, itdbWrite),
+		}
 
-    row, err := db.Query(query)
-	
-	if err == sql.ErrNoRows {
-		// if it indeed has no rows, it means the table is still new
-		log.Fatal("GetPC() ", err)
-		return pcstruct
-	} else if err != nil {
-		log.Fatal("func GetPC() return error :", err)
+		tmpl := ParseTemplate(w, r, "itdb/printerlist.html")
+		tmpl.Execute(w, data)
 	}
-
-    defer row.Close()
-    for row.Next() {
-        pc := PC{}
-        err := row.Scan(&pc.Id, &pc.Hostname, &pc.Ip, &pc.Cpumodel, &pc.Cpuno, &pc.Monitormodel, &pc.Monitorno, &pc.Printer, &pc.User, &pc.Department, &pc.Notes)
-        if err != nil {
-            log.Fatal(err)
-        }
-
-		pc.Office = office //assigns at each row, because when inside range, global ".Office" is not recognized
-
-        pcstruct = append(pcstruct, pc)
-    }
-
-    return pcstruct
 }
 
-// function to get PC by its row id (not rowid)
-func GetPCById(office string, id int) PC {
-	db, errOpen := sql.Open("sqlite3", "./database/itdb.db")
-	if errOpen != nil {
-		log.Fatal("error opening itdb.db ", errOpen)
-	}
-	defer db.Close()
-
-	query := ""
+// "/itdb/printer/{office}/add"
+func PageITDBPrinterAdd(w http.ResponseWriter, r *http.Request) {
+	user, _ := GetCurrentUser(r)
+	office := mux.Vars(r)["office"]
 
-	switch(office) {
-	case "sibu":
-		query = "SELECT * FROM " + pcsibu + " WHERE id=?"
-	case "kapit":
-		query = "SELECT * FROM " + pckapit + " WHERE id=?"
+	userbasic := PageITDBStruct {
+		"",
+		user.Username,
+		"",
+		user.Usergroup,
 	}
 
-	pcstruct := PC{}
-
-	err := db.QueryRow(query, id).Scan(&pcstruct.Id, &pcstruct.Hostname, &pcstruct.Ip, &pcstruct.Cpumodel, &pcstruct.Cpuno, &pcstruct.Monitormodel, &pcstruct.Monitorno, &pcstruct.Printer, &pcstruct.User, &pcstruct.Department, &pcstruct.Notes)
-
-	if err == sql.ErrNoRows {
-		log.Fatal("GetPCById ", err)
-	} else if err != nil {
-		log.Fatal(err)
+	data := struct {
+		Office string
+		PageITDBStruct PageITDBStruct
+	}{
+		office,
+		userbasic,
 	}
 
-	pcstruct.Office = office //most likely is needed
-
-    return pcstruct
+	tmpl := ParseTemplate(w, r, "itdb/addprinter.html")
+	tmpl.Execute(w, data)
 }
 
-// function to get printer by its rowid
-func GetPrinterByRowid(office string, rowid int) Printer {
-	db, errOpen := sql.Open("sqlite3", "./database/itdb.db")
-	if errOpen != nil {
-		log.Fatal("error opening itdb.db ", errOpen)
-	}
-	defer db.Close()
-
-	query := ""
+// /itdb/printer/{office}/edit/{rowid}
+func PageITDBPrinterEdit(s *Store) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		user, _ := GetCurrentUser(r)
+		office := mux.Vars(r)["office"]
+		rowidInt, err := itdbId(mux.Vars(r)["rowid"])
+		if err != nil {
+			HTTPError(w, r, err)
+			return
+		}
 
-	switch(office) {
-	case "sibu":
-		query = "SELECT rowid, * FROM " + printersibu + " WHERE rowid=?"
-	case "kapit":
-		query = "SELECT rowid, * FROM " + printerkapit + " WHERE rowid=?"
-	}
+		userbasic := PageITDBStruct {
+			"",
+			user.Username,
+			"",
+			user.Usergroup,
+		}
 
-	printerstruct := Printer{}
+		printer, err := s.Printers.ByRowid(office, rowidInt)
+		if err != nil {
+			HTTPError(w, r, err)
+			return
+		}
 
-	err := db.QueryRow(query, rowid).Scan(&printerstruct.Rowid, &printerstruct.Printermodel, &printerstruct.Printerno, &printerstruct.Printertype, &printerstruct.Notes, &printerstruct.Host, &printerstruct.Nickname)
+		data := struct{
+			Office string
+			PageITDBStruct PageITDBStruct
+			Printer	Printer
+		}{
+			office,
+			userbasic,
+			printer,
+		}
 
-	if err == sql.ErrNoRows {
-		log.Fatal("GetPrinterByRowid ", err)
-	} else if err != nil {
-		log.Fatal(err)
+		tmpl := ParseTemplate(w, r, "itdb/editprinter.html")
+		tmpl.Execute(w, data)
 	}
-
-	printerstruct.Office = office //most likely is needed
-
-    return printerstruct
 }
 
-// function to get all printers as per office
-func GetPrinter(office string) []Printer {
-	db, errOpen := sql.Open("sqlite3", "./database/itdb.db")
-	if errOpen != nil {
-		log.Fatal("error opening itdb.db ", errOpen)
-	}
-	defer db.Close()
-
-    var printerstruct []Printer
-
-	query := ""
+// Functions that handles process and procedures and does not involve returning HTML page
+//
+//
 
-	switch(office) {
-	case "sibu":
-		query = "SELECT rowid, * FROM " + printersibu 
-	case "kapit":
-		query = "SELECT rowid, * FROM " + printerkapit
+// determines whether usergroup may access PCs and printers of office at level (itdbRead, itdbWrite or itdbDelete)
+// on top of access_itdb, this needs permission "itdb_<level>_<office>". write implies read
+func ITDBOfficeAccess(usergroup string, office string, level string) bool {
+	known := false
+	for _, o := range itdbOffices {
+		if o == office {
+			known = true
+		}
 	}
-
-    row, err := db.Query(query)
-	
-	if err == sql.ErrNoRows {
-		// if it indeed has no rows, it means the table is still new
-		log.Fatal("GetPrinter() ", err)
-		return printerstruct
-	} else if err != nil {
-		log.Fatal("func GetPrinter() return error :", err)
+	if !known || !AccessITDB(usergroup) {
+		return false
 	}
 
-    defer row.Close()
-    for row.Next() {
-        printer := Printer{}
-        err := row.Scan(&printer.Rowid, &printer.Printermodel, &printer.Printerno, &printer.Printertype, &printer.Notes, &printer.Host, &printer.Nickname)
-        if err != nil {
-            log.Fatal(err)
-        }
-
-		printer.Office = office //assigns at each row, because when inside range, global ".Office" is not recognized
-
-        printerstruct = append(printerstruct, printer)
-    }
-
-    return printerstruct
+	if level == itdbRead && UsergroupPermission("itdb_" + itdbWrite + "_" + office, usergroup) {
+		return true
+	}
+	return UsergroupPermission("itdb_" + level + "_" + office, usergroup)
 }
 
 // function to offset index at range so that it begins at 1
@@ -594,29 +406,24 @@ func (p PC) IndexOffset(index int) string {
 }
 
 // function to display printer rowid as printer name
-// printerno format "1 2" (number separated by spaces)
-func (p PC) PrinterName(office string, printerno string) string {
-	if len(printerno) == 0 {
-		return ""
-	}
-
-	printerRowids := strings.Split(printerno, " ")
-
-	// An uninitialized slice equals to nil and has length 0.
-	if len(printerRowids) == 0 {
-		return ""
-	}
-
-	// loop
+// printerno format "1 2" (number separated by spaces), printers removed in the meantime are skipped
+func (p PC) PrinterName(office string, printerno string) (string, error) {
 	finalString := ""
-	for i:=0; i<len(printerRowids); i++ {
-		printer := Printer{}
-		rowid, _ := strconv.Atoi(printerRowids[i])
-		printer = GetPrinterByRowid(office, rowid)
+	for _, field := range strings.Fields(printerno) {
+		rowid, err := strconv.Atoi(field)
+		if err != nil {
+			continue
+		}
+		printer, err := defaultStore.Printers.ByRowid(office, rowid)
+		if err == sql.ErrNoRows {
+			continue
+		} else if err != nil {
+			return "", err
+		}
 		finalString += printer.Printermodel + " (" + printer.Nickname + ") "
 	}
 
-	return finalString
+	return finalString, nil
 }
 
 func (p Printer) IndexOffset(index int) string {
@@ -624,419 +431,279 @@ func (p Printer) IndexOffset(index int) string {
 	return strconv.Itoa(index)
 }
 
-// function to get hostname for related printer
-func (p Printer) PrinterHostname(id int64, office string) string {
+// function to get hostname for related printer, "n/a" if it has no host or the host has been removed
+func (p Printer) PrinterHostname(id int64, office string) (string, error) {
 	if id == 0 {
-		return "n/a"
-	} else {
-		return GetHostname(int(id),office)
+		return "n/a", nil
 	}
-}
 
-// function to determine whether the printer is already hosted, and will return "checked" or ""
-func (p Printer) PrinterChecked(office string, rowid int) string {
-	checkedStr := ""
-
-	printertable := ""
-	switch(office) {
-	case "sibu":
-		printertable = printersibu
-	case "kapit":
-		printertable = printerkapit
+	hostname, err := defaultStore.PCs.Hostname(office, int(id))
+	if err == sql.ErrNoRows {
+		return "n/a", nil
 	}
+	return hostname, err
+}
 
-	db, err := sql.Open("sqlite3", "./database/itdb.db")
+// function to determine whether the printer is already hosted, and will return "checked" or ""
+func (p Printer) PrinterChecked(office string, rowid int) (string, error) {
+	hosted, err := defaultStore.Printers.Hosted(office, rowid)
 	if err != nil {
-		log.Fatal(err)
+		return "", err
 	}
-	defer db.Close()
-
-	var hostInt sql.NullInt64
-	query := `SELECT host FROM ` + printertable + ` WHERE rowid=?`
-	err = db.QueryRow(query, rowid).Scan(&hostInt)
 
-	if hostInt.Valid {
-		checkedStr = "checked"
-	} else {
-		checkedStr = ""
+	if hosted {
+		return "checked", nil
 	}
-
-	return checkedStr
+	return "", nil
 }
 
-func GetHostname(id int, office string) string {
-	hostname := ""
-
-	db, errOpen := sql.Open("sqlite3", "./database/itdb.db")
-	if errOpen != nil {
-		log.Fatal(errOpen)
-	}
-	defer db.Close()
-
-	pctable := ""
-	switch(office) {
-	case "sibu":
-		pctable = pcsibu 
-	case "kapit":
-		pctable = pckapit
-	}
-
-
-	query := `SELECT hostname FROM ` + pctable + ` WHERE id = ?`
-	err := db.QueryRow(query, id).Scan(&hostname)
-
-	if err == sql.ErrNoRows {
-		log.Fatal("GetHostname() =",err)
-		return ""
-	} else if err != nil {
-		log.Fatal(err)
-		return ""
+// function to read the id of a PC or the rowid of a printer, ErrBadRequest if it is not a number
+func itdbId(value string) (int, error) {
+	id, err := strconv.Atoi(value)
+	if err != nil {
+		return 0, fmt.Errorf("%w: invalid id %q", ErrBadRequest, value)
 	}
-
-	return hostname
+	return id, nil
 }
 
 // function to handle add new PC
-func ITDBPCAddSubmit(w http.ResponseWriter, r *http.Request) {
-	if IsAuthenticated(w,r) {
-		_, usergroup := GetUserSession(r)
-		if AccessITDB(usergroup) {
-			r.ParseForm()
-
-			office := r.FormValue("office")
-			hostname := r.FormValue("hostname")
-			ip := r.FormValue("ip")
-			cpu_model := r.FormValue("cpu_model")
-			cpu_no := r.FormValue("cpu_no")
-			monitor_model := r.FormValue("monitor_model")
-			monitor_no := r.FormValue("monitor_no")
-			user := r.FormValue("user")
-			department := r.FormValue("department")
-			notes := r.FormValue("notes")
-			// have to check because sometimes there are no printer to be set
-			printer := "" //default
-			if r.PostForm.Has("printer") {
-				printer = r.FormValue("printer")
-			}
-
-			db, errOpen := sql.Open("sqlite3", "./database/itdb.db")
-			if errOpen != nil {
-				log.Fatal(errOpen)
-			}
-			defer db.Close()
-
-			// decides which table
-			pctable := ""
-			switch(office) {
-			case "sibu":
-				pctable = pcsibu
-			case "kapit":
-				pctable = pckapit
-			}
-
-			result, err := db.Exec(`INSERT INTO ` + pctable + ` (hostname, ip, cpu_model, cpu_no, monitor_model, monitor_no, printer, user, department, notes) VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?)`, hostname, ip, cpu_model, cpu_no, monitor_model, monitor_no, printer, user, department, notes)
-
-			if err != nil {
-				log.Println(err)
-			} else {
-				if len(printer) != 0 {
-					// update the printer too
-					lastid, _ := result.LastInsertId() // get last id being inserted on the pc table
-					ITDBPrinterHostUpdate(office, printer, int(lastid))
-				}
-
-				http.Redirect(w, r, "/itdb/pc/"+office, 302)
-			}
-		} else {
-			http.Redirect(w, r, "/user", 302)
+func ITDBPCAddSubmit(s *Store) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		user, _ := GetCurrentUser(r)
+		r.ParseForm()
+
+		office := mux.Vars(r)["office"]
+		pc := PC{
+			Office: office,
+			Hostname: r.FormValue("hostname"),
+			Ip: r.FormValue("ip"),
+			Cpumodel: r.FormValue("cpu_model"),
+			Cpuno: r.FormValue("cpu_no"),
+			Monitormodel: r.FormValue("monitor_model"),
+			Monitorno: r.FormValue("monitor_no"),
+			User: r.FormValue("user"),
+			Department: r.FormValue("department"),
+			Notes: r.FormValue("notes"),
+		}
+		// have to check because sometimes there are no printer to be set
+		if r.PostForm.Has("printer") {
+			pc.Printer = r.FormValue("printer")
 		}
-	} else{
-		http.Redirect(w, r, "/", 302)
-	}
-}
-
-func ITDBPCEditSubmit(w http.ResponseWriter, r *http.Request) {
-	if IsAuthenticated(w,r) {
-		_, usergroup := GetUserSession(r)
-		if AccessITDB(usergroup) {
-			r.ParseForm()
-			//
-			id := r.FormValue("id")
-			office := r.FormValue("office")
-			hostname := r.FormValue("hostname")
-			ip := r.FormValue("ip")
-			cpu_model := r.FormValue("cpu_model")
-			cpu_no := r.FormValue("cpu_no")
-			monitor_model := r.FormValue("monitor_model")
-			monitor_no := r.FormValue("monitor_no")
-			user := r.FormValue("user")
-			department := r.FormValue("department")
-			notes := r.FormValue("notes")
-			// have to check because sometimes there are no printer to be set
-			printer := "" //default
-			if r.PostForm.Has("printer") {
-				var s []string
-				for index := range r.Form["printer"] {
-					s = append(s, r.Form["printer"][index])
-				}
-				printer = strings.Join(s, " ")
-			}
 
-			// procedures performed before the update
-			intid, _ := strconv.Atoi(id)
-			hostedprinters := ITDBGetHostedPrinters(office, intid)
-			if len(hostedprinters)!=0 {
-				// split into string slices
-				var s []string
-				s = strings.Fields(hostedprinters)
-				
-				// loop to update every printer rowids
-				for index := range s {
-					intindex, _ := strconv.Atoi(s[index])
-					ITDBPrinterSetHostEmpty(office, intindex)
+		lastid, err := s.PCs.Create(pc) // get last id being inserted on the pc table
+		if err != nil {
+			HTTPError(w, r, err)
+		} else {
+			if len(pc.Printer) != 0 {
+				// update the printer too
+				if err := s.Printers.SetHost(office, pc.Printer, int(lastid)); err != nil {
+					HTTPError(w, r, err)
+					return
 				}
 			}
-
-
-			db, errOpen := sql.Open("sqlite3", "./database/itdb.db")
-			if errOpen != nil {
-				log.Fatal(errOpen)
+			after, err := AuditPC(office, int(lastid))
+			if err != nil {
+				HTTPError(w, r, err)
+				return
 			}
-			defer db.Close()
-
-			// decides which table
-			pctable := ""
-			switch(office) {
-			case "sibu":
-				pctable = pcsibu
-			case "kapit":
-				pctable = pckapit
+			if err := AuditLog(r, user.Username, auditEntityPC, office + ":" + strconv.FormatInt(lastid, 10), auditActionCreate, nil, after); err != nil {
+				HTTPError(w, r, err)
+				return
 			}
 
-			query := `UPDATE ` + pctable + ` SET hostname=?, ip=?, cpu_model=?, cpu_no=?, monitor_model=?, monitor_no=?, printer=?, user=?, department=?, notes=? WHERE id = ?`
-			_, err := db.Exec(query, hostname, ip, cpu_model, cpu_no, monitor_model, monitor_no, printer, user, department, notes, id)
-			
-			if err != nil {
-				log.Println(err)
-			} else {
-				if len(printer) != 0 {
-					// update the printer too
-					idInt, _ := strconv.Atoi(id)
-					ITDBPrinterHostUpdate(office, printer, idInt)
-				}
-
-				http.Redirect(w, r, "/itdb/pc/" + office + "/view/" + id, 302)
-			}
-		} else {
-			http.Redirect(w, r, "/user", 302)
+			http.Redirect(w, r, "/itdb/pc/"+office, 302)
 		}
-	} else {
-		http.Redirect(w, r, "/", 302)
 	}
 }
 
-func ITDBPCDelete(w http.ResponseWriter, r *http.Request) {
-	if IsAuthenticated(w,r) {
-		_, usergroup := GetUserSession(r)
-		if AccessITDB(usergroup) {
-			office := mux.Vars(r)["office"]
-			id := mux.Vars(r)["id"] // because pc tables use id instead of rowid
-			idInt,_ := strconv.Atoi(id)
-
-			// decides which table
-			pctable := ""
-			switch(office) {
-			case "sibu":
-				pctable = pcsibu
-			case "kapit":
-				pctable = pckapit
-			}
+func ITDBPCEditSubmit(s *Store) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		user, _ := GetCurrentUser(r)
+		r.ParseForm()
+		id := mux.Vars(r)["id"]
+		intid, err := itdbId(id)
+		if err != nil {
+			HTTPError(w, r, err)
+			return
+		}
+		office := mux.Vars(r)["office"]
+		pc := PC{
+			Office: office,
+			Id: intid,
+			Hostname: r.FormValue("hostname"),
+			Ip: r.FormValue("ip"),
+			Cpumodel: r.FormValue("cpu_model"),
+			Cpuno: r.FormValue("cpu_no"),
+			Monitormodel: r.FormValue("monitor_model"),
+			Monitorno: r.FormValue("monitor_no"),
+			User: r.FormValue("user"),
+			Department: r.FormValue("department"),
+			Notes: r.FormValue("notes"),
+		}
+		// have to check because sometimes there are no printer to be set
+		if r.PostForm.Has("printer") {
+			pc.Printer = strings.Join(r.Form["printer"], " ")
+		}
 
-			db, errOpen := sql.Open("sqlite3", "./database/itdb.db")
-			if errOpen != nil {
-				log.Fatal(errOpen)
-			}
-			defer db.Close()
+		// procedures performed before the update
+		before, err := AuditPC(office, intid)
+		if err != nil {
+			HTTPError(w, r, err)
+			return
+		}
+		if before == nil {
+			PageNotFound(w, r)
+			return
+		}
+		hostedprinters, err := s.PCs.PrinterField(office, intid)
+		if err != nil {
+			HTTPError(w, r, err)
+			return
+		}
+		if err := s.Printers.ClearHost(office, hostedprinters); err != nil {
+			HTTPError(w, r, err)
+			return
+		}
 
-			query := `DELETE FROM ` + pctable + ` WHERE id = ?`
-			_, err := db.Exec(query, idInt)
+		err = s.PCs.Update(pc)
+		if err != nil {
+			HTTPError(w, r, err)
+		} else {
+			if len(pc.Printer) != 0 {
+				// update the printer too
+				if err := s.Printers.SetHost(office, pc.Printer, intid); err != nil {
+					HTTPError(w, r, err)
+					return
+				}
+			}
+			after, err := AuditPC(office, intid)
 			if err != nil {
-				log.Fatal(err)
+				HTTPError(w, r, err)
+				return
+			}
+			if err := AuditLog(r, user.Username, auditEntityPC, office + ":" + id, auditActionUpdate, before, after); err != nil {
+				HTTPError(w, r, err)
+				return
 			}
 
-			http.Redirect(w, r, "/itdb/pc/"+office, 302)
-		} else {
-			http.Redirect(w, r, "/user", 302)
+			http.Redirect(w, r, "/itdb/pc/" + office + "/view/" + id, 302)
 		}
-	} else {
-		http.Redirect(w, r, "/", 302)
 	}
 }
 
-// function to handle add new printer
-func ITDBPrinterAddSubmit(w http.ResponseWriter, r *http.Request) {
-	if IsAuthenticated(w,r) {
-		_, usergroup := GetUserSession(r)
-		if AccessITDB(usergroup) {
-			r.ParseForm()
-
-			office := r.FormValue("office")
-			printermodel := r.FormValue("printermodel")
-			printerno := r.FormValue("printerno")
-			printertype := r.FormValue("printertype")
-			notes := r.FormValue("notes")
-			nickname := r.FormValue("nickname")
-
-			db, errOpen := sql.Open("sqlite3", "./database/itdb.db")
-			if errOpen != nil {
-				log.Fatal(errOpen)
-			}
-			defer db.Close()
-
-			// decides which table
-			printertable := ""
-			switch(office) {
-			case "sibu":
-				printertable = printersibu
-			case "kapit":
-				printertable = printerkapit
-			}
+func ITDBPCDelete(s *Store) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		user, _ := GetCurrentUser(r)
+		office := mux.Vars(r)["office"]
+		id := mux.Vars(r)["id"] // because pc tables use id instead of rowid
+		idInt, err := itdbId(id)
+		if err != nil {
+			HTTPError(w, r, err)
+			return
+		}
 
-			_, err := db.Exec(`INSERT INTO ` + printertable + ` (printermodel, printerno, printertype, notes, nickname) VALUES (?, ?, ?, ?, ?)`, printermodel, printerno, printertype, notes, nickname)
+		before, err := AuditPC(office, idInt)
+		if err != nil {
+			HTTPError(w, r, err)
+			return
+		}
+		if before == nil {
+			PageNotFound(w, r)
+			return
+		}
 
-			if err != nil {
-				log.Println(err)
-			} else {
-				//success
-				http.Redirect(w, r, "/itdb/printer/" + office + "", 302)
-			}
-		} else {
-			http.Redirect(w, r, "/user", 302)
+		if err := s.PCs.Delete(office, idInt); err != nil {
+			HTTPError(w, r, err)
+			return
 		}
-	} else{
-		http.Redirect(w, r, "/", 302)
+		if err := AuditLog(r, user.Username, auditEntityPC, office + ":" + id, auditActionDelete, before, nil); err != nil {
+			HTTPError(w, r, err)
+			return
+		}
+
+		http.Redirect(w, r, "/itdb/pc/"+office, 302)
 	}
 }
 
-func ITDBPrinterEditSubmit(w http.ResponseWriter, r *http.Request) {
-	if IsAuthenticated(w,r) {
-		_, usergroup := GetUserSession(r)
-		if AccessITDB(usergroup) {
-			rowid := r.FormValue("rowid")
-			office := r.FormValue("office")
-			printermodel := r.FormValue("printermodel")
-			printerno := r.FormValue("printerno")
-			printertype := r.FormValue("printertype")
-			notes := r.FormValue("notes")
-			nickname := r.FormValue("nickname")
-
-
-			// begin procedure of updating password
-			db, errOpen := sql.Open("sqlite3", "./database/itdb.db")
-			if errOpen != nil {
-				log.Fatal(errOpen)
-			}
-			defer db.Close()
-
-			// decides which table
-			printertable := ""
-			switch(office) {
-			case "sibu":
-				printertable = printersibu
-			case "kapit":
-				printertable = printerkapit
-			}
+// function to handle add new printer
+func ITDBPrinterAddSubmit(s *Store) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		user, _ := GetCurrentUser(r)
+		r.ParseForm()
+
+		office := mux.Vars(r)["office"]
+		printer := Printer{
+			Office: office,
+			Printermodel: r.FormValue("printermodel"),
+			Printerno: r.FormValue("printerno"),
+			Printertype: r.FormValue("printertype"),
+			Notes: sql.NullString{String: r.FormValue("notes"), Valid: true},
+			Nickname: r.FormValue("nickname"),
+		}
 
-			query := `UPDATE ` + printertable + ` SET printermodel=?, printerno=?, printertype=?, notes=?, nickname=? WHERE rowid = ?`
-			_, err := db.Exec(query, printermodel, printerno, printertype, notes, nickname, rowid)
+		lastid, err := s.Printers.Create(printer)
+		if err != nil {
+			HTTPError(w, r, err)
+		} else {
+			//success
+			after, err := AuditPrinter(office, int(lastid))
 			if err != nil {
-				log.Fatal(err)
+				HTTPError(w, r, err)
+				return
 			}
-			
-			http.Redirect(w, r, "/itdb/printer/" + office, 302)
-		} else {
-			http.Redirect(w, r, "/user", 302)
+			if err := AuditLog(r, user.Username, auditEntityPrinter, office + ":" + strconv.FormatInt(lastid, 10), auditActionCreate, nil, after); err != nil {
+				HTTPError(w, r, err)
+				return
+			}
+			http.Redirect(w, r, "/itdb/printer/" + office + "", 302)
 		}
-	} else {
-		http.Redirect(w, r, "/", 302)
 	}
 }
 
-// function to update printer host column
-// remember: the host column is FK
-// this could involve multple printers/devices
-func ITDBPrinterHostUpdate(office string, printer string, pcid int) {
-	printertable := ""
-	switch(office) {
-	case "sibu":
-		printertable = printersibu
-	case "kapit":
-		printertable = printerkapit
-	}
-
-	// printer means the format used in storing printer as in PC
-	printerRowids := strings.Split(printer, " ")
-
-	db, errOpen := sql.Open("sqlite3", "./database/itdb.db")
-	if errOpen != nil {
-		log.Fatal(errOpen)
-	}
-	defer db.Close()
-
-	for i:=0; i<len(printerRowids); i++ {
-		query := `UPDATE ` + printertable + ` SET host=? WHERE rowid=?`
-		_, err := db.Exec(query, pcid, printerRowids[i])
+func ITDBPrinterEditSubmit(s *Store) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		user, _ := GetCurrentUser(r)
+		rowid := mux.Vars(r)["rowid"]
+		rowidInt, err := itdbId(rowid)
 		if err != nil {
-			log.Fatal(err)
+			HTTPError(w, r, err)
+			return
+		}
+		office := mux.Vars(r)["office"]
+		printer := Printer{
+			Office: office,
+			Rowid: rowidInt,
+			Printermodel: r.FormValue("printermodel"),
+			Printerno: r.FormValue("printerno"),
+			Printertype: r.FormValue("printertype"),
+			Notes: sql.NullString{String: r.FormValue("notes"), Valid: true},
+			Nickname: r.FormValue("nickname"),
 		}
-	}
-}
-
-// function to get value on printer field
-func ITDBGetHostedPrinters(office string, pcid int) string {
-	pctable := ""
-	switch(office) {
-	case "sibu":
-		pctable = pcsibu
-	case "kapit":
-		pctable = pckapit
-	}
-
-	strPrinter := ""
 
-	db, errOpen := sql.Open("sqlite3", "./database/itdb.db")
-	if errOpen != nil {
-		log.Fatal(errOpen)
-	}
-	defer db.Close()
+		before, err := AuditPrinter(office, rowidInt)
+		if err != nil {
+			HTTPError(w, r, err)
+			return
+		}
+		if before == nil {
+			PageNotFound(w, r)
+			return
+		}
 
-	query := `SELECT printer FROM `+pctable+` WHERE id = ?`
-	err := db.QueryRow(query, pcid).Scan(&strPrinter)
+		if err := s.Printers.Update(printer); err != nil {
+			HTTPError(w, r, err)
+			return
+		}
+		after, err := AuditPrinter(office, rowidInt)
+		if err != nil {
+			HTTPError(w, r, err)
+			return
+		}
+		if err := AuditLog(r, user.Username, auditEntityPrinter, office + ":" + rowid, auditActionUpdate, before, after); err != nil {
+			HTTPError(w, r, err)
+			return
+		}
 
-	if err == sql.ErrNoRows {
-		log.Fatal(err)
-	} else if err != nil {
-		log.Fatal(err)
+		http.Redirect(w, r, "/itdb/printer/" + office, 302)
 	}
-
-	return strPrinter
 }
-
-func ITDBPrinterSetHostEmpty(office string, rowid int) {
-	printertable := ""
-	switch(office) {
-	case "sibu":
-		printertable = printersibu
-	case "kapit":
-		printertable = printerkapit
-	}
-
-	db, errOpen := sql.Open("sqlite3", "./database/itdb.db")
-	if errOpen != nil {
-		log.Fatal(errOpen)
-	}
-	defer db.Close()
-
-	query := `UPDATE ` + printertable + ` SET host = NULL WHERE rowid = ?`
-	db.Exec(query, rowid)
-}
\ No newline at end of file
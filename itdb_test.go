@@ -0,0 +1,50 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+	"net/url"
+	"net/http"
+	"net/http/httptest"
+	"github.com/gorilla/mux"
+)
+
+// function to post form to the edit of PC id in office, returns the status code
+func testPCEdit(t *testing.T, s *Store, office string, id string, form url.Values) int {
+	t.Helper()
+	r := httptest.NewRequest("POST", "/itdb/pc/" + office + "/edit/" + id + "/submit", strings.NewReader(form.Encode()))
+	r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	r = testAsUser(mux.SetURLVars(r, map[string]string{"office": office, "id": id}), CurrentUser{"1", "alice", "admin"})
+	w := httptest.NewRecorder()
+	ITDBPCEditSubmit(s)(w, r)
+	return w.Code
+}
+
+// the PC edited is the one named by the URL, whatever the form says
+func TestITDBPCEditSubmit(t *testing.T) {
+	s := testStore(t)
+	first, err := s.PCs.Create(PC{Office: "sibu", Hostname: "pc-01"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	second, err := s.PCs.Create(PC{Office: "sibu", Hostname: "pc-02"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	form := url.Values{"id": {fmt.Sprint(second)}, "hostname": {"pc-renamed"}}
+	if code := testPCEdit(t, s, "sibu", fmt.Sprint(first), form); code != http.StatusFound {
+		t.Fatalf("edit returned %d", code)
+	}
+	if hostname, err := s.PCs.Hostname("sibu", int(first)); err != nil || hostname != "pc-renamed" {
+		t.Errorf("Hostname(first) = %q, %v", hostname, err)
+	}
+	if hostname, err := s.PCs.Hostname("sibu", int(second)); err != nil || hostname != "pc-02" {
+		t.Errorf("Hostname(second) = %q, %v", hostname, err)
+	}
+
+	if code := testPCEdit(t, s, "sibu", "999", form); code != http.StatusNotFound {
+		t.Errorf("edit of unknown PC returned %d, want %d", code, http.StatusNotFound)
+	}
+}
@@ -0,0 +1,293 @@
+// queries on the PC and printer tables of itdb.db, every office has a table of each (see itdbOffices)
+package main
+
+import (
+	"errors"
+	"strings"
+	"database/sql"
+)
+
+var ErrUnknownOffice = errors.New("unknown office")
+
+type PCRepository struct {
+	db	*sql.DB
+}
+
+type PrinterRepository struct {
+	db	*sql.DB
+}
+
+// function to return the PC table of office
+func pcTable(office string) (string, error) {
+	switch(office) {
+	case "sibu":
+		return pcsibu, nil
+	case "kapit":
+		return pckapit, nil
+	}
+	return "", ErrUnknownOffice
+}
+
+// function to return the printer table of office
+func printerTable(office string) (string, error) {
+	switch(office) {
+	case "sibu":
+		return printersibu, nil
+	case "kapit":
+		return printerkapit, nil
+	}
+	return "", ErrUnknownOffice
+}
+
+func scanPCs(office string, row *sql.Rows) ([]PC, error) {
+	var pcs []PC
+
+	defer row.Close()
+	for row.Next() {
+		pc := PC{}
+		err := row.Scan(&pc.Id, &pc.Hostname, &pc.Ip, &pc.Cpumodel, &pc.Cpuno, &pc.Monitormodel, &pc.Monitorno, &pc.Printer, &pc.User, &pc.Department, &pc.Notes)
+		if err != nil {
+			return nil, err
+		}
+		pc.Office = office //assigns at each row, because when inside range, global ".Office" is not recognized
+		pcs = append(pcs, pc)
+	}
+
+	return pcs, row.Err()
+}
+
+func scanPrinters(office string, row *sql.Rows) ([]Printer, error) {
+	var printers []Printer
+
+	defer row.Close()
+	for row.Next() {
+		printer := Printer{}
+		err := row.Scan(&printer.Rowid, &printer.Printermodel, &printer.Printerno, &printer.Printertype, &printer.Notes, &printer.Host, &printer.Nickname)
+		if err != nil {
+			return nil, err
+		}
+		printer.Office = office
+		printers = append(printers, printer)
+	}
+
+	return printers, row.Err()
+}
+
+// function to get all PCs of office
+func (p *PCRepository) All(office string) ([]PC, error) {
+	table, err := pcTable(office)
+	if err != nil {
+		return nil, err
+	}
+
+	row, err := p.db.Query(`SELECT * FROM ` + table)
+	if err != nil {
+		return nil, err
+	}
+	return scanPCs(office, row)
+}
+
+// function to get PC by its id (not rowid), sql.ErrNoRows if there is no such PC
+func (p *PCRepository) ById(office string, id int) (PC, error) {
+	pc := PC{Office: office}
+
+	table, err := pcTable(office)
+	if err != nil {
+		return pc, err
+	}
+
+	err = p.db.QueryRow(`SELECT * FROM ` + table + ` WHERE id=?`, id).Scan(&pc.Id, &pc.Hostname, &pc.Ip, &pc.Cpumodel, &pc.Cpuno, &pc.Monitormodel, &pc.Monitorno, &pc.Printer, &pc.User, &pc.Department, &pc.Notes)
+	return pc, err
+}
+
+// function to get hostname of PC id, sql.ErrNoRows if there is no such PC
+func (p *PCRepository) Hostname(office string, id int) (string, error) {
+	table, err := pcTable(office)
+	if err != nil {
+		return "", err
+	}
+
+	hostname := ""
+	err = p.db.QueryRow(`SELECT hostname FROM ` + table + ` WHERE id = ?`, id).Scan(&hostname)
+	return hostname, err
+}
+
+// function to get the printer field of PC id, the rowids of its printers separated by spaces
+func (p *PCRepository) PrinterField(office string, id int) (string, error) {
+	table, err := pcTable(office)
+	if err != nil {
+		return "", err
+	}
+
+	printer := ""
+	err = p.db.QueryRow(`SELECT printer FROM ` + table + ` WHERE id = ?`, id).Scan(&printer)
+	return printer, err
+}
+
+// function to add pc to its office, returns the new id
+func (p *PCRepository) Create(pc PC) (int64, error) {
+	table, err := pcTable(pc.Office)
+	if err != nil {
+		return 0, err
+	}
+
+	query := `INSERT INTO ` + table + ` (hostname, ip, cpu_model, cpu_no, monitor_model, monitor_no, printer, user, department, notes) VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?)`
+	result, err := p.db.Exec(query, pc.Hostname, pc.Ip, pc.Cpumodel, pc.Cpuno, pc.Monitormodel, pc.Monitorno, pc.Printer, pc.User, pc.Department, pc.Notes)
+	if err != nil {
+		return 0, err
+	}
+	return result.LastInsertId()
+}
+
+// function to save every field of pc
+func (p *PCRepository) Update(pc PC) error {
+	table, err := pcTable(pc.Office)
+	if err != nil {
+		return err
+	}
+
+	query := `UPDATE ` + table + ` SET hostname=?, ip=?, cpu_model=?, cpu_no=?, monitor_model=?, monitor_no=?, printer=?, user=?, department=?, notes=? WHERE id = ?`
+	_, err = p.db.Exec(query, pc.Hostname, pc.Ip, pc.Cpumodel, pc.Cpuno, pc.Monitormodel, pc.Monitorno, pc.Printer, pc.User, pc.Department, pc.Notes, pc.Id)
+	return err
+}
+
+// function to delete PC id of office
+func (p *PCRepository) Delete(office string, id int) error {
+	table, err := pcTable(office)
+	if err != nil {
+		return err
+	}
+
+	_, err = p.db.Exec(`DELETE FROM ` + table + ` WHERE id = ?`, id)
+	return err
+}
+
+// function to get all printers of office
+func (p *PrinterRepository) All(office string) ([]Printer, error) {
+	table, err := printerTable(office)
+	if err != nil {
+		return nil, err
+	}
+
+	row, err := p.db.Query(`SELECT rowid, * FROM ` + table)
+	if err != nil {
+		return nil, err
+	}
+	return scanPrinters(office, row)
+}
+
+// function to get all printers of office that have no host
+func (p *PrinterRepository) Unhosted(office string) ([]Printer, error) {
+	table, err := printerTable(office)
+	if err != nil {
+		return nil, err
+	}
+
+	row, err := p.db.Query(`SELECT rowid, * FROM ` + table + ` WHERE host IS null OR host=''`)
+	if err != nil {
+		return nil, err
+	}
+	return scanPrinters(office, row)
+}
+
+// function to get the printers hosted by PC id
+func (p *PrinterRepository) HostedBy(office string, id int) ([]Printer, error) {
+	table, err := printerTable(office)
+	if err != nil {
+		return nil, err
+	}
+
+	row, err := p.db.Query(`SELECT rowid, * FROM ` + table + ` WHERE host=?`, id)
+	if err != nil {
+		return nil, err
+	}
+	return scanPrinters(office, row)
+}
+
+// function to get printer by its rowid, sql.ErrNoRows if there is no such printer
+func (p *PrinterRepository) ByRowid(office string, rowid int) (Printer, error) {
+	printer := Printer{Office: office}
+
+	table, err := printerTable(office)
+	if err != nil {
+		return printer, err
+	}
+
+	err = p.db.QueryRow(`SELECT rowid, * FROM ` + table + ` WHERE rowid=?`, rowid).Scan(&printer.Rowid, &printer.Printermodel, &printer.Printerno, &printer.Printertype, &printer.Notes, &printer.Host, &printer.Nickname)
+	return printer, err
+}
+
+// determines whether printer rowid has a host
+func (p *PrinterRepository) Hosted(office string, rowid int) (bool, error) {
+	table, err := printerTable(office)
+	if err != nil {
+		return false, err
+	}
+
+	var host sql.NullInt64
+	err = p.db.QueryRow(`SELECT host FROM ` + table + ` WHERE rowid=?`, rowid).Scan(&host)
+	if err == sql.ErrNoRows {
+		return false, nil
+	}
+	return host.Valid, err
+}
+
+// function to add printer to its office, returns the new rowid
+func (p *PrinterRepository) Create(printer Printer) (int64, error) {
+	table, err := printerTable(printer.Office)
+	if err != nil {
+		return 0, err
+	}
+
+	query := `INSERT INTO ` + table + ` (printermodel, printerno, printertype, notes, nickname) VALUES (?, ?, ?, ?, ?)`
+	result, err := p.db.Exec(query, printer.Printermodel, printer.Printerno, printer.Printertype, printer.Notes, printer.Nickname)
+	if err != nil {
+		return 0, err
+	}
+	return result.LastInsertId()
+}
+
+// function to save the fields of printer, except its host
+func (p *PrinterRepository) Update(printer Printer) error {
+	table, err := printerTable(printer.Office)
+	if err != nil {
+		return err
+	}
+
+	query := `UPDATE ` + table + ` SET printermodel=?, printerno=?, printertype=?, notes=?, nickname=? WHERE rowid = ?`
+	_, err = p.db.Exec(query, printer.Printermodel, printer.Printerno, printer.Printertype, printer.Notes, printer.Nickname, printer.Rowid)
+	return err
+}
+
+// function to set PC id as host of the printers in rowids, which is formatted as in PC.Printer ("1 2")
+// remember: the host column is FK
+func (p *PrinterRepository) SetHost(office string, rowids string, id int) error {
+	table, err := printerTable(office)
+	if err != nil {
+		return err
+	}
+
+	for _, rowid := range strings.Fields(rowids) {
+		_, err := p.db.Exec(`UPDATE ` + table + ` SET host=? WHERE rowid=?`, id, rowid)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// function to clear the host of the printers in rowids, formatted as in PC.Printer
+func (p *PrinterRepository) ClearHost(office string, rowids string) error {
+	table, err := printerTable(office)
+	if err != nil {
+		return err
+	}
+
+	for _, rowid := range strings.Fields(rowids) {
+		_, err := p.db.Exec(`UPDATE ` + table + ` SET host = NULL WHERE rowid = ?`, rowid)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,79 @@
+package main
+
+import (
+	"testing"
+	"database/sql"
+)
+
+func TestPCRepository(t *testing.T) {
+	s := testOpenStore(t)
+
+	id, err := s.PCs.Create(PC{Office: "sibu", Hostname: "pc-01", Ip: "10.0.0.1"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	pc, err := s.PCs.ById("sibu", int(id))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if pc.Hostname != "pc-01" || pc.Ip != "10.0.0.1" {
+		t.Errorf("ById() = %+v", pc)
+	}
+	if _, err := s.PCs.ById("kapit", int(id)); err != sql.ErrNoRows {
+		t.Errorf("PC of sibu found in kapit, error = %v", err)
+	}
+
+	pc.Hostname = "pc-02"
+	if err := s.PCs.Update(pc); err != nil {
+		t.Fatal(err)
+	}
+	if hostname, err := s.PCs.Hostname("sibu", int(id)); err != nil || hostname != "pc-02" {
+		t.Errorf("Hostname() = %q, %v after Update()", hostname, err)
+	}
+
+	if err := s.PCs.Delete("sibu", int(id)); err != nil {
+		t.Fatal(err)
+	}
+	if pcs, err := s.PCs.All("sibu"); err != nil || len(pcs) != 0 {
+		t.Errorf("All() = %v, %v after Delete()", pcs, err)
+	}
+
+	if _, err := s.PCs.All("miri"); err != ErrUnknownOffice {
+		t.Errorf("All(miri) error = %v, want ErrUnknownOffice", err)
+	}
+}
+
+func TestPrinterRepositoryHost(t *testing.T) {
+	s := testOpenStore(t)
+
+	pc, err := s.PCs.Create(PC{Office: "kapit", Hostname: "pc-01"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	rowid, err := s.Printers.Create(Printer{Office: "kapit", Printermodel: "LaserJet", Nickname: "front desk"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if unhosted, err := s.Printers.Unhosted("kapit"); err != nil || len(unhosted) != 1 {
+		t.Errorf("Unhosted() = %v, %v", unhosted, err)
+	}
+
+	if err := s.Printers.SetHost("kapit", "1", int(pc)); err != nil {
+		t.Fatal(err)
+	}
+	if hosted, err := s.Printers.Hosted("kapit", int(rowid)); err != nil || !hosted {
+		t.Errorf("Hosted() = %v, %v after SetHost()", hosted, err)
+	}
+	if printers, err := s.Printers.HostedBy("kapit", int(pc)); err != nil || len(printers) != 1 || printers[0].Nickname != "front desk" {
+		t.Errorf("HostedBy() = %v, %v", printers, err)
+	}
+
+	if err := s.Printers.ClearHost("kapit", "1"); err != nil {
+		t.Fatal(err)
+	}
+	if hosted, err := s.Printers.Hosted("kapit", int(rowid)); err != nil || hosted {
+		t.Errorf("Hosted() = %v, %v after ClearHost()", hosted, err)
+	}
+}
@@ -0,0 +1,123 @@
+// LDAP / Active Directory authentication backend
+// the user is looked up with the service account (or anonymously), then verified by binding as that user.
+// directory groups are mapped to fragment usergroups through config.LDAP.Groups
+package main
+
+import (
+	"fmt"
+	"errors"
+	"crypto/tls"
+	"github.com/go-ldap/ldap/v3"
+)
+
+type LDAPConfig struct {
+	URL					string		`toml:"url"` // ldap://host:389 or ldaps://host:636, empty disables LDAP
+	StartTLS			bool		`toml:"start_tls"`
+	InsecureSkipVerify	bool		`toml:"insecure_skip_verify"`
+	BindDN				string		`toml:"bind_dn"`
+	BindPassword		string		`toml:"bind_password"`
+	BaseDN				string		`toml:"base_dn"`
+	UserFilter			string		`toml:"user_filter"` // %s is replaced by the escaped username
+	UsernameAttribute	string		`toml:"username_attribute"`
+	EmailAttribute		string		`toml:"email_attribute"`
+	GroupAttribute		string		`toml:"group_attribute"`
+	Groups				[]GroupMapping	`toml:"groups"`
+	DefaultUsergroup	string		`toml:"default_usergroup"` // used when no group matches, empty denies login
+}
+
+type LDAPAuthenticator struct {
+	LDAPConfig
+}
+
+func (LDAPAuthenticator) Name() string {
+	return authSourceLDAP
+}
+
+func (a LDAPAuthenticator) Authenticate(username string, password string) (AuthIdentity, error) {
+	conn, err := a.dial()
+	if err != nil {
+		return AuthIdentity{}, err
+	}
+	defer conn.Close()
+
+	// look up the user entry
+	if a.BindDN != "" {
+		err = conn.Bind(a.BindDN, a.BindPassword)
+	} else {
+		err = conn.UnauthenticatedBind("")
+	}
+	if err != nil {
+		return AuthIdentity{}, fmt.Errorf("service bind: %w", err)
+	}
+
+	request := ldap.NewSearchRequest(
+		a.BaseDN,
+		ldap.ScopeWholeSubtree, ldap.NeverDerefAliases, 2, 10, false,
+		fmt.Sprintf(a.UserFilter, ldap.EscapeFilter(username)),
+		[]string{"dn", a.UsernameAttribute, a.EmailAttribute, a.GroupAttribute},
+		nil,
+	)
+	result, err := conn.Search(request)
+	if err != nil {
+		return AuthIdentity{}, fmt.Errorf("search: %w", err)
+	}
+	if len(result.Entries) != 1 {
+		return AuthIdentity{}, ErrInvalidCredentials
+	}
+	entry := result.Entries[0]
+
+	// verify password by binding as the user
+	err = conn.Bind(entry.DN, password)
+	if ldap.IsErrorWithCode(err, ldap.LDAPResultInvalidCredentials) {
+		return AuthIdentity{}, ErrInvalidCredentials
+	} else if err != nil {
+		return AuthIdentity{}, fmt.Errorf("user bind: %w", err)
+	}
+
+	usergroup, err := a.usergroup(entry.GetAttributeValues(a.GroupAttribute))
+	if err != nil {
+		return AuthIdentity{}, err
+	}
+	if usergroup == "" {
+		return AuthIdentity{}, errors.New("user " + username + " is not a member of any mapped group")
+	}
+
+	identity := AuthIdentity{
+		Username: entry.GetAttributeValue(a.UsernameAttribute),
+		Email: entry.GetAttributeValue(a.EmailAttribute),
+		Usergroup: usergroup,
+		Source: authSourceLDAP,
+	}
+	if identity.Username == "" {
+		identity.Username = username
+	}
+
+	if _, err := ProvisionUser(identity); err != nil {
+		return AuthIdentity{}, err
+	}
+
+	return identity, nil
+}
+
+func (a LDAPAuthenticator) dial() (*ldap.Conn, error) {
+	tlsConfig := &tls.Config{InsecureSkipVerify: a.InsecureSkipVerify}
+
+	conn, err := ldap.DialURL(a.URL, ldap.DialWithTLSConfig(tlsConfig))
+	if err != nil {
+		return nil, err
+	}
+
+	if a.StartTLS {
+		if err := conn.StartTLS(tlsConfig); err != nil {
+			conn.Close()
+			return nil, err
+		}
+	}
+
+	return conn, nil
+}
+
+// function to map directory groups to usergroup
+func (a LDAPAuthenticator) usergroup(groups []string) (string, error) {
+	return MapUsergroup(groups, a.Groups, a.DefaultUsergroup)
+}
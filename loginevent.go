@@ -0,0 +1,99 @@
+// login history (table login_events), one row for every login attempt whether or not it succeeded
+// users see their own recent logins on "/user/account", admins see the last login of everyone on "/admin/usermanagement"
+package main
+
+import (
+	"time"
+	"net/http"
+	"database/sql"
+)
+
+// values of login_events.method
+const (
+	loginMethodPassword = "password" // login form, checked by the local database or LDAP
+	loginMethodTwoFactor = "2fa" // second step after the password, see twofactor.go
+	loginMethodOIDC = "oidc" // single sign-on, see oidc.go
+)
+
+// logins shown on "/user/account"
+const loginHistoryLimit = 10
+
+// older events are removed as new ones are written
+const loginEventRetention = 365 * 24 * time.Hour
+
+type LoginEvent struct {
+	Created		time.Time
+	Ip			string
+	UserAgent	string
+	Success		bool
+	Method		string
+}
+
+// function to return recent logins of the account, see template/user/account.html
+func (p PageAccountStruct) RecentLogins() ([]LoginEvent, error) {
+	return GetLoginEvents(p.Id, loginHistoryLimit)
+}
+
+// Functions that handles process and procedures and does not involve returning HTML page
+//
+//
+
+// function to record a login attempt, id is empty when the username does not exist
+func RecordLoginEvent(r *http.Request, id string, username string, method string, success bool) error {
+	db := coreDB()
+
+	userAgent := r.UserAgent()
+	if len(userAgent) > 255 {
+		userAgent = userAgent[:255]
+	}
+
+	var userId interface{}
+	if id != "" {
+		userId = id
+	}
+
+	query := `INSERT INTO login_events (created, user_id, username, ip, user_agent, success, method) VALUES (?, ?, ?, ?, ?, ?, ?)`
+	_, err := db.Exec(query, time.Now().Unix(), userId, username, ClientIP(r), userAgent, success, method)
+	if err != nil {
+		return err
+	}
+
+	_, err = db.Exec(`DELETE FROM login_events WHERE created < ?`, time.Now().Add(-loginEventRetention).Unix())
+	return err
+}
+
+// function to record a failed attempt for username, which may not exist
+func RecordLoginFailure(r *http.Request, username string, method string) error {
+	id, err := GetUserId(username)
+	if err != nil && err != sql.ErrNoRows {
+		return err
+	}
+	return RecordLoginEvent(r, id, username, method, false)
+}
+
+// function to list the latest login attempts of user id, newest first
+func GetLoginEvents(id string, limit int) ([]LoginEvent, error) {
+	db := coreDB()
+
+	var events []LoginEvent
+
+	query := `SELECT created, ip, user_agent, success, method FROM login_events WHERE user_id = ? ORDER BY id DESC LIMIT ?`
+	row, err := db.Query(query, id, limit)
+	if err != nil {
+		return nil, err
+	}
+
+	defer row.Close()
+	for row.Next() {
+		e := LoginEvent{}
+		var created int64
+		err := row.Scan(&created, &e.Ip, &e.UserAgent, &e.Success, &e.Method)
+		if err != nil {
+			return nil, err
+		}
+		e.Created = time.Unix(created, 0)
+		events = append(events, e)
+	}
+
+	return events, row.Err()
+}
@@ -0,0 +1,50 @@
+// outgoing email through the SMTP server in config.SMTP
+package main
+
+import (
+	"fmt"
+	"time"
+	"errors"
+	"strings"
+	"net/smtp"
+)
+
+type SMTPConfig struct {
+	Host		string	`toml:"host"` // empty disables email
+	Port		int		`toml:"port"`
+	Username	string	`toml:"username"` // empty skips authentication, e.g. for a local SMTP sink
+	Password	string	`toml:"password"`
+	From		string	`toml:"from"`
+}
+
+// determines whether email can be sent at all
+func MailEnabled() bool {
+	return config.SMTP.Host != ""
+}
+
+// function to send a plain text email
+func SendMail(to string, subject string, body string) error {
+	if !MailEnabled() {
+		return errors.New("smtp is not configured")
+	}
+	if strings.ContainsAny(to + subject, "\r\n") {
+		return errors.New("invalid email header")
+	}
+
+	var auth smtp.Auth
+	if config.SMTP.Username != "" {
+		auth = smtp.PlainAuth("", config.SMTP.Username, config.SMTP.Password, config.SMTP.Host)
+	}
+
+	msg := "From: " + config.SMTP.From + "\r\n" +
+		"To: " + to + "\r\n" +
+		"Subject: " + subject + "\r\n" +
+		"Date: " + time.Now().Format(time.RFC1123Z) + "\r\n" +
+		"MIME-Version: 1.0\r\n" +
+		"Content-Type: text/plain; charset=UTF-8\r\n" +
+		"\r\n" +
+		strings.ReplaceAll(body, "\n", "\r\n")
+
+	addr := fmt.Sprintf("%s:%d", config.SMTP.Host, config.SMTP.Port)
+	return smtp.SendMail(addr, auth, config.SMTP.From, []string{to}, []byte(msg))
+}
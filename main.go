@@ -1,58 +1,138 @@
 package main
 
 import (
+	"os"
 	"fmt"
+	"log"
 	"net/http"
-	"html/template"
 	"github.com/gorilla/mux"
 )
 
 type PageIndexStruct struct {
 	Message string
 	Version string
+	OIDCEnabled bool
+	Next string // page to return to after login, see auth.go
 }
 
 
 func main() {
+	// "fragment migrate [flags]" only brings the databases up to date, see database.go
+	args := os.Args[1:]
+	command := ""
+	if len(args) > 0 && args[0] == "migrate" {
+		command = args[0]
+		args = args[1:]
+	}
+
+	// configuration
+	cfg, err := LoadConfig(args)
+	if err != nil {
+		log.Fatal("error loading configuration: ", err)
+	}
+	config = cfg
+
+	// database handles shared by every request, see store.go
+	s, err := OpenStore(config.CoreDB, config.ITDBDB)
+	if err != nil {
+		log.Fatal("error opening database: ", err)
+	}
+	defer s.Close()
+	defaultStore = s
+
+	// before anything queries the databases, a new installation has no tables yet
+	if err := MigrateDatabases(s); err != nil { // database.go
+		log.Fatal("error migrating database: ", err)
+	}
+	if command == "migrate" {
+		fmt.Println("Databases are up to date")
+		return
+	}
+
+	SessionInit()
+	InitAuthenticators() // authenticator.go
+	LoadBannedPasswords() // password.go
+	if err := LoadTemplates(); err != nil { // template.go
+		log.Fatal("error parsing templates: ", err)
+	}
+
 	// mux
 	r := mux.NewRouter()
+	r.NotFoundHandler = http.HandlerFunc(PageNotFound) // errorpage.go
+	r.Use(APITokenMiddleware) // apitoken.go
+	r.Use(CSRFMiddleware) // csrf.go
+	r.Use(PasswordChangeMiddleware) // password.go
+	r.Use(ImpersonationMiddleware) // impersonate.go
 
-	// for assets files
-	fs := http.FileServer(http.Dir("./asset/"))
+	// for assets files, built in unless in dev mode, see template.go
+	fs := http.FileServer(http.FS(assetFS()))
 	r.PathPrefix("/asset/").Handler(http.StripPrefix("/asset/", fs))
 
 	// routes handled within main.go
 	r.HandleFunc("/", PageIndex("")) // index page
 
+	// areas for logged in users only, each with the permission it needs, see auth.go
+	// paths not matched there fall through to r, which is how the public "/user/login" and alike are reached
+	user := r.PathPrefix("/user").Subrouter()
+	user.Use(RequireLogin)
+	admin := r.PathPrefix("/admin").Subrouter()
+	admin.Use(RequireLogin)
+	admin.Use(RequirePermission("access_admin"))
+	itdb := r.PathPrefix("/itdb").Subrouter()
+	itdb.Use(RequireLogin)
+	itdb.Use(RequirePermission("access_itdb"))
+
 	// routes handled in separate go files
-	UserHandler(r) // user.go
+	UserHandler(r, user, s) // user.go
 	AboutHandler(r) // about.go
-	AdminHandler(r) // admin.go
-	ITDBHandler(r) // itdb.go
+	AdminHandler(admin, s) // admin.go
+	ITDBHandler(itdb, s) // itdb.go
+	TwoFactorHandler(r, user) // twofactor.go
+	OIDCHandler(r) // oidc.go
+	UserSessionHandler(user, admin) // usersession.go
+	PasswordResetHandler(r) // reset.go
+	APITokenHandler(user) // apitoken.go
+	AuditHandler(admin) // audit.go
+	UsergroupHandler(admin) // usergroup.go
+	ProfileHandler(r, user, s) // profile.go
+	ImpersonationHandler(user, admin) // impersonate.go
 
 	// start the server
 	fmt.Println("Starting server...")
-	fmt.Println("Go to http://localhost:8000/")
-	http.ListenAndServe(":8000", r)
+	fmt.Println("Listening on " + config.Listen)
+	log.Fatal(http.ListenAndServe(config.Listen, RecoveryMiddleware(r))) // errorpage.go
 }
 
 // function to return index page
 func PageIndex(message string) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
-		tmpl := template.Must(template.ParseFiles("template/index.html"))
+		tmpl := ParseTemplate(w, r, "index.html")
 		data := PageIndexStruct{
 			message,
 			"version 1.0.0 (07/11/2024)",
+			OIDCEnabled(),
+			loginNextField(r),
 		}
 		tmpl.Execute(w, data)
 	}
 }
 
 func PageIndexRedirect(w http.ResponseWriter, r *http.Request) {
-	tmpl := template.Must(template.ParseFiles("template/index.html"))
+	tmpl := ParseTemplate(w, r, "index.html")
 	data := PageIndexStruct{
 		"wrong username or password",
 		"version 1.0.0 (07/11/2024)",
+		OIDCEnabled(),
+		loginNextField(r),
 	}
 	tmpl.Execute(w, data)
+}
+
+// function to carry the page to return to through the login form
+func loginNextField(r *http.Request) string {
+	next := r.FormValue("next")
+	if !localPath(next) {
+		return ""
+	}
+	return next
 }
\ No newline at end of file
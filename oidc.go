@@ -0,0 +1,277 @@
+// OpenID Connect single sign-on (authorization code flow with PKCE)
+// "/user/login/oidc" redirects to the identity provider, which sends the user back to "/user/login/oidc/callback"
+package main
+
+import (
+	"log"
+	"sync"
+	"errors"
+	"context"
+	"net/http"
+	"crypto/rand"
+	"encoding/base64"
+	"github.com/gorilla/mux"
+	"github.com/coreos/go-oidc/v3/oidc"
+	"golang.org/x/oauth2"
+)
+
+type OIDCConfig struct {
+	Issuer				string		`toml:"issuer"` // empty disables single sign-on
+	ClientID			string		`toml:"client_id"`
+	ClientSecret		string		`toml:"client_secret"`
+	RedirectURL			string		`toml:"redirect_url"` // e.g. https://fragment.example.com/user/login/oidc/callback
+	Scopes				[]string	`toml:"scopes"`
+	UsernameClaim		string		`toml:"username_claim"`
+	EmailClaim			string		`toml:"email_claim"`
+	GroupsClaim			string		`toml:"groups_claim"`
+	Groups				[]GroupMapping	`toml:"groups"`
+	DefaultUsergroup	string		`toml:"default_usergroup"` // used when no group matches, empty denies login
+}
+
+// provider discovery is done on first use, so the server still starts when the identity provider is down
+var (
+	oidcMutex		sync.Mutex
+	oidcProvider	*oidc.Provider
+)
+
+func OIDCHandler(r *mux.Router) {
+	r.HandleFunc("/user/login/oidc", OIDCLogin)
+	r.HandleFunc("/user/login/oidc/callback", OIDCCallback)
+}
+
+// determines whether single sign-on is configured
+func OIDCEnabled() bool {
+	return config.OIDC.Issuer != ""
+}
+
+// "/user/login/oidc"
+func OIDCLogin(w http.ResponseWriter, r *http.Request) {
+	if !OIDCEnabled() {
+		http.NotFound(w, r)
+		return
+	}
+
+	oauth2Config, _, err := oidcClient(r.Context())
+	if err != nil {
+		log.Println("OIDCLogin() ", err)
+		PageIndex("single sign-on is currently unavailable")(w,r)
+		return
+	}
+
+	state := randomToken()
+	nonce := randomToken()
+	verifier := oauth2.GenerateVerifier()
+
+	SetLoginNext(w, r, r.FormValue("next"))
+
+	session, _ := store.Get(r, "cookie-name")
+	session.Values["oidc_state"] = state
+	session.Values["oidc_nonce"] = nonce
+	session.Values["oidc_verifier"] = verifier
+	session.Save(r, w)
+
+	url := oauth2Config.AuthCodeURL(state, oidc.Nonce(nonce), oauth2.S256ChallengeOption(verifier))
+	http.Redirect(w, r, url, 302)
+}
+
+// "/user/login/oidc/callback"
+func OIDCCallback(w http.ResponseWriter, r *http.Request) {
+	if !OIDCEnabled() {
+		http.NotFound(w, r)
+		return
+	}
+
+	session, _ := store.Get(r, "cookie-name")
+	state, _ := session.Values["oidc_state"].(string)
+	nonce, _ := session.Values["oidc_nonce"].(string)
+	verifier, _ := session.Values["oidc_verifier"].(string)
+	delete(session.Values, "oidc_state")
+	delete(session.Values, "oidc_nonce")
+	delete(session.Values, "oidc_verifier")
+
+	if state == "" || r.URL.Query().Get("state") != state {
+		log.Println("OIDCCallback() state mismatch from", ClientIP(r))
+		PageIndex("single sign-on failed, please try again")(w,r)
+		return
+	}
+
+	if errParam := r.URL.Query().Get("error"); errParam != "" {
+		log.Println("OIDCCallback() provider returned", errParam, r.URL.Query().Get("error_description"))
+		PageIndex("single sign-on failed, please try again")(w,r)
+		return
+	}
+
+	identity, err := oidcExchange(r.Context(), r.URL.Query().Get("code"), nonce, verifier)
+	if err != nil {
+		log.Println("OIDCCallback() ", err)
+		PageIndex("single sign-on failed, please try again")(w,r)
+		return
+	}
+
+	username, err := ProvisionUser(identity)
+	if err != nil {
+		log.Println("OIDCCallback() ", err)
+		PageIndex("single sign-on failed, please try again")(w,r)
+		return
+	}
+
+	id, err := GetUserId(username)
+	if err != nil {
+		HTTPError(w, r, err)
+		return
+	}
+	disabled, err := UserDisabled(id)
+	if err != nil {
+		HTTPError(w, r, err)
+		return
+	}
+	if disabled {
+		log.Println("single sign-on refused for disabled account", username)
+		if err := RecordLoginEvent(r, id, username, loginMethodOIDC, false); err != nil {
+			HTTPError(w, r, err)
+			return
+		}
+		PageIndex("your account is disabled, please contact your administrator")(w,r)
+		return
+	}
+
+	usergroup, err := GetUsergroup(id)
+	if err != nil {
+		HTTPError(w, r, err)
+		return
+	}
+
+	// the identity provider is not trusted to have checked a second factor, see twofactor.go
+	required, err := TwoFactorRequired(id, usergroup)
+	if err != nil {
+		HTTPError(w, r, err)
+		return
+	}
+	if required {
+		loginPending(w,r,id,username)
+		http.Redirect(w, r, "/user/login/2fa", 302)
+		return
+	}
+
+	if err := RecordLoginEvent(r, id, username, loginMethodOIDC, true); err != nil {
+		HTTPError(w, r, err)
+		return
+	}
+	if err := login(w, r, id, username); err != nil {
+		HTTPError(w, r, err)
+		return
+	}
+
+	PageRedirect(w,r)
+}
+
+// function to exchange authorization code and turn the verified ID token into an identity
+func oidcExchange(ctx context.Context, code string, nonce string, verifier string) (AuthIdentity, error) {
+	oauth2Config, provider, err := oidcClient(ctx)
+	if err != nil {
+		return AuthIdentity{}, err
+	}
+
+	token, err := oauth2Config.Exchange(ctx, code, oauth2.VerifierOption(verifier))
+	if err != nil {
+		return AuthIdentity{}, err
+	}
+
+	rawIDToken, ok := token.Extra("id_token").(string)
+	if !ok {
+		return AuthIdentity{}, errors.New("token response has no id_token")
+	}
+
+	idToken, err := provider.Verifier(&oidc.Config{ClientID: config.OIDC.ClientID}).Verify(ctx, rawIDToken)
+	if err != nil {
+		return AuthIdentity{}, err
+	}
+	if idToken.Nonce != nonce {
+		return AuthIdentity{}, errors.New("id_token nonce mismatch")
+	}
+
+	claims := map[string]interface{}{}
+	if err := idToken.Claims(&claims); err != nil {
+		return AuthIdentity{}, err
+	}
+
+	usergroup, err := MapUsergroup(claimStrings(claims, config.OIDC.GroupsClaim), config.OIDC.Groups, config.OIDC.DefaultUsergroup)
+	if err != nil {
+		return AuthIdentity{}, err
+	}
+
+	identity := AuthIdentity{
+		Username: claimString(claims, config.OIDC.UsernameClaim),
+		Email: claimString(claims, config.OIDC.EmailClaim),
+		Usergroup: usergroup,
+		Source: authSourceOIDC,
+		Issuer: idToken.Issuer,
+		Subject: idToken.Subject,
+	}
+
+	if identity.Subject == "" {
+		return AuthIdentity{}, errors.New("id_token has no sub claim")
+	}
+	if identity.Username == "" {
+		return AuthIdentity{}, errors.New("id_token has no " + config.OIDC.UsernameClaim + " claim")
+	}
+	if identity.Usergroup == "" {
+		return AuthIdentity{}, errors.New("user " + identity.Username + " is not a member of any mapped group")
+	}
+
+	return identity, nil
+}
+
+// function to return oauth2 client configuration, discovering the provider if not done yet
+func oidcClient(ctx context.Context) (*oauth2.Config, *oidc.Provider, error) {
+	oidcMutex.Lock()
+	defer oidcMutex.Unlock()
+
+	if oidcProvider == nil {
+		provider, err := oidc.NewProvider(context.WithoutCancel(ctx), config.OIDC.Issuer)
+		if err != nil {
+			return nil, nil, err
+		}
+		oidcProvider = provider
+	}
+
+	scopes := append([]string{oidc.ScopeOpenID}, config.OIDC.Scopes...)
+
+	return &oauth2.Config{
+		ClientID: config.OIDC.ClientID,
+		ClientSecret: config.OIDC.ClientSecret,
+		RedirectURL: config.OIDC.RedirectURL,
+		Endpoint: oidcProvider.Endpoint(),
+		Scopes: scopes,
+	}, oidcProvider, nil
+}
+
+func claimString(claims map[string]interface{}, name string) string {
+	value, _ := claims[name].(string)
+	return value
+}
+
+// groups claim is usually an array, but some providers send a single string
+func claimStrings(claims map[string]interface{}, name string) []string {
+	switch value := claims[name].(type) {
+	case string:
+		return []string{value}
+	case []interface{}:
+		var values []string
+		for _, v := range value {
+			if s, ok := v.(string); ok {
+				values = append(values, s)
+			}
+		}
+		return values
+	}
+	return nil
+}
+
+func randomToken() string {
+	b := make([]byte, 24)
+	if _, err := rand.Read(b); err != nil {
+		log.Panic(err)
+	}
+	return base64.RawURLEncoding.EncodeToString(b)
+}
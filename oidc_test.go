@@ -0,0 +1,217 @@
+package main
+
+import (
+	"time"
+	"context"
+	"testing"
+	"math/big"
+	"net/http"
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/json"
+	"encoding/base64"
+	"net/http/httptest"
+)
+
+// identity provider answering discovery, keys and the token endpoint, enough for oidcExchange
+// the ID token it hands out for "good-code" carries claims, signed with signer and announced as key
+type testIssuer struct {
+	*httptest.Server
+	key			*rsa.PrivateKey
+	signer		*rsa.PrivateKey
+	verifier	string
+	claims		map[string]interface{}
+}
+
+func newTestIssuer(t *testing.T) *testIssuer {
+	t.Helper()
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	issuer := &testIssuer{key: key, signer: key}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/.well-known/openid-configuration", func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"issuer": issuer.URL,
+			"authorization_endpoint": issuer.URL + "/authorize",
+			"token_endpoint": issuer.URL + "/token",
+			"jwks_uri": issuer.URL + "/keys",
+			"id_token_signing_alg_values_supported": []string{"RS256"},
+		})
+	})
+	mux.HandleFunc("/keys", func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(map[string]interface{}{"keys": []map[string]string{{
+			"kty": "RSA",
+			"alg": "RS256",
+			"use": "sig",
+			"kid": "test",
+			"n": base64.RawURLEncoding.EncodeToString(key.N.Bytes()),
+			"e": base64.RawURLEncoding.EncodeToString(big.NewInt(int64(key.E)).Bytes()),
+		}}})
+	})
+	mux.HandleFunc("/token", func(w http.ResponseWriter, r *http.Request) {
+		if r.FormValue("code") != "good-code" || r.FormValue("code_verifier") != issuer.verifier {
+			w.Header().Set("Content-Type", "application/json")
+			w.WriteHeader(http.StatusBadRequest)
+			w.Write([]byte(`{"error":"invalid_grant"}`))
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"access_token": "access",
+			"token_type": "Bearer",
+			"expires_in": 300,
+			"id_token": issuer.idToken(t),
+		})
+	})
+
+	issuer.Server = httptest.NewServer(mux)
+	t.Cleanup(issuer.Close)
+	return issuer
+}
+
+// function to return the claims as RS256 JWT
+func (issuer *testIssuer) idToken(t *testing.T) string {
+	header, _ := json.Marshal(map[string]string{"alg": "RS256", "kid": "test", "typ": "JWT"})
+	payload, err := json.Marshal(issuer.claims)
+	if err != nil {
+		t.Error(err)
+	}
+	signed := base64.RawURLEncoding.EncodeToString(header) + "." + base64.RawURLEncoding.EncodeToString(payload)
+
+	sum := sha256.Sum256([]byte(signed))
+	signature, err := rsa.SignPKCS1v15(rand.Reader, issuer.signer, crypto.SHA256, sum[:])
+	if err != nil {
+		t.Error(err)
+	}
+	return signed + "." + base64.RawURLEncoding.EncodeToString(signature)
+}
+
+// function to point config.OIDC at a new test issuer for the duration of the test
+func testOIDC(t *testing.T) *testIssuer {
+	t.Helper()
+	testStore(t)
+	issuer := newTestIssuer(t)
+
+	previous := config.OIDC
+	config.OIDC.Issuer = issuer.URL
+	config.OIDC.ClientID = "fragment"
+	config.OIDC.ClientSecret = "secret"
+	config.OIDC.Groups = []GroupMapping{{"fragment-admins", "admin"}}
+	config.OIDC.DefaultUsergroup = ""
+	oidcProvider = nil
+	t.Cleanup(func() {
+		config.OIDC = previous
+		oidcProvider = nil
+	})
+
+	issuer.verifier = "verifier-0123456789-0123456789-0123456789"
+	issuer.claims = map[string]interface{}{
+		"iss": issuer.URL,
+		"sub": "1001",
+		"aud": "fragment",
+		"iat": time.Now().Unix(),
+		"exp": time.Now().Add(time.Minute).Unix(),
+		"nonce": "nonce",
+		"preferred_username": "alice",
+		"email": "alice@example.com",
+		"groups": []string{"fragment-admins"},
+	}
+	return issuer
+}
+
+func TestOIDCExchange(t *testing.T) {
+	issuer := testOIDC(t)
+
+	identity, err := oidcExchange(context.Background(), "good-code", "nonce", issuer.verifier)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := AuthIdentity{"alice", "alice@example.com", "admin", authSourceOIDC, issuer.URL, "1001"}
+	if identity != want {
+		t.Errorf("oidcExchange() = %+v, want %+v", identity, want)
+	}
+}
+
+func TestOIDCExchangeRefused(t *testing.T) {
+	tests := []struct {
+		name		string
+		change		func(issuer *testIssuer)
+		code		string
+		nonce		string
+		verifier	string
+	}{
+		{"wrong code", nil, "bad-code", "nonce", ""},
+		{"wrong verifier", nil, "good-code", "nonce", "other-verifier"},
+		{"wrong nonce", nil, "good-code", "other", ""},
+		{"expired", func(issuer *testIssuer) { issuer.claims["exp"] = time.Now().Add(-time.Minute).Unix() }, "good-code", "nonce", ""},
+		{"other audience", func(issuer *testIssuer) { issuer.claims["aud"] = "someone-else" }, "good-code", "nonce", ""},
+		{"other issuer", func(issuer *testIssuer) { issuer.claims["iss"] = "https://evil.example" }, "good-code", "nonce", ""},
+		{"no subject", func(issuer *testIssuer) { delete(issuer.claims, "sub") }, "good-code", "nonce", ""},
+		{"no username", func(issuer *testIssuer) { delete(issuer.claims, "preferred_username") }, "good-code", "nonce", ""},
+		{"no mapped group", func(issuer *testIssuer) { issuer.claims["groups"] = []string{"others"} }, "good-code", "nonce", ""},
+		{"unknown key", func(issuer *testIssuer) {
+			other, err := rsa.GenerateKey(rand.Reader, 2048)
+			if err != nil {
+				panic(err)
+			}
+			issuer.signer = other
+		}, "good-code", "nonce", ""},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			issuer := testOIDC(t)
+			if test.change != nil {
+				test.change(issuer)
+			}
+			verifier := test.verifier
+			if verifier == "" {
+				verifier = issuer.verifier
+			}
+
+			if identity, err := oidcExchange(context.Background(), test.code, test.nonce, verifier); err == nil {
+				t.Errorf("oidcExchange() accepted, identity %+v", identity)
+			}
+		})
+	}
+}
+
+func testOIDCIdentity(username string, subject string) AuthIdentity {
+	return AuthIdentity{
+		Username: username,
+		Email: username + "@example.com",
+		Usergroup: "normal",
+		Source: authSourceOIDC,
+		Issuer: "https://idp.example.com",
+		Subject: subject,
+	}
+}
+
+// a username claim naming an existing account must not log in to it
+func TestProvisionUserSubject(t *testing.T) {
+	s := testStore(t)
+	testUser(t, s, "alice", "admin")
+
+	if _, err := ProvisionUser(testOIDCIdentity("alice", "attacker")); err == nil {
+		t.Errorf("local account taken over by username claim")
+	}
+
+	username, err := ProvisionUser(testOIDCIdentity("bob", "1001"))
+	if err != nil || username != "bob" {
+		t.Fatalf("first login = %q, %v", username, err)
+	}
+	if _, err := ProvisionUser(testOIDCIdentity("bob", "1002")); err == nil {
+		t.Errorf("single sign-on account taken over by another subject")
+	}
+
+	// the claim changed, the account stays the same
+	username, err = ProvisionUser(testOIDCIdentity("robert", "1001"))
+	if err != nil || username != "bob" {
+		t.Errorf("renamed claim = %q, %v, want bob", username, err)
+	}
+}
@@ -0,0 +1,277 @@
+// password hashing, verification, upgrade of legacy plaintext rows & password policy
+package main
+
+import (
+	"os"
+	"fmt"
+	"log"
+	"time"
+	"errors"
+	"strings"
+	"unicode"
+	"net/http"
+	"crypto/subtle"
+	"database/sql"
+	"golang.org/x/crypto/bcrypt"
+)
+
+// bcrypt refuses passwords longer than this, see PasswordPolicyCheck
+const passwordMaxBytes = 72
+
+// function to hash a password before it is written into the user table
+func HashPassword(password string) (string, error) {
+	hash, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
+	if err != nil {
+		return "", err
+	}
+	return string(hash), nil
+}
+
+// determines whether the stored value is a bcrypt hash
+// rows created before hashing was introduced still hold the plaintext password
+func PasswordIsHashed(stored string) bool {
+	return strings.HasPrefix(stored, "$2a$") || strings.HasPrefix(stored, "$2b$") || strings.HasPrefix(stored, "$2y$")
+}
+
+// compares given password against the stored value, hashed or legacy plaintext
+func PasswordMatch(stored string, password string) bool {
+	// externally authenticated users have no local password
+	if stored == "" {
+		return false
+	}
+
+	if PasswordIsHashed(stored) {
+		return bcrypt.CompareHashAndPassword([]byte(stored), []byte(password)) == nil
+	}
+
+	// legacy plaintext row
+	return subtle.ConstantTimeCompare([]byte(stored), []byte(password)) == 1
+}
+
+// function to rehash a legacy plaintext password after a successful login
+// does nothing when the stored value is already hashed
+func PasswordUpgrade(username string, password string) error {
+	db := coreDB()
+
+	stored := ""
+	err := db.QueryRow(`SELECT password FROM user WHERE username = ?`, username).Scan(&stored)
+	if err != nil {
+		return err
+	}
+
+	if PasswordIsHashed(stored) {
+		return nil
+	}
+
+	hash, err := HashPassword(password)
+	if err != nil {
+		return err
+	}
+
+	_, err = db.Exec(`UPDATE user SET password = ? WHERE username = ?`, hash, username)
+	return err
+}
+
+// commonly used passwords which are always refused, extended by config.PasswordBannedFile
+var bannedPasswords = []string{
+	"password", "password1", "password123", "passw0rd", "p@ssw0rd", "p@ssword",
+	"123456", "1234567", "12345678", "123456789", "1234567890", "12345",
+	"qwerty", "qwerty123", "qwertyuiop", "abc123", "111111", "000000",
+	"iloveyou", "admin", "admin123", "administrator", "welcome", "welcome1",
+	"letmein", "monkey", "dragon", "sunshine", "princess", "football",
+	"changeme", "secret", "fragment",
+}
+
+// function to load extra banned passwords, one per line, called from main() after config is loaded
+func LoadBannedPasswords() {
+	if config.PasswordBannedFile == "" {
+		return
+	}
+
+	content, err := os.ReadFile(config.PasswordBannedFile)
+	if err != nil {
+		log.Fatal("error loading banned passwords: ", err)
+	}
+
+	for _, line := range strings.Split(string(content), "\n") {
+		line = strings.TrimSpace(line)
+		if line != "" && !strings.HasPrefix(line, "#") {
+			bannedPasswords = append(bannedPasswords, strings.ToLower(line))
+		}
+	}
+}
+
+// returns human readable description of the password policy
+func PasswordPolicyDescription() string {
+	return fmt.Sprintf("at least %d characters (at most %d bytes), using at least %d of: lowercase, uppercase, digits, symbols. common passwords and your last %d passwords are not accepted.",
+		config.PasswordMinLength, passwordMaxBytes, config.PasswordMinClasses, config.PasswordHistory)
+}
+
+// function to check a new password against the policy, returns nil if acceptable
+func PasswordPolicyCheck(username string, password string) error {
+	if len([]rune(password)) < config.PasswordMinLength {
+		return fmt.Errorf("password must be at least %d characters long", config.PasswordMinLength)
+	}
+	// counted in bytes, a character outside ASCII takes up to 4
+	if len(password) > passwordMaxBytes {
+		return fmt.Errorf("password must not be longer than %d bytes", passwordMaxBytes)
+	}
+
+	var lower, upper, digit, symbol int
+	for _, c := range password {
+		switch {
+		case unicode.IsLower(c):
+			lower = 1
+		case unicode.IsUpper(c):
+			upper = 1
+		case unicode.IsDigit(c):
+			digit = 1
+		default:
+			symbol = 1
+		}
+	}
+	if lower + upper + digit + symbol < config.PasswordMinClasses {
+		return fmt.Errorf("password must use at least %d of: lowercase, uppercase, digits, symbols", config.PasswordMinClasses)
+	}
+
+	lowered := strings.ToLower(password)
+	if username != "" && strings.Contains(lowered, strings.ToLower(username)) {
+		return errors.New("password must not contain the username")
+	}
+	for _, banned := range bannedPasswords {
+		if lowered == banned {
+			return errors.New("password is too common")
+		}
+	}
+
+	return nil
+}
+
+// determines whether password equals the current one or one of the last config.PasswordHistory passwords of user
+func PasswordReused(id string, password string) (bool, error) {
+	db := coreDB()
+
+	current := ""
+	err := db.QueryRow(`SELECT password FROM user WHERE id = ?`, id).Scan(&current)
+	if err != nil && err != sql.ErrNoRows {
+		return false, err
+	}
+	if PasswordMatch(current, password) {
+		return true, nil
+	}
+
+	query := `SELECT password_hash FROM password_history WHERE user_id = ? ORDER BY created DESC, rowid DESC LIMIT ?`
+	row, err := db.Query(query, id, config.PasswordHistory)
+	if err != nil {
+		return false, err
+	}
+	defer row.Close()
+	for row.Next() {
+		hash := ""
+		if err := row.Scan(&hash); err != nil {
+			return false, err
+		}
+		if PasswordMatch(hash, password) {
+			return true, nil
+		}
+	}
+
+	return false, row.Err()
+}
+
+// function to store a new password for user, keeping the previous hashes for reuse checks
+// mustChange forces the user to choose another password after next login
+func SetPassword(id string, password string, mustChange bool) error {
+	hash, err := HashPassword(password)
+	if err != nil {
+		return err
+	}
+
+	db := coreDB()
+
+	now := time.Now().Unix()
+
+	query := `UPDATE user SET password = ?, password_changed_at = ?, must_change_password = ? WHERE id = ?`
+	_, err = db.Exec(query, hash, now, mustChange, id)
+	if err != nil {
+		return err
+	}
+
+	_, err = db.Exec(`INSERT INTO password_history (user_id, password_hash, created) VALUES (?, ?, ?)`, id, hash, now)
+	if err != nil {
+		return err
+	}
+
+	// keep only as many as needed
+	query = `DELETE FROM password_history WHERE user_id = ? AND rowid NOT IN
+		(SELECT rowid FROM password_history WHERE user_id = ? ORDER BY created DESC, rowid DESC LIMIT ?)`
+	_, err = db.Exec(query, id, id, config.PasswordHistory)
+	return err
+}
+
+// determines whether user has to change password before doing anything else,
+// either because an admin asked for it or because it is older than config.PasswordMaxAgeDays
+func PasswordChangeRequired(id string) (bool, error) {
+	db := coreDB()
+
+	var source string
+	var changedAt int64
+	var mustChange bool
+	query := `SELECT auth_source, password_changed_at, must_change_password FROM user WHERE id = ?`
+	err := db.QueryRow(query, id).Scan(&source, &changedAt, &mustChange)
+	if err == sql.ErrNoRows {
+		return false, nil
+	} else if err != nil {
+		return false, err
+	}
+
+	// password of external accounts is not managed here
+	if source != authSourceLocal {
+		return false, nil
+	}
+
+	if mustChange {
+		return true, nil
+	}
+
+	if changedAt == 0 {
+		// rows older than password expiry start counting from now
+		_, err = db.Exec(`UPDATE user SET password_changed_at = ? WHERE id = ?`, time.Now().Unix(), id)
+		return false, err
+	}
+
+	maxAge := time.Duration(config.PasswordMaxAgeDays) * 24 * time.Hour
+	return config.PasswordMaxAgeDays > 0 && time.Since(time.Unix(changedAt, 0)) > maxAge, nil
+}
+
+// function to let users holding update_own_password through to h, as well as anyone who must change the password
+// right now, who would otherwise be sent to "/user/password" by PasswordChangeMiddleware only to be refused there
+func RequireOwnPassword(h http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		session, _ := store.Get(r, "cookie-name")
+		if mustChange, _ := session.Values["must_change_password"].(bool); mustChange {
+			h(w, r)
+			return
+		}
+		Require("update_own_password", h)(w, r)
+	}
+}
+
+// middleware sending users who must change their password to "/user/password" until they did
+func PasswordChangeMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		session, _ := store.Get(r, "cookie-name")
+
+		if mustChange, _ := session.Values["must_change_password"].(bool); mustChange {
+			switch {
+			case r.URL.Path == "/user/password", r.URL.Path == "/user/password/update", r.URL.Path == "/user/logout":
+			case strings.HasPrefix(r.URL.Path, "/asset/"):
+			default:
+				http.Redirect(w, r, "/user/password", 302)
+				return
+			}
+		}
+
+		next.ServeHTTP(w, r)
+	})
+}
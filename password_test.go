@@ -0,0 +1,70 @@
+package main
+
+import (
+	"strings"
+	"testing"
+	"net/http"
+	"net/http/httptest"
+)
+
+func TestPasswordPolicyCheck(t *testing.T) {
+	tests := map[string]bool{
+		"Secure#Pass1": true,
+		"short#A1": true,
+		"Short#1": false,
+		"alllowercase": false,
+		"Password1": false, // common
+		"Alice#2024": false, // contains the username
+		"Aa1#" + strings.Repeat("x", 68): true,
+		"Aa1#" + strings.Repeat("x", 69): false, // 73 bytes, bcrypt refuses it
+		"Aa1#" + strings.Repeat("é", 35): false, // 74 bytes in 39 characters
+	}
+
+	for password, want := range tests {
+		err := PasswordPolicyCheck("alice", password)
+		if (err == nil) != want {
+			t.Errorf("PasswordPolicyCheck(%q) = %v, want accepted %v", password, err, want)
+		}
+	}
+}
+
+// every password the policy accepts must be one bcrypt can hash
+func TestPasswordPolicyCheckHashable(t *testing.T) {
+	password := "Aa1#" + strings.Repeat("x", passwordMaxBytes - 4)
+	if err := PasswordPolicyCheck("", password); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := HashPassword(password); err != nil {
+		t.Errorf("HashPassword() of %d bytes: %v", len(password), err)
+	}
+	if _, err := HashPassword(password + "x"); err == nil {
+		t.Errorf("bcrypt accepts more than %d bytes, passwordMaxBytes can be raised", passwordMaxBytes)
+	}
+}
+
+// a user made to change the password gets to the form, even in a usergroup without update_own_password
+func TestRequireOwnPassword(t *testing.T) {
+	testStore(t)
+	if err := CreateUsergroup("kiosk", ""); err != nil {
+		t.Fatal(err)
+	}
+	user := CurrentUser{"2", "kiosk", "kiosk"}
+	h := RequireOwnPassword(func(w http.ResponseWriter, r *http.Request) {})
+
+	for _, mustChange := range []bool{true, false} {
+		r := testAsUser(httptest.NewRequest("GET", "/user/password", nil), user)
+		for _, c := range testSession(t, map[interface{}]interface{}{"must_change_password": mustChange}) {
+			r.AddCookie(c)
+		}
+		w := httptest.NewRecorder()
+		h(w, r)
+
+		want := http.StatusForbidden
+		if mustChange {
+			want = http.StatusOK
+		}
+		if w.Code != want {
+			t.Errorf("must_change_password %v: status %d, want %d", mustChange, w.Code, want)
+		}
+	}
+}
@@ -0,0 +1,287 @@
+// self-service editing of own contact details on "/user/account"
+// a new email address only replaces the old one after the link sent to it is opened, using the same signed
+// one-time token scheme as reset.go (table email_change)
+package main
+
+import (
+	"log"
+	"time"
+	"errors"
+	"regexp"
+	"strings"
+	"strconv"
+	"net/http"
+	"net/mail"
+	"database/sql"
+	"crypto/hmac"
+	"github.com/gorilla/mux"
+)
+
+// how long an email confirmation link stays valid
+const emailChangeExpiry = 24 * time.Hour
+
+var ErrEmailTokenInvalid = errors.New("confirmation link is invalid or has expired")
+
+var phoneExtPattern = regexp.MustCompile(`^[0-9]{0,10}$`)
+
+// the email confirmation link works without being logged in, so it stays on r
+func ProfileHandler(r *mux.Router, user *mux.Router, s *Store) {
+	user.HandleFunc("/account/profile", SessionOnly(ProfileUpdate(s))).Methods("POST")
+	r.HandleFunc("/user/account/email/verify", ProfileVerifyEmail(s))
+}
+
+// handle the profile form on "/user/account"
+// display name and phone extension are saved at once, a new email address only once confirmed
+func ProfileUpdate(s *Store) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		user, _ := GetCurrentUser(r)
+		data, err := s.Users.Account(user.Username)
+		if err != nil {
+			HTTPError(w, r, err)
+			return
+		}
+
+		displayName := strings.TrimSpace(r.FormValue("displayname"))
+		phoneExt := strings.TrimSpace(r.FormValue("phoneext"))
+		email := strings.TrimSpace(r.FormValue("email"))
+
+		if len(displayName) > 64 || strings.ContainsAny(displayName, "\r\n\t") {
+			data.Message = "Error. Display name must be a single line of at most 64 characters."
+		} else if !phoneExtPattern.MatchString(phoneExt) {
+			data.Message = "Error. Phone extension must be digits only, at most 10."
+		} else if email != data.Email && data.AuthSource != authSourceLocal {
+			data.Message = "Error. Email of this account is managed by " + data.AuthSource + "."
+		} else if email != data.Email && email != "" && !ValidEmail(email) {
+			data.Message = "Error. Invalid email address."
+		} else if email != data.Email && email != "" && !MailEnabled() {
+			data.Message = "Error. Email addresses cannot be confirmed on this server, please contact your administrator."
+		} else {
+			before, err := AuditUser(data.Id)
+			if err != nil {
+				HTTPError(w, r, err)
+				return
+			}
+			if err := s.Users.UpdateProfile(data.Id, displayName, phoneExt); err != nil {
+				HTTPError(w, r, err)
+				return
+			}
+			data.Message = "Profile updated."
+
+			if email != data.Email {
+				if email == "" {
+					if err := s.Users.SetEmail(data.Id, ""); err != nil {
+						HTTPError(w, r, err)
+						return
+					}
+				} else if token, err := CreateEmailToken(data.Id, email); err != nil {
+					HTTPError(w, r, err)
+					return
+				} else if err := sendEmailConfirmation(user.Username, email, token); err != nil {
+					log.Println("ProfileUpdate() ", err)
+					data.Message = "Profile updated, but the confirmation email could not be sent. Please try again later."
+				} else {
+					data.Message = "Profile updated. A confirmation link has been sent to " + email + ", your email address changes once it is opened."
+				}
+			}
+
+			after, err := AuditUser(data.Id)
+			if err != nil {
+				HTTPError(w, r, err)
+				return
+			}
+			if err := AuditLog(r, user.Username, auditEntityUser, data.Id, auditActionUpdate, before, after); err != nil {
+				HTTPError(w, r, err)
+				return
+			}
+
+			message := data.Message
+			data, err = s.Users.Account(user.Username)
+			if err != nil {
+				HTTPError(w, r, err)
+				return
+			}
+			data.Message = message
+		}
+
+		tmpl := ParseTemplate(w, r, "user/account.html")
+		tmpl.Execute(w, data)
+	}
+}
+
+// "/user/account/email/verify?token=..."
+// works without being logged in, as the link may well be opened on another device
+func ProfileVerifyEmail(s *Store) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		message := "your email address has been confirmed"
+
+		id, email, err := VerifyEmailToken(r.URL.Query().Get("token"))
+		username := ""
+		disabled := false
+		if err == nil {
+			username, err = s.Users.Username(id)
+		}
+		if err == nil {
+			disabled, err = s.Users.Disabled(id)
+		}
+		if err != nil && err != ErrEmailTokenInvalid {
+			HTTPError(w, r, err)
+			return
+		}
+		if err == nil && (username == "" || disabled) {
+			err = ErrEmailTokenInvalid
+		}
+
+		if err != nil {
+			message = err.Error()
+		} else {
+			before, err := AuditUser(id)
+			if err != nil {
+				HTTPError(w, r, err)
+				return
+			}
+			account, err := s.Users.Account(username)
+			if err != nil {
+				HTTPError(w, r, err)
+				return
+			}
+			oldEmail := account.Email
+
+			if err := s.Users.SetEmail(id, email); err != nil {
+				HTTPError(w, r, err)
+				return
+			}
+			after, err := AuditUser(id)
+			if err != nil {
+				HTTPError(w, r, err)
+				return
+			}
+			if err := AuditLog(r, username, auditEntityUser, id, auditActionUpdate, before, after); err != nil {
+				HTTPError(w, r, err)
+				return
+			}
+			log.Println("email of", username, "changed, confirmed from", ClientIP(r))
+
+			// let the previous address know, in case the change was not made by its owner
+			if oldEmail != "" && oldEmail != email {
+				body := "Hello " + username + ",\n\n" +
+					"The email address of your fragment account has been changed to " + email + ".\n" +
+					"If you did not make this change, please contact your administrator.\n"
+				if err := SendMail(oldEmail, "fragment email address changed", body); err != nil {
+					log.Println("ProfileVerifyEmail() ", err)
+				}
+			}
+		}
+
+		authenticated, err := IsAuthenticated(w,r)
+		if err != nil {
+			HTTPError(w, r, err)
+			return
+		}
+		if authenticated {
+			username, _, err := GetUserSession(r)
+			if err != nil {
+				HTTPError(w, r, err)
+				return
+			}
+			data, err := s.Users.Account(username)
+			if err != nil {
+				HTTPError(w, r, err)
+				return
+			}
+			data.Message = message
+			tmpl := ParseTemplate(w, r, "user/account.html")
+			tmpl.Execute(w, data)
+		} else {
+			PageIndex(message)(w,r)
+		}
+	}
+}
+
+// Functions that handles process and procedures and does not involve returning HTML page
+//
+//
+
+// determines whether email is a plain address such as "name@example.com"
+func ValidEmail(email string) bool {
+	addr, err := mail.ParseAddress(email)
+	return err == nil && addr.Address == email && len(email) <= 254
+}
+
+func sendEmailConfirmation(username string, email string, token string) error {
+	link := strings.TrimRight(config.BaseURL, "/") + "/user/account/email/verify?token=" + token
+
+	body := "Hello " + username + ",\n\n" +
+		"Please confirm this address for your fragment account by opening the link below within " +
+		strconv.Itoa(int(emailChangeExpiry.Hours())) + " hours:\n\n" +
+		link + "\n\n" +
+		"If you did not request this, you can ignore this email.\n"
+
+	return SendMail(email, "fragment email confirmation", body)
+}
+
+// function to create a confirmation token for changing email of user id to email
+func CreateEmailToken(id string, email string) (string, error) {
+	nonce := randomToken()
+	expires := time.Now().Add(emailChangeExpiry).Unix()
+
+	db := coreDB()
+
+	query := `INSERT INTO email_change (nonce_hash, user_id, email, expires, used) VALUES (?, ?, ?, ?, 0)`
+	_, err := db.Exec(query, nonceHash(nonce), id, email, expires)
+	if err != nil {
+		return "", err
+	}
+
+	// opportunistic cleanup of expired links
+	_, err = db.Exec(`DELETE FROM email_change WHERE expires < ?`, time.Now().Unix())
+	if err != nil {
+		return "", err
+	}
+
+	payload := id + "." + strconv.FormatInt(expires, 10) + "." + nonce
+	return payload + "." + tokenSignature("email-change", payload), nil
+}
+
+// function to check token and use it up, returns user id and the confirmed email
+func VerifyEmailToken(token string) (string, string, error) {
+	i := strings.LastIndex(token, ".")
+	if i < 0 {
+		return "", "", ErrEmailTokenInvalid
+	}
+	payload, signature := token[:i], token[i+1:]
+	if !hmac.Equal([]byte(signature), []byte(tokenSignature("email-change", payload))) {
+		return "", "", ErrEmailTokenInvalid
+	}
+
+	parts := strings.SplitN(payload, ".", 3)
+	if len(parts) != 3 {
+		return "", "", ErrEmailTokenInvalid
+	}
+	id, nonce := parts[0], parts[2]
+	expires, err := strconv.ParseInt(parts[1], 10, 64)
+	if err != nil || time.Now().Unix() > expires {
+		return "", "", ErrEmailTokenInvalid
+	}
+
+	db := coreDB()
+
+	var email string
+	err = db.QueryRow(`SELECT email FROM email_change WHERE nonce_hash = ? AND user_id = ? AND used = 0`, nonceHash(nonce), id).Scan(&email)
+	if err == sql.ErrNoRows {
+		return "", "", ErrEmailTokenInvalid
+	} else if err != nil {
+		return "", "", err
+	}
+
+	result, err := db.Exec(`UPDATE email_change SET used = 1 WHERE nonce_hash = ? AND used = 0`, nonceHash(nonce))
+	if err != nil {
+		return "", "", err
+	}
+	if affected, err := result.RowsAffected(); err != nil {
+		return "", "", err
+	} else if affected != 1 {
+		return "", "", ErrEmailTokenInvalid
+	}
+
+	return id, email, nil
+}
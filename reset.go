@@ -0,0 +1,331 @@
+// self-service password reset through an emailed one-time link
+// the token in the link is "<payload>.<signature>", payload being "<user id>.<expiry>.<nonce>" and signature
+// an HMAC of the payload with the session key. the nonce is recorded in core.db (table password_reset) so every
+// link works only once
+package main
+
+import (
+	"log"
+	"time"
+	"errors"
+	"strings"
+	"sync"
+	"strconv"
+	"net/http"
+	"database/sql"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/base64"
+	"github.com/gorilla/mux"
+)
+
+var ErrResetTokenInvalid = errors.New("reset link is invalid or has expired")
+
+// reset links still being looked up or sent by ForgotPasswordSubmit
+var resetMail sync.WaitGroup
+
+type PageResetStruct struct {
+	Message	string
+	Token	string
+	Policy	string
+}
+
+func PasswordResetHandler(r *mux.Router) {
+	r.HandleFunc("/user/forgot", PageForgotPassword)
+	r.HandleFunc("/user/forgot/submit", ForgotPasswordSubmit).Methods("POST")
+	r.HandleFunc("/user/reset", PageResetPassword)
+	r.HandleFunc("/user/reset/submit", ResetPasswordSubmit).Methods("POST")
+}
+
+// "/user/forgot"
+func PageForgotPassword(w http.ResponseWriter, r *http.Request) {
+	data := PageResetStruct{}
+	if !MailEnabled() {
+		data.Message = "password reset by email is not available, please contact your administrator"
+	}
+	tmpl := ParseTemplate(w, r, "forgot.html")
+	tmpl.Execute(w, data)
+}
+
+// handle the form on "/user/forgot"
+// the response is the same whether or not the account exists, so it cannot be used to discover usernames. the link
+// is looked up and sent in the background, so the response does not take any longer for an existing account either
+func ForgotPasswordSubmit(w http.ResponseWriter, r *http.Request) {
+	ip := ClientIP(r)
+	username := strings.TrimSpace(r.FormValue("username"))
+
+	wait, err := ResetThrottled(username, ip)
+	if err != nil {
+		HTTPError(w, r, err)
+		return
+	}
+	if wait > 0 {
+		data := PageResetStruct{Message: "too many attempts, try again in " + wait.Round(time.Second).String()}
+		tmpl := ParseTemplate(w, r, "forgot.html")
+		tmpl.Execute(w, data)
+		return
+	}
+	if err := ResetRequested(username, ip); err != nil {
+		HTTPError(w, r, err)
+		return
+	}
+
+	if MailEnabled() && username != "" {
+		resetMail.Add(1)
+		go func() {
+			defer resetMail.Done()
+			sendResetLink(username, ip)
+		}()
+	}
+
+	data := PageResetStruct{Message: "if the account exists and has an email address, a reset link has been sent to it"}
+	tmpl := ParseTemplate(w, r, "forgot.html")
+	tmpl.Execute(w, data)
+}
+
+// "/user/reset?token=..."
+func PageResetPassword(w http.ResponseWriter, r *http.Request) {
+	token := r.URL.Query().Get("token")
+	if _, _, err := VerifyResetToken(token); err == ErrResetTokenInvalid {
+		data := PageResetStruct{Message: err.Error()}
+		tmpl := ParseTemplate(w, r, "forgot.html")
+		tmpl.Execute(w, data)
+		return
+	} else if err != nil {
+		HTTPError(w, r, err)
+		return
+	}
+
+	data := PageResetStruct{Token: token, Policy: PasswordPolicyDescription()}
+	tmpl := ParseTemplate(w, r, "reset.html")
+	tmpl.Execute(w, data)
+}
+
+// handle the form on "/user/reset"
+func ResetPasswordSubmit(w http.ResponseWriter, r *http.Request) {
+	token := r.FormValue("token")
+	id, nonce, err := VerifyResetToken(token)
+	if err == nil {
+		disabled, errDisabled := UserDisabled(id)
+		if errDisabled != nil {
+			HTTPError(w, r, errDisabled)
+			return
+		}
+		if disabled {
+			err = ErrResetTokenInvalid
+		}
+	}
+	if err == ErrResetTokenInvalid {
+		data := PageResetStruct{Message: err.Error()}
+		tmpl := ParseTemplate(w, r, "forgot.html")
+		tmpl.Execute(w, data)
+		return
+	} else if err != nil {
+		HTTPError(w, r, err)
+		return
+	}
+
+	newpassword := r.FormValue("newpassword")
+	confirmpassword := r.FormValue("confirmpassword")
+	username, err := GetUsername(id)
+	if err != nil {
+		HTTPError(w, r, err)
+		return
+	}
+
+	data := PageResetStruct{Token: token, Policy: PasswordPolicyDescription()}
+
+	if newpassword != confirmpassword {
+		data.Message = "Error. Invalid password confirmation."
+	} else if errPolicy := PasswordPolicyCheck(username, newpassword); errPolicy != nil {
+		data.Message = "Error. " + errPolicy.Error() + "."
+	} else if reused, err := PasswordReused(id, newpassword); err != nil {
+		HTTPError(w, r, err)
+		return
+	} else if reused {
+		data.Message = "Error. Password was used recently, please choose another."
+	} else if used, err := UseResetToken(nonce); err != nil {
+		HTTPError(w, r, err)
+		return
+	} else if !used {
+		data = PageResetStruct{Message: ErrResetTokenInvalid.Error()}
+		tmpl := ParseTemplate(w, r, "forgot.html")
+		tmpl.Execute(w, data)
+		return
+	} else {
+		if err := SetPassword(id, newpassword, false); err != nil {
+			HTTPError(w, r, err)
+			return
+		}
+
+		// anyone holding the old password should be signed out, and the account unlocked
+		if err := RevokeUserSessions(id, ""); err != nil {
+			HTTPError(w, r, err)
+			return
+		}
+		if err := AuditLog(r, username, auditEntityUser, id, "password reset", nil, nil); err != nil {
+			HTTPError(w, r, err)
+			return
+		}
+		if err := LoginThrottleReset(throttleScopeUser, username); err != nil {
+			HTTPError(w, r, err)
+			return
+		}
+		if err := LoginThrottleReset(throttleScopeReset, username); err != nil {
+			HTTPError(w, r, err)
+			return
+		}
+		log.Println("password reset for", username, "from", ClientIP(r))
+
+		PageIndex("your password has been reset, please login")(w,r)
+		return
+	}
+
+	tmpl := ParseTemplate(w, r, "reset.html")
+	tmpl.Execute(w, data)
+}
+
+// Functions that handles process and procedures and does not involve returning HTML page
+//
+//
+
+// function to email a reset link to username, if it is an enabled local account with an email address
+// runs in the background of ForgotPasswordSubmit, so errors are only logged
+func sendResetLink(username string, ip string) {
+	exists, err := UsernameExist(username)
+	if err != nil {
+		log.Println("sendResetLink() ", err)
+		return
+	}
+	if !exists {
+		return
+	}
+	source, err := GetUserAuthSource(username)
+	if err != nil {
+		log.Println("sendResetLink() ", err)
+		return
+	}
+	if source != authSourceLocal {
+		return
+	}
+
+	account, err := ReadUserAccount(username)
+	if err != nil {
+		log.Println("sendResetLink() ", err)
+		return
+	}
+	disabled, err := UserDisabled(account.Id)
+	if err != nil {
+		log.Println("sendResetLink() ", err)
+		return
+	}
+	if account.Email == "" || disabled {
+		return
+	}
+
+	token, err := CreateResetToken(account.Id)
+	if err != nil {
+		log.Println("sendResetLink() ", err)
+		return
+	}
+	link := strings.TrimRight(config.BaseURL, "/") + "/user/reset?token=" + token
+
+	body := "Hello " + username + ",\n\n" +
+		"A password reset was requested for your account from " + ip + ".\n" +
+		"Open the link below within " + strconv.Itoa(config.PasswordResetMinutes) + " minutes to choose a new password:\n\n" +
+		link + "\n\n" +
+		"If you did not request this, you can ignore this email.\n"
+
+	if err := SendMail(account.Email, "fragment password reset", body); err != nil {
+		log.Println("sendResetLink() ", err)
+	} else {
+		log.Println("password reset link sent to", username, "requested from", ip)
+	}
+}
+
+// function to sign payload of an emailed link, purpose keeps links of one kind from being used as another
+func tokenSignature(purpose string, payload string) string {
+	mac := hmac.New(sha256.New, []byte(purpose + ":" + config.SessionKey))
+	mac.Write([]byte(payload))
+	return base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+func resetSignature(payload string) string {
+	return tokenSignature("password-reset", payload)
+}
+
+func nonceHash(nonce string) string {
+	sum := sha256.Sum256([]byte(nonce))
+	return hex.EncodeToString(sum[:])
+}
+
+// function to create a reset token for user id
+func CreateResetToken(id string) (string, error) {
+	nonce := randomToken()
+	expires := time.Now().Add(time.Duration(config.PasswordResetMinutes) * time.Minute).Unix()
+
+	db := coreDB()
+
+	query := `INSERT INTO password_reset (nonce_hash, user_id, expires, used) VALUES (?, ?, ?, 0)`
+	_, err := db.Exec(query, nonceHash(nonce), id, expires)
+	if err != nil {
+		return "", err
+	}
+
+	// opportunistic cleanup of expired links
+	_, err = db.Exec(`DELETE FROM password_reset WHERE expires < ?`, time.Now().Unix())
+	if err != nil {
+		return "", err
+	}
+
+	payload := id + "." + strconv.FormatInt(expires, 10) + "." + nonce
+	return payload + "." + resetSignature(payload), nil
+}
+
+// function to check signature, expiry and single use of token, returns user id and nonce
+func VerifyResetToken(token string) (string, string, error) {
+	i := strings.LastIndex(token, ".")
+	if i < 0 {
+		return "", "", ErrResetTokenInvalid
+	}
+	payload, signature := token[:i], token[i+1:]
+	if !hmac.Equal([]byte(signature), []byte(resetSignature(payload))) {
+		return "", "", ErrResetTokenInvalid
+	}
+
+	parts := strings.SplitN(payload, ".", 3)
+	if len(parts) != 3 {
+		return "", "", ErrResetTokenInvalid
+	}
+	id, nonce := parts[0], parts[2]
+	expires, err := strconv.ParseInt(parts[1], 10, 64)
+	if err != nil || time.Now().Unix() > expires {
+		return "", "", ErrResetTokenInvalid
+	}
+
+	db := coreDB()
+
+	var used bool
+	err = db.QueryRow(`SELECT used FROM password_reset WHERE nonce_hash = ? AND user_id = ?`, nonceHash(nonce), id).Scan(&used)
+	if err == sql.ErrNoRows || used {
+		return "", "", ErrResetTokenInvalid
+	} else if err != nil {
+		return "", "", err
+	}
+
+	return id, nonce, nil
+}
+
+// function to mark token as used, returns false if it was used in the meantime
+func UseResetToken(nonce string) (bool, error) {
+	db := coreDB()
+
+	result, err := db.Exec(`UPDATE password_reset SET used = 1 WHERE nonce_hash = ? AND used = 0`, nonceHash(nonce))
+	if err != nil {
+		return false, err
+	}
+	affected, err := result.RowsAffected()
+
+	return affected == 1, err
+}
@@ -0,0 +1,184 @@
+package main
+
+import (
+	"net"
+	"bufio"
+	"regexp"
+	"strings"
+	"testing"
+	"net/url"
+	"net/http/httptest"
+)
+
+// SMTP server accepting every message, which is passed on to the returned channel
+// config.SMTP points at it for the rest of the test
+func testSMTPSink(t *testing.T) chan string {
+	t.Helper()
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { listener.Close() })
+
+	messages := make(chan string, 10)
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go testSMTPSession(conn, messages)
+		}
+	}()
+
+	config.SMTP = SMTPConfig{Host: "127.0.0.1", Port: listener.Addr().(*net.TCPAddr).Port, From: "fragment@example.com"}
+	return messages
+}
+
+func testSMTPSession(conn net.Conn, messages chan string) {
+	defer conn.Close()
+	reader := bufio.NewReader(conn)
+	conn.Write([]byte("220 sink\r\n"))
+
+	for {
+		line, err := reader.ReadString('\n')
+		if err != nil {
+			return
+		}
+		switch command := strings.ToUpper(strings.TrimSpace(line)); {
+		case strings.HasPrefix(command, "DATA"):
+			conn.Write([]byte("354 go ahead\r\n"))
+			var message strings.Builder
+			for {
+				line, err := reader.ReadString('\n')
+				if err != nil {
+					return
+				}
+				if line == ".\r\n" {
+					break
+				}
+				message.WriteString(line)
+			}
+			messages <- message.String()
+			conn.Write([]byte("250 queued\r\n"))
+		case strings.HasPrefix(command, "QUIT"):
+			conn.Write([]byte("221 bye\r\n"))
+			return
+		default:
+			conn.Write([]byte("250 ok\r\n"))
+		}
+	}
+}
+
+// function to post username to ForgotPasswordSubmit, returns the page
+func testForgot(t *testing.T, username string) string {
+	t.Helper()
+	r := httptest.NewRequest("POST", "/user/forgot/submit", strings.NewReader(url.Values{"username": {username}}.Encode()))
+	r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	w := httptest.NewRecorder()
+	ForgotPasswordSubmit(w, r)
+	return w.Body.String()
+}
+
+var (
+	testResetLink = regexp.MustCompile(`/user/reset\?token=(\S+)`)
+	testCSRFField = regexp.MustCompile(`value="[^"]*"`)
+)
+
+func TestForgotPasswordSubmit(t *testing.T) {
+	s := testStore(t)
+	messages := testSMTPSink(t)
+	t.Cleanup(resetMail.Wait)
+	id := testUser(t, s, "alice", "normal")
+
+	known := testForgot(t, "alice")
+	resetMail.Wait()
+	if !strings.Contains(known, "a reset link has been sent") {
+		t.Fatalf("unexpected page:\n%s", known)
+	}
+	select {
+	case message := <-messages:
+		if !strings.Contains(message, "To: alice@example.com") {
+			t.Errorf("reset link sent to someone else:\n%s", message)
+		}
+		link := testResetLink.FindStringSubmatch(message)
+		if link == nil {
+			t.Fatalf("no reset link in:\n%s", message)
+		}
+		if got, _, err := VerifyResetToken(link[1]); err != nil || got != id {
+			t.Errorf("VerifyResetToken() = %q, %v, want %q", got, err, id)
+		}
+	default:
+		t.Fatalf("no email sent")
+	}
+
+	// nothing tells an unknown username apart
+	unknown := testForgot(t, "nobody")
+	resetMail.Wait()
+	if testCSRFField.ReplaceAllString(unknown, "") != testCSRFField.ReplaceAllString(known, "") {
+		t.Errorf("page differs for unknown username")
+	}
+	if len(messages) != 0 {
+		t.Errorf("email sent for unknown username")
+	}
+}
+
+// a mailbox must not be flooded with links, even though every request is for an existing account
+func TestForgotPasswordSubmitThrottled(t *testing.T) {
+	s := testStore(t)
+	messages := testSMTPSink(t)
+	t.Cleanup(resetMail.Wait)
+	testUser(t, s, "alice", "normal")
+
+	throttled := 0
+	for i := 0; i < 10; i++ {
+		if strings.Contains(testForgot(t, "alice"), "too many attempts") {
+			throttled++
+		}
+	}
+	resetMail.Wait()
+
+	// last_failure is kept in whole seconds, so the first one second back-off may already be over when a
+	// second boundary is crossed, the two second one after it is not
+	if sent := len(messages); sent + throttled != 10 || sent > throttleFreeAttempts + 2 {
+		t.Errorf("%d of 10 requests sent a link, %d throttled", sent, throttled)
+	}
+
+	// the login of the account stays usable
+	throttle, err := GetLoginThrottle(throttleScopeUser, "alice")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if wait := throttle.Wait(); wait > 0 {
+		t.Errorf("reset requests locked the login for %v", wait)
+	}
+}
+
+// reset requests have their own IP counter, they neither slow down logins from the same address nor show as failed logins
+func TestForgotPasswordSubmitIP(t *testing.T) {
+	s := testStore(t)
+	testSMTPSink(t)
+	t.Cleanup(resetMail.Wait)
+	testUser(t, s, "alice", "normal")
+	ip := ClientIP(httptest.NewRequest("POST", "/user/forgot/submit", nil))
+
+	for i := 0; i < 10; i++ {
+		testForgot(t, "alice")
+	}
+	resetMail.Wait()
+
+	if wait, err := LoginThrottled("bob", ip); err != nil || wait > 0 {
+		t.Errorf("LoginThrottled() = %v, %v after reset requests", wait, err)
+	}
+	if ips, err := FailedLoginIPs(); err != nil || len(ips) != 0 {
+		t.Errorf("FailedLoginIPs() = %v, %v after reset requests", ips, err)
+	}
+
+	// nor does a login from the same address lift the reset throttle
+	if err := LoginSucceeded("bob", ip); err != nil {
+		t.Fatal(err)
+	}
+	if wait, err := ResetThrottled("carol", ip); err != nil || wait == 0 {
+		t.Errorf("ResetThrottled() = %v, %v after login", wait, err)
+	}
+}
@@ -2,19 +2,39 @@ package main
 
 import (
     "fmt"
+    "errors"
+    "log"
     "time"
     "net/http"
     "os"
+    "path/filepath"
     "github.com/gorilla/sessions"
 )
 
 var (
-    // key must be 16, 24 or 32 bytes long (AES-128, AES-192 or AES-256)
-    key = []byte("super-secret-key")
     //store = sessions.NewCookieStore(key) //NOTE this line determines how to store session. This store in memory
-    store = sessions.NewFilesystemStore(SessionDirectory(), key)
+    store *sessions.FilesystemStore
 )
 
+// function to create the session store, called from main() after config is loaded
+// session files are kept on the server, the cookie only holds their id and is signed (HMAC) with the key, not encrypted
+func SessionInit() {
+    if config.SessionKey == defaultSessionKey {
+        log.Println("WARNING: using the built-in session_key, sessions and emailed links can be forged. dev mode only")
+    }
+    // a new installation has no session directory yet
+    if err := os.MkdirAll(SessionDirectory(), 0700); err != nil {
+        log.Fatal("SessionInit() ", err)
+    }
+    store = sessions.NewFilesystemStore(SessionDirectory(), []byte(config.SessionKey))
+    if config.SessionAbsoluteHours > 0 {
+        store.MaxAge(config.SessionAbsoluteHours * 3600)
+    }
+
+    // expired sessions are removed from registry and disk, see usersession.go
+    go SessionCleanup(time.Hour)
+}
+
 func secret(w http.ResponseWriter, r *http.Request) {
     session, _ := store.Get(r, "cookie-name")
 
@@ -28,43 +48,151 @@ func secret(w http.ResponseWriter, r *http.Request) {
 }
 
 // function to determine authentication
-func IsAuthenticated(w http.ResponseWriter, r *http.Request) bool {
+func IsAuthenticated(w http.ResponseWriter, r *http.Request) (bool, error) {
     session, _ := store.Get(r, "cookie-name")
 
     // Check if user is authenticated
     if auth, ok := session.Values["authenticated"].(bool); !ok || !auth {
-        return false
-    } else {
-        return true
+        return false, nil
     }
+
+    // bearer token was already checked, see apitoken.go
+    if APIRequest(r) {
+        return true, nil
+    }
+
+    // session may have expired or been revoked, see usersession.go
+    sid, _ := session.Values["sid"].(string)
+    valid, err := SessionValid(sid)
+    if err != nil {
+        return false, err
+    }
+    if !valid {
+        return false, logout(w, r)
+    }
+
+    // account may have been removed while logged in
+    username, _ := session.Values["username"].(string)
+    exists, err := UsernameExist(username)
+    if err != nil {
+        return false, err
+    }
+    if !exists {
+        return false, logout(w, r)
+    }
+
+    return true, nil
 }
 
-func login(w http.ResponseWriter, r *http.Request, id string, username string) {
+func login(w http.ResponseWriter, r *http.Request, id string, username string) error {
+    sid, err := CreateSession(r, id, username)
+    if err != nil {
+        return err
+    }
+    mustChange, err := PasswordChangeRequired(id)
+    if err != nil {
+        return err
+    }
+
     session, _ := store.Get(r, "cookie-name")
 
+    // the session id from before login may have been planted by someone else, so it is replaced by a new one
+    if session.ID != "" {
+        os.Remove(filepath.Join(SessionDirectory(), "session_" + session.ID))
+        session.ID = ""
+    }
+
     // Set user as authenticated
     session.Values["authenticated"] = true
     session.Values["id"] = id
     session.Values["username"] = username
     session.Values["loggedon"] = time.Now().Format(time.RFC822)
+    session.Values["sid"] = sid
+    session.Values["must_change_password"] = mustChange
+    delete(session.Values, csrfSessionKey) // issue a fresh csrf token for the new identity
 
-    session.Save(r, w)
+    return session.Save(r, w)
 }
 
-func logout(w http.ResponseWriter, r *http.Request) {
+// function to sign out, the cookie session is cleared even if the registry entry could not be removed
+func logout(w http.ResponseWriter, r *http.Request) error {
     session, _ := store.Get(r, "cookie-name")
 
+    var err error
+    if sid, ok := session.Values["sid"].(string); ok && sid != "" {
+        err = RevokeSession(sid)
+    }
+    if admin, ok := session.Values["impersonator_username"].(string); ok && admin != "" {
+        id, _ := session.Values["id"].(string)
+        err = errors.Join(err, AuditLog(r, admin, auditEntityUser, id, "impersonate stop", nil, nil))
+    }
+    delete(session.Values, "impersonator_id")
+    delete(session.Values, "impersonator_username")
+    delete(session.Values, "sid")
+    delete(session.Values, "must_change_password")
+
     // Revoke users authentication
     session.Values["authenticated"] = false
     session.Values["id"] = ""
     session.Values["username"] = ""
     session.Values["loggedon"] = ""
+    delete(session.Values, "pending_id")
+    delete(session.Values, "pending_username")
+    delete(session.Values, "pending_since")
+    delete(session.Values, "totp_secret")
 
     session.Save(r, w)
+    return err
 }
 
 // function to return directory for storing session
 func SessionDirectory() string {
+    if filepath.IsAbs(config.SessionDir) {
+        return config.SessionDir
+    }
     str, _ := os.Getwd()
-    return str + "/session"
-}
\ No newline at end of file
+    return filepath.Join(str, config.SessionDir)
+}
+
+// function to remember a user who passed the password check but still has to pass two-factor authentication
+// the session is not authenticated until loginPendingComplete() is called
+func loginPending(w http.ResponseWriter, r *http.Request, id string, username string) {
+    session, _ := store.Get(r, "cookie-name")
+
+    session.Values["authenticated"] = false
+    session.Values["pending_id"] = id
+    session.Values["pending_username"] = username
+    session.Values["pending_since"] = time.Now().Unix()
+    delete(session.Values, "totp_secret") // a secret offered to someone else must not be enrolled for this user
+
+    session.Save(r, w)
+}
+
+// function to return the user waiting for two-factor authentication, if any and not expired
+func pendingLogin(r *http.Request) (string, string, bool) {
+    session, _ := store.Get(r, "cookie-name")
+
+    id, _ := session.Values["pending_id"].(string)
+    username, _ := session.Values["pending_username"].(string)
+    since, _ := session.Values["pending_since"].(int64)
+
+    if id == "" || username == "" || time.Since(time.Unix(since, 0)) > 5*time.Minute {
+        return "", "", false
+    }
+    return id, username, true
+}
+
+// function to turn the pending login into a full login
+func loginPendingComplete(w http.ResponseWriter, r *http.Request) error {
+    id, username, ok := pendingLogin(r)
+    if !ok {
+        return nil
+    }
+
+    session, _ := store.Get(r, "cookie-name")
+    delete(session.Values, "pending_id")
+    delete(session.Values, "pending_username")
+    delete(session.Values, "pending_since")
+
+    return login(w, r, id, username)
+}
@@ -0,0 +1,39 @@
+package main
+
+import (
+	"testing"
+	"net/http/httptest"
+)
+
+// a session id handed out before login must not be the one that gets authenticated
+func TestLoginIssuesNewSession(t *testing.T) {
+	s := testStore(t)
+	id := testUser(t, s, "alice", "normal")
+
+	planted := testSession(t, map[interface{}]interface{}{"login_next": "/user/account"})
+	r := httptest.NewRequest("POST", "/user/login", nil)
+	for _, c := range planted {
+		r.AddCookie(c)
+	}
+	w := httptest.NewRecorder()
+	if err := login(w, r, id, "alice"); err != nil {
+		t.Fatal(err)
+	}
+
+	values := testSessionValues(t, w, r)
+	if auth, _ := values["authenticated"].(bool); !auth {
+		t.Fatalf("session not authenticated after login")
+	}
+	if next, _ := values["login_next"].(string); next != "/user/account" {
+		t.Errorf("values of the session before login were lost")
+	}
+
+	old := httptest.NewRequest("GET", "/user", nil)
+	for _, c := range planted {
+		old.AddCookie(c)
+	}
+	session, _ := store.Get(old, "cookie-name")
+	if auth, _ := session.Values["authenticated"].(bool); auth {
+		t.Errorf("the session id from before login is authenticated")
+	}
+}
@@ -0,0 +1,45 @@
+// system-wide settings changeable at runtime by admins, stored in core.db (table setting)
+package main
+
+import (
+	"database/sql"
+)
+
+// setting names
+const (
+	settingRequire2FAAdmin = "require_2fa_admin"
+)
+
+// function to read a setting, returns fallback when it was never set
+func GetSetting(name string, fallback string) (string, error) {
+	db := coreDB()
+
+	value := ""
+	err := db.QueryRow(`SELECT value FROM setting WHERE name = ?`, name).Scan(&value)
+	if err == sql.ErrNoRows {
+		return fallback, nil
+	}
+
+	return value, err
+}
+
+func GetSettingBool(name string) (bool, error) {
+	value, err := GetSetting(name, "0")
+	return value == "1", err
+}
+
+// function to create or update a setting
+func SetSetting(name string, value string) error {
+	db := coreDB()
+
+	query := `INSERT INTO setting (name, value) VALUES (?, ?) ON CONFLICT (name) DO UPDATE SET value = excluded.value`
+	_, err := db.Exec(query, name, value)
+	return err
+}
+
+func SetSettingBool(name string, value bool) error {
+	if value {
+		return SetSetting(name, "1")
+	}
+	return SetSetting(name, "0")
+}
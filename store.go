@@ -0,0 +1,81 @@
+// long-lived database handles, opened once in main() and shared by every request
+// *sql.DB is a connection pool, so handing the same one around replaces opening and closing core.db or
+// itdb.db in every helper
+package main
+
+import (
+	"os"
+	"errors"
+	"path/filepath"
+	"database/sql"
+)
+
+type Store struct {
+	Core		*sql.DB
+	ITDB		*sql.DB
+	Users		*UserRepository
+	PCs			*PCRepository
+	Printers	*PrinterRepository
+}
+
+// store opened in main(), for the helpers which are not handed one
+var defaultStore *Store
+
+// function to open core.db and itdb.db at the given paths
+// a temporary SQLite file works just as well, which is how the repositories can be exercised on their own
+func OpenStore(corePath string, itdbPath string) (*Store, error) {
+	core, err := openSQLite(corePath)
+	if err != nil {
+		return nil, err
+	}
+	itdb, err := openSQLite(itdbPath)
+	if err != nil {
+		core.Close()
+		return nil, err
+	}
+
+	return &Store{
+		core,
+		itdb,
+		&UserRepository{core},
+		&PCRepository{itdb},
+		&PrinterRepository{itdb},
+	}, nil
+}
+
+// function to close every pooled connection of the store
+func (s *Store) Close() error {
+	return errors.Join(s.Core.Close(), s.ITDB.Close())
+}
+
+// function to open a pool on SQLite file path, waiting for a locked database instead of failing at once
+// the directory is created if needed, a missing file is created empty and filled by MigrateDatabases()
+func openSQLite(path string) (*sql.DB, error) {
+	if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+		return nil, err
+	}
+
+	db, err := sql.Open("sqlite3", "file:" + path + "?_busy_timeout=5000")
+	if err != nil {
+		return nil, err
+	}
+	db.SetMaxIdleConns(4)
+
+	// sql.Open does not connect, so a missing directory or unreadable file would only show at the first query
+	if err := db.Ping(); err != nil {
+		db.Close()
+		return nil, err
+	}
+
+	return db, nil
+}
+
+// pooled handle to core.db
+func coreDB() *sql.DB {
+	return defaultStore.Core
+}
+
+// pooled handle to itdb.db
+func itdbDB() *sql.DB {
+	return defaultStore.ITDB
+}
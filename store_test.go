@@ -0,0 +1,102 @@
+package main
+
+import (
+	"fmt"
+	"context"
+	"testing"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"github.com/gorilla/sessions"
+)
+
+// function to open a store on empty databases in a temporary directory, with the schema of MigrateDatabases()
+func testOpenStore(t *testing.T) *Store {
+	t.Helper()
+	dir := t.TempDir()
+
+	s, err := OpenStore(filepath.Join(dir, "core.db"), filepath.Join(dir, "itdb.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { s.Close() })
+
+	if err := MigrateDatabases(s); err != nil {
+		t.Fatal(err)
+	}
+	return s
+}
+
+// function to open a store like testOpenStore, used as defaultStore for the duration of the test
+// session files and templates are set up as well, so that handlers can be called directly
+func testStore(t *testing.T) *Store {
+	t.Helper()
+	s := testOpenStore(t)
+	dir := t.TempDir()
+
+	previous, previousConfig := defaultStore, config
+	defaultStore = s
+	UsergroupCacheReset()
+	config.SessionDir = dir
+	store = sessions.NewFilesystemStore(dir, []byte("test-session-key"))
+	if err := LoadTemplates(); err != nil {
+		t.Fatal(err)
+	}
+
+	t.Cleanup(func() {
+		defaultStore, config = previous, previousConfig
+		UsergroupCacheReset()
+	})
+	return s
+}
+
+// function to add user username to s, returns its id
+func testUser(t *testing.T, s *Store, username string, usergroup string) string {
+	t.Helper()
+	id, err := s.Users.Create(username, username + "@example.com", usergroup)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return fmt.Sprint(id)
+}
+
+// function to return the cookie of a session holding values
+func testSession(t *testing.T, values map[interface{}]interface{}) []*http.Cookie {
+	t.Helper()
+	r := httptest.NewRequest("GET", "/", nil)
+	w := httptest.NewRecorder()
+
+	session, _ := store.Get(r, "cookie-name")
+	for k, v := range values {
+		session.Values[k] = v
+	}
+	if err := session.Save(r, w); err != nil {
+		t.Fatal(err)
+	}
+	return w.Result().Cookies()
+}
+
+// function to return the values of the session the cookies of w and r belong to
+func testSessionValues(t *testing.T, w *httptest.ResponseRecorder, r *http.Request) map[interface{}]interface{} {
+	t.Helper()
+	// the last cookie set by the response comes first, it replaces any earlier one and the one of the request
+	next := httptest.NewRequest("GET", "/", nil)
+	cookies := w.Result().Cookies()
+	for i := len(cookies) - 1; i >= 0; i-- {
+		next.AddCookie(cookies[i])
+	}
+	for _, c := range r.Cookies() {
+		next.AddCookie(c)
+	}
+
+	session, err := store.Get(next, "cookie-name")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return session.Values
+}
+
+// function to return r as made by user, the way RequireLogin passes it on to the handlers behind it
+func testAsUser(r *http.Request, user CurrentUser) *http.Request {
+	return r.WithContext(context.WithValue(r.Context(), currentUserKey{}, user))
+}
@@ -0,0 +1,167 @@
+// HTML templates and static assets, both built into the binary so that it runs from any directory
+// every page of template/ is parsed once at startup on top of template/layout.html, which holds the <head> and
+// <body> shared by all pages, so a page only defines "content" and, if needed, "title" and "style"
+// in dev mode (-dev) both are read from config.TemplateDir and config.AssetDir instead, and the templates are
+// parsed again as soon as a file there changes
+package main
+
+import (
+	"os"
+	"fmt"
+	"log"
+	"path"
+	"sync"
+	"time"
+	"embed"
+	"io/fs"
+	"html/template"
+)
+
+//go:embed template
+var embeddedTemplates embed.FS
+
+//go:embed asset
+var embeddedAssets embed.FS
+
+const templateLayout = "layout.html"
+
+// parsed pages by name, e.g. "user/index.html"
+var (
+	templateMutex	sync.RWMutex
+	templateCache	map[string]*template.Template
+	templateChanged	time.Time // dev mode, newest modification seen in config.TemplateDir
+)
+
+// stand-ins for the helpers ParseTemplate() binds to each request, parsing only needs their names
+var templateFuncs = template.FuncMap{
+	"csrfToken": func() string { return "" },
+	"csrfField": func() template.HTML { return "" },
+	"impersonationBanner": func() template.HTML { return "" },
+}
+
+// function to return the file system templates are read from
+func templateFS() fs.FS {
+	if config.Dev {
+		return os.DirFS(config.TemplateDir)
+	}
+	sub, _ := fs.Sub(embeddedTemplates, "template")
+	return sub
+}
+
+// function to return the file system "/asset/" is served from
+func assetFS() fs.FS {
+	if config.Dev {
+		return os.DirFS(config.AssetDir)
+	}
+	sub, _ := fs.Sub(embeddedAssets, "asset")
+	return sub
+}
+
+// function to parse every page of fsys, each on its own copy of the layout
+func ParseTemplates(fsys fs.FS) (map[string]*template.Template, error) {
+	layout, err := template.New(templateLayout).Funcs(templateFuncs).ParseFS(fsys, templateLayout)
+	if err != nil {
+		return nil, err
+	}
+
+	templates := map[string]*template.Template{}
+	err = fs.WalkDir(fsys, ".", func(name string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if d.IsDir() || path.Ext(name) != ".html" || name == templateLayout {
+			return nil
+		}
+
+		page, err := layout.Clone()
+		if err != nil {
+			return err
+		}
+		// the page only adds its definitions, executing it still starts at the layout
+		if _, err := page.ParseFS(fsys, name); err != nil {
+			return err
+		}
+		if page.Lookup("content") == nil {
+			return fmt.Errorf("%s does not define \"content\"", name)
+		}
+		templates[name] = page
+		return nil
+	})
+	return templates, err
+}
+
+// function to parse the templates into the cache, called once in main()
+func LoadTemplates() error {
+	changed := templateModTime()
+
+	templates, err := ParseTemplates(templateFS())
+	if err != nil {
+		return err
+	}
+
+	templateMutex.Lock()
+	templateCache = templates
+	templateChanged = changed
+	templateMutex.Unlock()
+	return nil
+}
+
+// function to return a copy of page name ready to be given the helpers of one request
+func lookupTemplate(name string) (*template.Template, error) {
+	if config.Dev {
+		reloadTemplates()
+	}
+
+	templateMutex.RLock()
+	tmpl, ok := templateCache[name]
+	templateMutex.RUnlock()
+	if !ok {
+		return nil, fmt.Errorf("template %s does not exist", name)
+	}
+	return tmpl.Clone()
+}
+
+// function to parse the templates again when a file in config.TemplateDir changed, dev mode only
+// a template that does not parse is logged and the previous ones are kept until the next change
+func reloadTemplates() {
+	changed := templateModTime()
+
+	templateMutex.Lock()
+	if !changed.After(templateChanged) {
+		templateMutex.Unlock()
+		return
+	}
+	templateChanged = changed
+	templateMutex.Unlock()
+
+	templates, err := ParseTemplates(templateFS())
+	if err != nil {
+		log.Println("reloadTemplates() ", err)
+		return
+	}
+
+	templateMutex.Lock()
+	templateCache = templates
+	templateMutex.Unlock()
+	log.Println("templates reloaded")
+}
+
+// function to return the newest modification time in config.TemplateDir, zero unless in dev mode
+// directories count too, so that removing a file is noticed
+func templateModTime() time.Time {
+	var newest time.Time
+	if !config.Dev {
+		return newest
+	}
+
+	fs.WalkDir(templateFS(), ".", func(name string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return nil
+		}
+		if info, err := d.Info(); err == nil && info.ModTime().After(newest) {
+			newest = info.ModTime()
+		}
+		return nil
+	})
+	return newest
+}
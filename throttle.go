@@ -0,0 +1,213 @@
+// login throttling & temporary account lockout
+// failed attempts are counted per username and per client IP in core.db (table login_throttle).
+// both counters impose an exponential back-off; the username counter additionally locks
+// the account for config.LoginLockoutMinutes once it reaches config.LoginMaxFailures
+package main
+
+import (
+	"net"
+	"time"
+	"strings"
+	"net/http"
+	"database/sql"
+)
+
+const (
+	throttleScopeUser = "user"
+	throttleScopeIP = "ip"
+	throttleScopeReset = "reset" // password reset requests per username, apart from logins so they cannot lock the account
+	throttleScopeResetIP = "reset_ip" // password reset requests per client IP, for the same reason
+
+	// back-off kicks in after this many consecutive failures
+	throttleFreeAttempts = 2
+	throttleMaxDelay = 5 * time.Minute
+)
+
+type LoginThrottle struct {
+	Scope		string
+	Subject		string
+	Failures	int
+	LastFailure	time.Time
+	LockedUntil	time.Time
+}
+
+// determines whether the account is currently locked
+func (t LoginThrottle) Locked() bool {
+	return t.LockedUntil.After(time.Now())
+}
+
+// returns how long the subject must wait before trying again
+func (t LoginThrottle) Wait() time.Duration {
+	if t.Locked() {
+		return time.Until(t.LockedUntil)
+	}
+
+	if t.Failures <= throttleFreeAttempts {
+		return 0
+	}
+
+	delay := time.Second << uint(t.Failures-throttleFreeAttempts-1)
+	if delay > throttleMaxDelay || delay <= 0 {
+		delay = throttleMaxDelay
+	}
+
+	wait := time.Until(t.LastFailure.Add(delay))
+	if wait < 0 {
+		return 0
+	}
+	return wait
+}
+
+// function to get client IP address, without port
+func ClientIP(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
+
+// function to return the subject counted for scope, usernames are counted whatever their case or surrounding spaces
+// as the directory accepts "Bob" for "bob", which must not give anyone a fresh counter
+func throttleSubject(scope string, subject string) string {
+	if scope == throttleScopeUser || scope == throttleScopeReset {
+		return strings.ToLower(strings.TrimSpace(subject))
+	}
+	return subject
+}
+
+// function to read counter for given scope and subject
+// returns an empty counter if nothing was recorded yet
+func GetLoginThrottle(scope string, subject string) (LoginThrottle, error) {
+	subject = throttleSubject(scope, subject)
+	t := LoginThrottle{Scope: scope, Subject: subject}
+
+	db := coreDB()
+
+	var lastFailure, lockedUntil int64
+	query := `SELECT failures, last_failure, locked_until FROM login_throttle WHERE scope = ? AND subject = ?`
+	err := db.QueryRow(query, scope, subject).Scan(&t.Failures, &lastFailure, &lockedUntil)
+	if err == sql.ErrNoRows {
+		return t, nil
+	} else if err != nil {
+		return t, err
+	}
+
+	t.LastFailure = time.Unix(lastFailure, 0)
+	t.LockedUntil = time.Unix(lockedUntil, 0)
+
+	return t, nil
+}
+
+// function to return the longest wait of the counters of subjects, a pair of scope and subject each
+func throttleWait(subjects [][2]string) (time.Duration, error) {
+	var wait time.Duration
+	for _, subject := range subjects {
+		t, err := GetLoginThrottle(subject[0], subject[1])
+		if err != nil {
+			return 0, err
+		}
+		if t.Wait() > wait {
+			wait = t.Wait()
+		}
+	}
+	return wait, nil
+}
+
+// returns how long a login attempt for username from ip must wait, 0 if allowed now
+func LoginThrottled(username string, ip string) (time.Duration, error) {
+	return throttleWait([][2]string{{throttleScopeUser, username}, {throttleScopeIP, ip}})
+}
+
+// function to record a failed login for both username and ip
+func LoginFailed(username string, ip string) error {
+	db := coreDB()
+
+	now := time.Now().Unix()
+	query := `INSERT INTO login_throttle (scope, subject, failures, last_failure) VALUES (?, ?, 1, ?)
+		ON CONFLICT (scope, subject) DO UPDATE SET failures = failures + 1, last_failure = excluded.last_failure`
+
+	for _, row := range [][2]string{{throttleScopeUser, username}, {throttleScopeIP, ip}} {
+		_, err := db.Exec(query, row[0], throttleSubject(row[0], row[1]), now)
+		if err != nil {
+			return err
+		}
+	}
+
+	// lock the account once it reaches the limit
+	if config.LoginMaxFailures > 0 {
+		lockedUntil := time.Now().Add(time.Duration(config.LoginLockoutMinutes) * time.Minute).Unix()
+		query = `UPDATE login_throttle SET locked_until = ? WHERE scope = ? AND subject = ? AND failures >= ? AND locked_until < ?`
+		_, err := db.Exec(query, lockedUntil, throttleScopeUser, throttleSubject(throttleScopeUser, username), config.LoginMaxFailures, now)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// returns how long a password reset request for username from ip must wait, 0 if allowed now
+func ResetThrottled(username string, ip string) (time.Duration, error) {
+	return throttleWait([][2]string{{throttleScopeReset, username}, {throttleScopeResetIP, ip}})
+}
+
+// function to record a password reset request for username from ip
+// every request counts, not only those for unknown usernames, so that nobody can flood a mailbox with links
+func ResetRequested(username string, ip string) error {
+	db := coreDB()
+
+	query := `INSERT INTO login_throttle (scope, subject, failures, last_failure) VALUES (?, ?, 1, ?)
+		ON CONFLICT (scope, subject) DO UPDATE SET failures = failures + 1, last_failure = excluded.last_failure`
+
+	for _, row := range [][2]string{{throttleScopeReset, username}, {throttleScopeResetIP, ip}} {
+		_, err := db.Exec(query, row[0], throttleSubject(row[0], row[1]), time.Now().Unix())
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// function to clear counters after a successful login
+func LoginSucceeded(username string, ip string) error {
+	if err := LoginThrottleReset(throttleScopeUser, username); err != nil {
+		return err
+	}
+	return LoginThrottleReset(throttleScopeIP, ip)
+}
+
+// function to remove counter for given scope and subject, also used by admin to unlock an account
+func LoginThrottleReset(scope string, subject string) error {
+	db := coreDB()
+
+	_, err := db.Exec(`DELETE FROM login_throttle WHERE scope = ? AND subject = ?`, scope, throttleSubject(scope, subject))
+	return err
+}
+
+// function to list IP addresses with failed login attempts, most recent first
+func FailedLoginIPs() ([]LoginThrottle, error) {
+	db := coreDB()
+
+	var throttles []LoginThrottle
+
+	query := `SELECT subject, failures, last_failure, locked_until FROM login_throttle WHERE scope = ? AND failures > 0 ORDER BY last_failure DESC`
+	row, err := db.Query(query, throttleScopeIP)
+	if err != nil {
+		return nil, err
+	}
+
+	defer row.Close()
+	for row.Next() {
+		t := LoginThrottle{Scope: throttleScopeIP}
+		var lastFailure, lockedUntil int64
+		err := row.Scan(&t.Subject, &t.Failures, &lastFailure, &lockedUntil)
+		if err != nil {
+			return nil, err
+		}
+		t.LastFailure = time.Unix(lastFailure, 0)
+		t.LockedUntil = time.Unix(lockedUntil, 0)
+		throttles = append(throttles, t)
+	}
+
+	return throttles, row.Err()
+}
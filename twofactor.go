@@ -0,0 +1,574 @@
+// TOTP two-factor authentication (RFC 6238) and recovery codes
+package main
+
+import (
+	"log"
+	"fmt"
+	"time"
+	"strings"
+	"net/url"
+	"net/http"
+	"html/template"
+	"database/sql"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha1"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/base32"
+	"encoding/base64"
+	"encoding/binary"
+	"github.com/gorilla/mux"
+	"github.com/skip2/go-qrcode"
+)
+
+const (
+	totpIssuer = "fragment"
+	totpPeriod = 30
+	totpDigits = 6
+	totpSkew = 1 // number of periods accepted before and after current time
+	recoveryCodeCount = 10
+)
+
+type PageTwoFactorStruct struct {
+	Username		string
+	Usergroup		string
+	Enabled			bool
+	Mandatory		bool
+	LocalAccount	bool // disabling asks for the password, otherwise for a current code
+	Secret			string
+	QRCode			template.URL
+	RecoveryCodes	[]string
+	Message			string
+}
+
+func TwoFactorHandler(r *mux.Router, user *mux.Router) {
+	user.HandleFunc("/2fa", SessionOnly(PageTwoFactor))
+	user.HandleFunc("/2fa/enable", SessionOnly(TwoFactorEnable)).Methods("POST")
+	user.HandleFunc("/2fa/disable", SessionOnly(TwoFactorDisable)).Methods("POST")
+	r.HandleFunc("/user/login/2fa", PageLoginTwoFactor)
+	r.HandleFunc("/user/login/2fa/verify", LoginTwoFactorVerify).Methods("POST")
+	r.HandleFunc("/user/login/2fa/enroll", LoginTwoFactorEnroll).Methods("POST")
+}
+
+func (p PageTwoFactorStruct) UserPermission(permission string, usergroup string) bool {
+	return UsergroupPermission(permission, usergroup)
+}
+
+// "/user/2fa"
+func PageTwoFactor(w http.ResponseWriter, r *http.Request) {
+	user, _ := GetCurrentUser(r)
+	data, err := twoFactorEnrollData(w, r, user.Id, user.Username, user.Usergroup)
+	if err != nil {
+		HTTPError(w, r, err)
+		return
+	}
+	tmpl := ParseTemplate(w, r, "user/twofactor.html")
+	tmpl.Execute(w, data)
+}
+
+// handle confirmation of enrollment from "/user/2fa"
+func TwoFactorEnable(w http.ResponseWriter, r *http.Request) {
+	user, _ := GetCurrentUser(r)
+
+	codes, ok, err := twoFactorConfirmEnrollment(w, r, user.Id)
+	if err != nil {
+		HTTPError(w, r, err)
+		return
+	}
+
+	data, err := twoFactorEnrollData(w, r, user.Id, user.Username, user.Usergroup)
+	if err != nil {
+		HTTPError(w, r, err)
+		return
+	}
+	if ok {
+		data.RecoveryCodes = codes
+		data.Message = "Two-factor authentication enabled"
+	} else {
+		data.Message = "Error. Invalid code, please try again."
+	}
+
+	tmpl := ParseTemplate(w, r, "user/twofactor.html")
+	tmpl.Execute(w, data)
+}
+
+// handle removal of two-factor authentication, requires current password
+// directory and single sign-on accounts have no password here, so they prove a current code instead
+func TwoFactorDisable(w http.ResponseWriter, r *http.Request) {
+	user, _ := GetCurrentUser(r)
+
+	data, err := twoFactorEnrollData(w, r, user.Id, user.Username, user.Usergroup)
+	if err != nil {
+		HTTPError(w, r, err)
+		return
+	}
+
+	valid := false
+	if data.LocalAccount {
+		valid, err = PasswordIsValid(user.Username, r.FormValue("password"))
+	} else {
+		valid, err = TotpVerifyUser(user.Id, strings.TrimSpace(r.FormValue("code")))
+	}
+	if err != nil {
+		HTTPError(w, r, err)
+		return
+	}
+
+	if data.Mandatory {
+		data.Message = "Error. Two-factor authentication is mandatory for your usergroup."
+	} else if !valid && data.LocalAccount {
+		data.Message = "Error. Password is incorrect."
+	} else if !valid {
+		data.Message = "Error. Invalid code."
+	} else {
+		if err := TotpDelete(user.Id); err != nil {
+			HTTPError(w, r, err)
+			return
+		}
+		data, err = twoFactorEnrollData(w, r, user.Id, user.Username, user.Usergroup)
+		if err != nil {
+			HTTPError(w, r, err)
+			return
+		}
+		data.Message = "Two-factor authentication disabled"
+	}
+
+	tmpl := ParseTemplate(w, r, "user/twofactor.html")
+	tmpl.Execute(w, data)
+}
+
+// "/user/login/2fa", second login step after the password was accepted
+func PageLoginTwoFactor(w http.ResponseWriter, r *http.Request) {
+	id, username, ok := pendingLogin(r)
+	if !ok {
+		http.Redirect(w, r, "/", 302)
+		return
+	}
+
+	_, enabled, err := TotpGet(id)
+	if err != nil {
+		HTTPError(w, r, err)
+		return
+	}
+
+	data := PageTwoFactorStruct{Username: username, Enabled: true}
+	if !enabled {
+		// two-factor is mandatory but the user has not enrolled yet
+		usergroup, err := GetUsergroup(id)
+		if err != nil {
+			HTTPError(w, r, err)
+			return
+		}
+		data, err = twoFactorEnrollData(w, r, id, username, usergroup)
+		if err != nil {
+			HTTPError(w, r, err)
+			return
+		}
+		data.Message = "Two-factor authentication is mandatory for your account. Please enroll to continue."
+	}
+
+	tmpl := ParseTemplate(w, r, "login2fa.html")
+	tmpl.Execute(w, data)
+}
+
+// handle the code submitted on "/user/login/2fa"
+func LoginTwoFactorVerify(w http.ResponseWriter, r *http.Request) {
+	id, username, ok := pendingLogin(r)
+	if !ok {
+		http.Redirect(w, r, "/", 302)
+		return
+	}
+
+	ip := ClientIP(r)
+	wait, err := LoginThrottled(username, ip)
+	if err != nil {
+		HTTPError(w, r, err)
+		return
+	}
+	if wait > 0 {
+		data := PageTwoFactorStruct{Username: username, Enabled: true, Message: "too many failed attempts, try again in " + wait.Round(time.Second).String()}
+		tmpl := ParseTemplate(w, r, "login2fa.html")
+		tmpl.Execute(w, data)
+		return
+	}
+
+	code := strings.TrimSpace(r.FormValue("code"))
+	valid, err := TotpVerifyUser(id, code)
+	if err == nil && !valid {
+		valid, err = RecoveryCodeUse(id, code)
+	}
+	if err != nil {
+		HTTPError(w, r, err)
+		return
+	}
+
+	if valid {
+		if err := LoginSucceeded(username, ip); err != nil {
+			HTTPError(w, r, err)
+			return
+		}
+		if err := RecordLoginEvent(r, id, username, loginMethodTwoFactor, true); err != nil {
+			HTTPError(w, r, err)
+			return
+		}
+		if err := loginPendingComplete(w, r); err != nil {
+			HTTPError(w, r, err)
+			return
+		}
+		PageRedirect(w,r)
+	} else {
+		log.Println("two-factor code invalid for", username, "from", ip)
+		if err := LoginFailed(username, ip); err != nil {
+			HTTPError(w, r, err)
+			return
+		}
+		if err := RecordLoginEvent(r, id, username, loginMethodTwoFactor, false); err != nil {
+			HTTPError(w, r, err)
+			return
+		}
+		data := PageTwoFactorStruct{Username: username, Enabled: true, Message: "invalid code"}
+		tmpl := ParseTemplate(w, r, "login2fa.html")
+		tmpl.Execute(w, data)
+	}
+}
+
+// handle enrollment during login when two-factor is mandatory
+func LoginTwoFactorEnroll(w http.ResponseWriter, r *http.Request) {
+	id, username, ok := pendingLogin(r)
+	if !ok {
+		http.Redirect(w, r, "/", 302)
+		return
+	}
+
+	usergroup, err := GetUsergroup(id)
+	if err != nil {
+		HTTPError(w, r, err)
+		return
+	}
+	_, enabled, err := TotpGet(id)
+	if err != nil {
+		HTTPError(w, r, err)
+		return
+	}
+	mandatory, err := TwoFactorMandatory(usergroup)
+	if err != nil {
+		HTTPError(w, r, err)
+		return
+	}
+	// only a user who has to have two-factor and has none may enroll here, anyone else proves a code
+	if enabled || !mandatory {
+		http.Redirect(w, r, "/user/login/2fa", 302)
+		return
+	}
+
+	codes, ok, err := twoFactorConfirmEnrollment(w, r, id)
+	if err != nil {
+		HTTPError(w, r, err)
+		return
+	}
+	if !ok {
+		data, err := twoFactorEnrollData(w, r, id, username, usergroup)
+		if err != nil {
+			HTTPError(w, r, err)
+			return
+		}
+		data.Message = "Error. Invalid code, please try again."
+		tmpl := ParseTemplate(w, r, "login2fa.html")
+		tmpl.Execute(w, data)
+		return
+	}
+
+	if err := LoginSucceeded(username, ClientIP(r)); err != nil {
+		HTTPError(w, r, err)
+		return
+	}
+	if err := RecordLoginEvent(r, id, username, loginMethodTwoFactor, true); err != nil {
+		HTTPError(w, r, err)
+		return
+	}
+	if err := loginPendingComplete(w, r); err != nil {
+		HTTPError(w, r, err)
+		return
+	}
+
+	data := PageTwoFactorStruct{
+		Username: username,
+		Enabled: true,
+		RecoveryCodes: codes,
+		Message: "Two-factor authentication enabled",
+	}
+	tmpl := ParseTemplate(w, r, "login2fa.html")
+	tmpl.Execute(w, data)
+}
+
+// function to prepare page data, generating a new secret in session if user has not enrolled
+// must be called before anything is written to w
+func twoFactorEnrollData(w http.ResponseWriter, r *http.Request, id string, username string, usergroup string) (PageTwoFactorStruct, error) {
+	data := PageTwoFactorStruct{
+		Username: username,
+		Usergroup: usergroup,
+	}
+
+	var err error
+	if data.Mandatory, err = TwoFactorMandatory(usergroup); err != nil {
+		return data, err
+	}
+	source, err := GetUserAuthSource(username)
+	if err != nil {
+		return data, err
+	}
+	data.LocalAccount = source == authSourceLocal
+
+	if _, data.Enabled, err = TotpGet(id); err != nil || data.Enabled {
+		return data, err
+	}
+
+	session, _ := store.Get(r, "cookie-name")
+	secret, _ := session.Values["totp_secret"].(string)
+	if secret == "" {
+		secret = TotpGenerateSecret()
+		session.Values["totp_secret"] = secret
+		session.Save(r, w)
+	}
+
+	data.Secret = secret
+	png, err := qrcode.Encode(TotpURI(secret, username), qrcode.Medium, 256)
+	if err != nil {
+		log.Println("twoFactorEnrollData() ", err)
+	} else {
+		data.QRCode = template.URL("data:image/png;base64," + base64.StdEncoding.EncodeToString(png))
+	}
+
+	return data, nil
+}
+
+// function to verify the code against the secret kept in session and, if valid, store it for user
+// returns the freshly generated recovery codes, false also if user is enrolled already, an existing secret is never replaced
+func twoFactorConfirmEnrollment(w http.ResponseWriter, r *http.Request, id string) ([]string, bool, error) {
+	session, _ := store.Get(r, "cookie-name")
+	secret, _ := session.Values["totp_secret"].(string)
+	if secret == "" {
+		return nil, false, nil
+	}
+
+	step, ok := TotpValidate(secret, strings.TrimSpace(r.FormValue("code")), time.Now())
+	if !ok {
+		return nil, false, nil
+	}
+
+	created, err := TotpCreate(id, secret, step)
+	if err != nil {
+		return nil, false, err
+	}
+	delete(session.Values, "totp_secret")
+	session.Save(r, w)
+	if !created {
+		return nil, false, nil
+	}
+
+	codes, err := RecoveryCodesGenerate(id)
+	return codes, err == nil, err
+}
+
+// determines whether two-factor authentication is mandatory for usergroup
+func TwoFactorMandatory(usergroup string) (bool, error) {
+	if !AccessAdmin(usergroup) {
+		return false, nil
+	}
+	return GetSettingBool(settingRequire2FAAdmin)
+}
+
+// determines whether user must pass the second login step
+func TwoFactorRequired(id string, usergroup string) (bool, error) {
+	_, enabled, err := TotpGet(id)
+	if err != nil || enabled {
+		return enabled, err
+	}
+	return TwoFactorMandatory(usergroup)
+}
+
+// Functions implementing TOTP and its storage
+//
+//
+
+// function to generate a random 160-bit secret, base32 encoded as expected by authenticator apps
+func TotpGenerateSecret() string {
+	b := make([]byte, 20)
+	if _, err := rand.Read(b); err != nil {
+		log.Panic(err)
+	}
+	return base32.StdEncoding.WithPadding(base32.NoPadding).EncodeToString(b)
+}
+
+// function to return otpauth URI, which is what the QR code contains
+func TotpURI(secret string, username string) string {
+	v := url.Values{}
+	v.Set("secret", secret)
+	v.Set("issuer", totpIssuer)
+	v.Set("period", fmt.Sprint(totpPeriod))
+	v.Set("digits", fmt.Sprint(totpDigits))
+	return "otpauth://totp/" + url.PathEscape(totpIssuer+":"+username) + "?" + v.Encode()
+}
+
+// function to calculate the code for given time step (RFC 4226 HOTP with SHA-1)
+func TotpCode(secret string, step int64) (string, error) {
+	key, err := base32.StdEncoding.WithPadding(base32.NoPadding).DecodeString(strings.ToUpper(secret))
+	if err != nil {
+		return "", err
+	}
+
+	msg := make([]byte, 8)
+	binary.BigEndian.PutUint64(msg, uint64(step))
+
+	mac := hmac.New(sha1.New, key)
+	mac.Write(msg)
+	sum := mac.Sum(nil)
+
+	offset := sum[len(sum)-1] & 0x0f
+	value := binary.BigEndian.Uint32(sum[offset:offset+4]) & 0x7fffffff
+
+	mod := uint32(1)
+	for i := 0; i < totpDigits; i++ {
+		mod *= 10
+	}
+
+	return fmt.Sprintf("%0*d", totpDigits, value%mod), nil
+}
+
+// function to validate code at time t, returns the matching time step
+func TotpValidate(secret string, code string, t time.Time) (int64, bool) {
+	if len(code) != totpDigits {
+		return 0, false
+	}
+
+	current := t.Unix() / totpPeriod
+	for step := current - totpSkew; step <= current + totpSkew; step++ {
+		expected, err := TotpCode(secret, step)
+		if err != nil {
+			return 0, false
+		}
+		if hmac.Equal([]byte(expected), []byte(code)) {
+			return step, true
+		}
+	}
+
+	return 0, false
+}
+
+// function to return the secret of user, and whether two-factor is enabled at all
+func TotpGet(id string) (string, bool, error) {
+	db := coreDB()
+
+	secret := ""
+	err := db.QueryRow(`SELECT secret FROM user_totp WHERE user_id = ?`, id).Scan(&secret)
+	if err == sql.ErrNoRows {
+		return "", false, nil
+	} else if err != nil {
+		return "", false, err
+	}
+
+	return secret, true, nil
+}
+
+// function to verify code for user, each time step can only be used once
+func TotpVerifyUser(id string, code string) (bool, error) {
+	secret, enabled, err := TotpGet(id)
+	if err != nil || !enabled {
+		return false, err
+	}
+
+	step, ok := TotpValidate(secret, code, time.Now())
+	if !ok {
+		return false, nil
+	}
+
+	db := coreDB()
+
+	// reject replay of a code that was already used
+	result, err := db.Exec(`UPDATE user_totp SET last_step = ? WHERE user_id = ? AND last_step < ?`, step, id, step)
+	if err != nil {
+		return false, err
+	}
+	affected, err := result.RowsAffected()
+
+	return affected == 1, err
+}
+
+// function to enable two-factor for user with secret, false if user already has one
+// replacing a secret takes TotpDelete() first, see TwoFactorDisable
+func TotpCreate(id string, secret string, step int64) (bool, error) {
+	db := coreDB()
+
+	query := `INSERT INTO user_totp (user_id, secret, last_step, created) VALUES (?, ?, ?, ?) ON CONFLICT (user_id) DO NOTHING`
+	result, err := db.Exec(query, id, secret, step, time.Now().Unix())
+	if err != nil {
+		return false, err
+	}
+	affected, err := result.RowsAffected()
+	return affected == 1, err
+}
+
+// function to remove two-factor authentication and recovery codes of user
+func TotpDelete(id string) error {
+	db := coreDB()
+
+	_, err := db.Exec(`DELETE FROM user_totp WHERE user_id = ?`, id)
+	if err != nil {
+		return err
+	}
+	_, err = db.Exec(`DELETE FROM user_recovery_code WHERE user_id = ?`, id)
+	return err
+}
+
+// recovery codes are random, so a plain SHA-256 is enough to store them
+func recoveryCodeHash(code string) string {
+	normalized := strings.ToLower(strings.ReplaceAll(strings.TrimSpace(code), "-", ""))
+	sum := sha256.Sum256([]byte(normalized))
+	return hex.EncodeToString(sum[:])
+}
+
+// function to replace recovery codes of user, returns the codes in plain text to be shown once
+func RecoveryCodesGenerate(id string) ([]string, error) {
+	db := coreDB()
+
+	_, err := db.Exec(`DELETE FROM user_recovery_code WHERE user_id = ?`, id)
+	if err != nil {
+		return nil, err
+	}
+
+	var codes []string
+	for i := 0; i < recoveryCodeCount; i++ {
+		b := make([]byte, 5)
+		if _, err := rand.Read(b); err != nil {
+			log.Panic(err)
+		}
+		code := hex.EncodeToString(b)
+		code = code[:5] + "-" + code[5:]
+
+		_, err := db.Exec(`INSERT INTO user_recovery_code (user_id, code_hash) VALUES (?, ?)`, id, recoveryCodeHash(code))
+		if err != nil {
+			return nil, err
+		}
+		codes = append(codes, code)
+	}
+
+	return codes, nil
+}
+
+// function to consume a recovery code, returns false if it is unknown or already used
+func RecoveryCodeUse(id string, code string) (bool, error) {
+	if code == "" {
+		return false, nil
+	}
+
+	db := coreDB()
+
+	result, err := db.Exec(`UPDATE user_recovery_code SET used = 1 WHERE user_id = ? AND code_hash = ? AND used = 0`, id, recoveryCodeHash(code))
+	if err != nil {
+		return false, err
+	}
+	affected, err := result.RowsAffected()
+
+	return affected > 0, err
+}
@@ -0,0 +1,198 @@
+package main
+
+import (
+	"time"
+	"encoding/base32"
+	"strings"
+	"testing"
+	"net/url"
+	"net/http"
+	"net/http/httptest"
+)
+
+// function to post code to the enrollment of the login, as the user pending in cookies
+func testEnroll(t *testing.T, cookies []*http.Cookie, code string) (*httptest.ResponseRecorder, *http.Request) {
+	t.Helper()
+	r := httptest.NewRequest("POST", "/user/login/2fa/enroll", strings.NewReader(url.Values{"code": {code}}.Encode()))
+	r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	for _, c := range cookies {
+		r.AddCookie(c)
+	}
+	w := httptest.NewRecorder()
+	LoginTwoFactorEnroll(w, r)
+	return w, r
+}
+
+// function to return a pending login of id whose session was offered secret for enrollment
+func testPendingEnroll(t *testing.T, id string, username string, secret string) []*http.Cookie {
+	return testSession(t, map[interface{}]interface{}{
+		"pending_id": id,
+		"pending_username": username,
+		"pending_since": time.Now().Unix(),
+		"totp_secret": secret,
+	})
+}
+
+func testCode(t *testing.T, secret string) string {
+	t.Helper()
+	code, err := TotpCode(secret, time.Now().Unix() / totpPeriod)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return code
+}
+
+// RFC 6238 appendix B, SHA-1 with the ASCII secret "12345678901234567890", last 6 of the 8 digits listed there
+func TestTotpCode(t *testing.T) {
+	secret := base32.StdEncoding.WithPadding(base32.NoPadding).EncodeToString([]byte("12345678901234567890"))
+	vectors := []struct {
+		unix	int64
+		code	string
+	}{
+		{59, "287082"},
+		{1111111109, "081804"},
+		{1111111111, "050471"},
+		{1234567890, "005924"},
+		{2000000000, "279037"},
+		{20000000000, "353130"},
+	}
+
+	for _, v := range vectors {
+		code, err := TotpCode(secret, v.unix / totpPeriod)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if code != v.code {
+			t.Errorf("TotpCode() at %d = %s, want %s", v.unix, code, v.code)
+		}
+	}
+}
+
+// codes of the neighbouring periods are accepted for clock drift, older ones are not
+func TestTotpValidate(t *testing.T) {
+	secret := base32.StdEncoding.WithPadding(base32.NoPadding).EncodeToString([]byte("12345678901234567890"))
+	now := time.Unix(1111111111, 0)
+	current := now.Unix() / totpPeriod
+
+	for offset := int64(-3); offset <= 3; offset++ {
+		code, err := TotpCode(secret, current + offset)
+		if err != nil {
+			t.Fatal(err)
+		}
+		step, ok := TotpValidate(secret, code, now)
+		want := offset >= -totpSkew && offset <= totpSkew
+		if ok != want || (ok && step != current + offset) {
+			t.Errorf("TotpValidate() of period %+d = %d, %v", offset, step, ok)
+		}
+	}
+
+	if _, ok := TotpValidate(secret, "12345", now); ok {
+		t.Errorf("5-digit code accepted")
+	}
+}
+
+// a password alone must not replace the secret of a user who already has two-factor
+func TestLoginTwoFactorEnrollEnrolledUser(t *testing.T) {
+	s := testStore(t)
+	if err := SetSettingBool(settingRequire2FAAdmin, true); err != nil {
+		t.Fatal(err)
+	}
+	id := testUser(t, s, "alice", "admin")
+
+	victim := TotpGenerateSecret()
+	if _, err := TotpCreate(id, victim, 0); err != nil {
+		t.Fatal(err)
+	}
+
+	attacker := TotpGenerateSecret()
+	w, r := testEnroll(t, testPendingEnroll(t, id, "alice", attacker), testCode(t, attacker))
+
+	if secret, _, _ := TotpGet(id); secret != victim {
+		t.Errorf("secret was replaced")
+	}
+	if auth, _ := testSessionValues(t, w, r)["authenticated"].(bool); auth {
+		t.Errorf("session was authenticated without the enrolled code")
+	}
+}
+
+// enrollment during login is only for usergroups where two-factor is mandatory
+func TestLoginTwoFactorEnrollNotMandatory(t *testing.T) {
+	s := testStore(t)
+	id := testUser(t, s, "bob", "normal")
+
+	secret := TotpGenerateSecret()
+	w, r := testEnroll(t, testPendingEnroll(t, id, "bob", secret), testCode(t, secret))
+
+	if _, enabled, _ := TotpGet(id); enabled {
+		t.Errorf("two-factor was enrolled")
+	}
+	if auth, _ := testSessionValues(t, w, r)["authenticated"].(bool); auth {
+		t.Errorf("session was authenticated")
+	}
+}
+
+func TestLoginTwoFactorEnrollMandatory(t *testing.T) {
+	s := testStore(t)
+	if err := SetSettingBool(settingRequire2FAAdmin, true); err != nil {
+		t.Fatal(err)
+	}
+	id := testUser(t, s, "carol", "admin")
+
+	secret := TotpGenerateSecret()
+	w, r := testEnroll(t, testPendingEnroll(t, id, "carol", secret), testCode(t, secret))
+
+	if stored, _, _ := TotpGet(id); stored != secret {
+		t.Errorf("two-factor was not enrolled")
+	}
+	if auth, _ := testSessionValues(t, w, r)["authenticated"].(bool); !auth {
+		t.Errorf("session was not authenticated")
+	}
+}
+
+func TestLogoutForgetsTotpSecret(t *testing.T) {
+	testStore(t)
+
+	r := httptest.NewRequest("GET", "/user/logout", nil)
+	for _, c := range testSession(t, map[interface{}]interface{}{"totp_secret": TotpGenerateSecret()}) {
+		r.AddCookie(c)
+	}
+	w := httptest.NewRecorder()
+	if err := logout(w, r); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, ok := testSessionValues(t, w, r)["totp_secret"]; ok {
+		t.Errorf("totp_secret kept after logout")
+	}
+}
+
+// function to post form to TwoFactorDisable as user
+func testDisable(t *testing.T, user CurrentUser, form url.Values) {
+	t.Helper()
+	r := httptest.NewRequest("POST", "/user/2fa/disable", strings.NewReader(form.Encode()))
+	r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	TwoFactorDisable(httptest.NewRecorder(), testAsUser(r, user))
+}
+
+// an account without local password proves a current code, an empty password must not do
+func TestTwoFactorDisableExternalAccount(t *testing.T) {
+	s := testStore(t)
+	id := testUser(t, s, "dave", "normal")
+	if _, err := s.Core.Exec(`UPDATE user SET auth_source = ? WHERE id = ?`, authSourceLDAP, id); err != nil {
+		t.Fatal(err)
+	}
+	secret := TotpGenerateSecret()
+	if _, err := TotpCreate(id, secret, 0); err != nil {
+		t.Fatal(err)
+	}
+
+	testDisable(t, CurrentUser{id, "dave", "normal"}, url.Values{"password": {""}})
+	if _, enabled, _ := TotpGet(id); !enabled {
+		t.Fatalf("disabled without a code")
+	}
+
+	testDisable(t, CurrentUser{id, "dave", "normal"}, url.Values{"code": {testCode(t, secret)}})
+	if _, enabled, _ := TotpGet(id); enabled {
+		t.Errorf("not disabled with a current code")
+	}
+}
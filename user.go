@@ -1,11 +1,10 @@
 package main
 
 import (
-	"fmt"
 	"log"
+	"time"
+	"errors"
 	"net/http"
-	"html/template"
-	"database/sql"
 	"github.com/gorilla/mux"
 	_ "github.com/gorilla/sessions"
 	_ "github.com/mattn/go-sqlite3"
@@ -21,6 +20,10 @@ type PageAccountStruct struct {
 	Username	string
 	Email		string
 	Usergroup	string
+	DisplayName	string
+	PhoneExt	string
+	AuthSource	string
+	Message		string
 }
 
 type PagePasswordStruct struct {
@@ -28,97 +31,170 @@ type PagePasswordStruct struct {
 	Message		string
 }
 
-func UserHandler(r *mux.Router) {
-	r.HandleFunc("/user", PageUser)
+// user is the "/user" subrouter for logged in users, login and logout stay on r
+func UserHandler(r *mux.Router, user *mux.Router, s *Store) {
+	user.HandleFunc("", PageUser)
 	//r.HandleFunc("/user/login", UserLogin).Methods("POST")
 	r.HandleFunc("/user/login", UserLogin)
-	r.HandleFunc("/user/account", PageAccount)
-	r.HandleFunc("/user/password", PageUpdatePassword)
-	r.HandleFunc("/user/password/update", UserUpdatePassword)
+	user.HandleFunc("/account", PageAccount(s))
+	user.HandleFunc("/password", RequireOwnPassword(PageUpdatePassword))
+	user.HandleFunc("/password/update", RequireOwnPassword(UserUpdatePassword)).Methods("POST")
 	r.HandleFunc("/user/logout", UserLogout)
 }
 
 func UserLogin(w http.ResponseWriter, r *http.Request) {
 	if r.Method != http.MethodPost {
 		PageIndexRedirect(w,r)
+		return
 	}
 
-	if UsernameExist(r.FormValue("username")) {
-		if PasswordIsValid(r.FormValue("username"), r.FormValue("password")) {
-			// obtain id and username, to be put in session
-			username := r.FormValue("username")
-			id := GetUserId(username)
-
-			login(w,r,id,username)
+	SetLoginNext(w, r, r.FormValue("next"))
 
-			PageRedirect(w,r)
-		} else {
-			// redirect user back to login
-			fmt.Println("password invalid")
-			PageIndexRedirect(w,r)
+	ip := ClientIP(r)
+	wait, err := LoginThrottled(r.FormValue("username"), ip)
+	if err != nil {
+		HTTPError(w, r, err)
+		return
+	}
+	if wait > 0 {
+		log.Println("login throttled for", r.FormValue("username"), "from", ip)
+		if err := RecordLoginFailure(r, r.FormValue("username"), loginMethodPassword); err != nil {
+			HTTPError(w, r, err)
+			return
 		}
-	} else {
+		PageIndex("too many failed attempts, try again in " + wait.Round(time.Second).String())(w,r)
+		return
+	}
+
+	// only refused credentials count as a failed attempt, a failing backend says nothing about them
+	identity, err := Authenticate(r.FormValue("username"), r.FormValue("password"))
+	if errors.Is(err, ErrInvalidCredentials) {
 		// redirect user back to login
-		fmt.Println("username invalid")
+		log.Println("login failed for", r.FormValue("username"), "from", ip)
+		if err := LoginFailed(r.FormValue("username"), ip); err != nil {
+			HTTPError(w, r, err)
+			return
+		}
+		if err := RecordLoginFailure(r, r.FormValue("username"), loginMethodPassword); err != nil {
+			HTTPError(w, r, err)
+			return
+		}
 		PageIndexRedirect(w,r)
+		return
+	} else if err != nil {
+		HTTPError(w, r, err)
+		return
+	}
+
+	// obtain id and username, to be put in session
+	username := identity.Username
+	id, err := GetUserId(username)
+	if err != nil {
+		HTTPError(w, r, err)
+		return
+	}
+
+	disabled, err := UserDisabled(id)
+	if err != nil {
+		HTTPError(w, r, err)
+		return
+	}
+	if disabled {
+		log.Println("login refused for disabled account", username, "from", ip)
+		if err := RecordLoginEvent(r, id, username, loginMethodPassword, false); err != nil {
+			HTTPError(w, r, err)
+			return
+		}
+		PageIndex("your account is disabled, please contact your administrator")(w,r)
+		return
+	}
+
+	usergroup, err := GetUsergroup(id)
+	if err != nil {
+		HTTPError(w, r, err)
+		return
+	}
+
+	// second step, see twofactor.go
+	required, err := TwoFactorRequired(id, usergroup)
+	if err != nil {
+		HTTPError(w, r, err)
+		return
+	}
+	if required {
+		loginPending(w,r,id,username)
+		http.Redirect(w, r, "/user/login/2fa", 302)
+		return
+	}
+
+	// the counter is the one LoginFailed() above adds to, a directory may return the username in another form
+	if err := LoginSucceeded(r.FormValue("username"), ip); err != nil {
+		HTTPError(w, r, err)
+		return
+	}
+	if err := RecordLoginEvent(r, id, username, loginMethodPassword, true); err != nil {
+		HTTPError(w, r, err)
+		return
+	}
+	if err := login(w,r,id,username); err != nil {
+		HTTPError(w, r, err)
+		return
 	}
+
+	PageRedirect(w,r)
 }
 
 func UserLogout(w http.ResponseWriter, r *http.Request) {
-	logout(w,r)
+	if err := logout(w,r); err != nil {
+		HTTPError(w, r, err)
+		return
+	}
 	http.Redirect(w, r, "/", 302)
 }
 
+// redirect after login, to the page the user asked for before logging in if any
 func PageRedirect(w http.ResponseWriter, r *http.Request) {
-	http.Redirect(w, r, "/user", 302)
+	http.Redirect(w, r, LoginNext(w,r), 302)
 }
 
 func PageUser(w http.ResponseWriter, r *http.Request) {
-	if IsAuthenticated(w,r) {
-		tmpl := template.Must(template.ParseFiles("template/user/index.html"))
+	tmpl := ParseTemplate(w, r, "user/index.html")
 
-		session, _ := store.Get(r, "cookie-name")
-		username := session.Values["username"].(string)
-		loggedon := session.Values["loggedon"].(string)
+	session, _ := store.Get(r, "cookie-name")
+	user, _ := GetCurrentUser(r)
+	loggedon, _ := session.Values["loggedon"].(string)
 
-		data := PageUserStruct{
-			username,
-			loggedon,
-		}
-		tmpl.Execute(w, data)
-	} else {
-		http.Redirect(w, r, "/", 302)
+	data := PageUserStruct{
+		user.Username,
+		loggedon,
 	}
+	tmpl.Execute(w, data)
 }
 
-func PageAccount(w http.ResponseWriter, r *http.Request) {
-	if IsAuthenticated(w,r) {
-		session, _ := store.Get(r, "cookie-name")
-		data := ReadUserAccount(session.Values["username"].(string))
-		tmpl := template.Must(template.ParseFiles("template/user/account.html"))
+func PageAccount(s *Store) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		user, _ := GetCurrentUser(r)
+		data, err := s.Users.Account(user.Username)
+		if err != nil {
+			HTTPError(w, r, err)
+			return
+		}
+		tmpl := ParseTemplate(w, r, "user/account.html")
 		tmpl.Execute(w, data)
-	} else {
-		http.Redirect(w, r, "/", 302)
 	}
 }
 
 func PageUpdatePassword(w http.ResponseWriter, r *http.Request) {	
-	if IsAuthenticated(w,r) {
-		session, _ := store.Get(r, "cookie-name")
-		username := session.Values["username"].(string)
-
-		data := PagePasswordStruct{username, ""}
+	session, _ := store.Get(r, "cookie-name")
+	user, _ := GetCurrentUser(r)
 
-		if UpdateOwnPassword(GetUsergroup(GetUserId(username))) {	
-			tmpl := template.Must(template.ParseFiles("template/user/password.html"))
-			tmpl.Execute(w, data)
-		} else {
-			//NOTE: assuming user previously came from "/user/account"
-			http.Redirect(w, r, "/user/account", 302)
-		}
-	} else {
-		http.Redirect(w, r, "/", 302)
+	data := PagePasswordStruct{user.Username, ""}
+	if mustChange, _ := session.Values["must_change_password"].(bool); mustChange {
+		data.Message = "Your password has to be changed before continuing."
 	}
+
+	tmpl := ParseTemplate(w, r, "user/password.html")
+	tmpl.Execute(w, data)
 }
 
 func (p PageAccountStruct) UserPermission(permission string, usergroup string) bool {
@@ -127,201 +203,160 @@ func (p PageAccountStruct) UserPermission(permission string, usergroup string) b
 
 // this particular functions, unlike most UserPermission function, take username as the second parameter
 // because its struct do not have usergroup defined. See PageUserStruct.
-func (p PageUserStruct) UserPermission(permission string, username string) bool {
-	usergroup := GetUsergroup(GetUserId(username))
-	return UsergroupPermission(permission, usergroup)
+func (p PageUserStruct) UserPermission(permission string, username string) (bool, error) {
+	usergroup, err := GetUsergroupByUsername(username)
+	if err != nil {
+		return false, err
+	}
+	return UsergroupPermission(permission, usergroup), nil
 }
 
-func (p PagePasswordStruct) UserPermission(permission string, username string) bool {
-	usergroup := GetUsergroup(GetUserId(username))
-	return UsergroupPermission(permission, usergroup)
+func (p PagePasswordStruct) UserPermission(permission string, username string) (bool, error) {
+	usergroup, err := GetUsergroupByUsername(username)
+	if err != nil {
+		return false, err
+	}
+	return UsergroupPermission(permission, usergroup), nil
+}
+
+func (p PagePasswordStruct) Policy() string {
+	return PasswordPolicyDescription()
 }
 
 // performs password update procedure
+// the account is always the one logged in, never taken from the form
 func UserUpdatePassword(w http.ResponseWriter, r *http.Request) {
-	if IsAuthenticated(w,r) {
-		username := r.FormValue("username")
-
-		if UsernameExist(username) {
-			oldpassword := r.FormValue("oldpassword")
-
-			if PasswordIsValid(username, oldpassword) {
-				newpassword := r.FormValue("newpassword")
-				confirmpassword := r.FormValue("confirmpassword")
-
-				if newpassword==confirmpassword {
-					id := GetUserId(username)
-
-					// begin procedure of updating password
-					db, errOpen := sql.Open("sqlite3", "./database/core.db")
-					if errOpen != nil {
-						log.Fatal(errOpen)
-					}
-					defer db.Close()
-
-					query := `UPDATE user SET password = ? WHERE id = ?`
-					_, err := db.Exec(query, newpassword, id)
-					if err != nil {
-						log.Fatal(err)
-					}
-					// success
-					data := PagePasswordStruct{username, "Password update success"}
-
-					tmpl := template.Must(template.ParseFiles("template/user/password.html"))
-					tmpl.Execute(w, data)
-				} else {
-					data := PagePasswordStruct{username, "Error. Invalid password confirmation."}
-		
-					tmpl := template.Must(template.ParseFiles("template/user/password.html"))
-					tmpl.Execute(w, data)
-				}
+	user, _ := GetCurrentUser(r)
+
+	exists, err := UsernameExist(user.Username)
+	if err != nil {
+		HTTPError(w, r, err)
+		return
+	}
+
+	if exists {
+		oldpassword := r.FormValue("oldpassword")
+
+		valid, err := PasswordIsValid(user.Username, oldpassword)
+		if err != nil {
+			HTTPError(w, r, err)
+			return
+		}
+
+		if valid {
+			newpassword := r.FormValue("newpassword")
+			confirmpassword := r.FormValue("confirmpassword")
+
+
+			if newpassword!=confirmpassword {
+				data := PagePasswordStruct{user.Username, "Error. Invalid password confirmation."}
+
+				tmpl := ParseTemplate(w, r, "user/password.html")
+				tmpl.Execute(w, data)
+			} else if errPolicy := PasswordPolicyCheck(user.Username, newpassword); errPolicy != nil {
+				data := PagePasswordStruct{user.Username, "Error. " + errPolicy.Error() + "."}
+
+				tmpl := ParseTemplate(w, r, "user/password.html")
+				tmpl.Execute(w, data)
+			} else if reused, err := PasswordReused(user.Id, newpassword); err != nil {
+				HTTPError(w, r, err)
+			} else if reused {
+				data := PagePasswordStruct{user.Username, "Error. Password was used recently, please choose another."}
+
+				tmpl := ParseTemplate(w, r, "user/password.html")
+				tmpl.Execute(w, data)
 			} else {
-				data := PagePasswordStruct{username, "Error. Old password is incorrect."}
+				// begin procedure of updating password
+				err := SetPassword(user.Id, newpassword, false)
+				if err != nil {
+					HTTPError(w, r, err)
+					return
+				}
 
-				tmpl := template.Must(template.ParseFiles("template/user/password.html"))
+				if err := AuditLog(r, user.Username, auditEntityUser, user.Id, "password", nil, nil); err != nil {
+					HTTPError(w, r, err)
+					return
+				}
+
+				session, _ := store.Get(r, "cookie-name")
+				session.Values["must_change_password"] = false
+				session.Save(r, w)
+
+				// success
+				data := PagePasswordStruct{user.Username, "Password update success"}
+
+				tmpl := ParseTemplate(w, r, "user/password.html")
 				tmpl.Execute(w, data)
 			}
 		} else {
-			data := PagePasswordStruct{"", "Error. Username invalid. Please consider relogin."}
+			data := PagePasswordStruct{user.Username, "Error. Old password is incorrect."}
 
-			tmpl := template.Must(template.ParseFiles("template/user/password.html"))
+			tmpl := ParseTemplate(w, r, "user/password.html")
 			tmpl.Execute(w, data)
 		}
 	} else {
-		http.Redirect(w, r, "/", 302)
+		data := PagePasswordStruct{"", "Error. Username invalid. Please consider relogin."}
+
+		tmpl := ParseTemplate(w, r, "user/password.html")
+		tmpl.Execute(w, data)
 	}
 
 }
 
 // function to verify whether the username exist or not
-func UsernameExist(username string) bool {
-	// Connect to SQLite database
-	db, errOpen := sql.Open("sqlite3", "./database/core.db")
-	if errOpen != nil {
-		log.Fatal(errOpen)
-	}
-	defer db.Close()
-
-	query := `SELECT COUNT(*) FROM user WHERE username = ?`
-	var count int
-	errQuery := db.QueryRow(query, username).Scan(&count)
-	if errQuery != nil {
-		log.Fatal(errQuery)
-	}
-
-	// If count > 0, the username exists
-	return count > 0
+func UsernameExist(username string) (bool, error) {
+	return defaultStore.Users.Exists(username)
 }
 
-// function to validate password
-func PasswordIsValid(username string, password string) bool {
-	// Connect to SQLite database
-	db, errOpen := sql.Open("sqlite3", "./database/core.db")
-	if errOpen != nil {
-		log.Fatal(errOpen)
-	}
-	defer db.Close()
-
-	query := `SELECT password FROM user WHERE username = ?`
-	password_hash := ""
-	err := db.QueryRow(query, username).Scan(&password_hash)
-	if err == sql.ErrNoRows {
-		return false
-	} else if err != nil {
-		log.Fatal(err)
-		return false
+// function to validate password, false for an unknown username
+func PasswordIsValid(username string, password string) (bool, error) {
+	password_hash, err := defaultStore.Users.PasswordHash(username)
+	if err != nil {
+		return false, err
 	}
 
 	// check if given password same with in the table
-	if password == password_hash {
-		return true
-	} else {
-		return false
-	}
+	return PasswordMatch(password_hash, password), nil
 }
 
-// function to get id based on username
-func GetUserId(username string) string {
-	strId := ""
-
-	db, errOpen := sql.Open("sqlite3", "./database/core.db")
-	if errOpen != nil {
-		log.Fatal(errOpen)
-	}
-	defer db.Close()
-
-	query := `SELECT id FROM user WHERE username = ?`
-	err := db.QueryRow(query, username).Scan(&strId)
-
-	if err == sql.ErrNoRows {
-		log.Fatal(err)
-		return ""
-	} else if err != nil {
-		log.Fatal(err)
-		return ""
-	}
-
-	return strId
+// function to get id based on username, sql.ErrNoRows if there is no such user
+func GetUserId(username string) (string, error) {
+	return defaultStore.Users.Id(username)
 }
 
-// function to get usergroup based on id
-func GetUsergroup(id string) string {
-	strUsergroup := ""
+// function to get username based on id, empty if the user no longer exists
+func GetUsername(id string) (string, error) {
+	return defaultStore.Users.Username(id)
+}
 
-	db, errOpen := sql.Open("sqlite3", "./database/core.db")
-	if errOpen != nil {
-		log.Fatal(errOpen)
-	}
-	defer db.Close()
+// determines whether the account of user id has been disabled by an admin
+func UserDisabled(id string) (bool, error) {
+	return defaultStore.Users.Disabled(id)
+}
 
-	query := `SELECT usergroup FROM user WHERE id = ?`
-	err := db.QueryRow(query, id).Scan(&strUsergroup)
+// function to get usergroup based on id, sql.ErrNoRows if there is no such user
+func GetUsergroup(id string) (string, error) {
+	return defaultStore.Users.Usergroup(id)
+}
 
-	if err == sql.ErrNoRows {
-		log.Fatal(err)
-		return ""
-	} else if err != nil {
-		log.Fatal(err)
-		return ""
+// function to get usergroup of username, sql.ErrNoRows if there is no such user
+func GetUsergroupByUsername(username string) (string, error) {
+	id, err := GetUserId(username)
+	if err != nil {
+		return "", err
 	}
-
-	return strUsergroup
+	return GetUsergroup(id)
 }
 
-// get username and usergroup from session
-func GetUserSession(r *http.Request) (string, string) {
+// get username and usergroup from session, only after IsAuthenticated()
+func GetUserSession(r *http.Request) (string, string, error) {
 	session, _ := store.Get(r, "cookie-name")
-	username := session.Values["username"].(string)
-	usergroup := GetUsergroup(GetUserId(username))
-	return username, usergroup
+	username, _ := session.Values["username"].(string)
+	usergroup, err := GetUsergroupByUsername(username)
+	return username, usergroup, err
 }
 
-// function to get basic user info from db based on username
-func ReadUserAccount(username string) PageAccountStruct {
-	data := PageAccountStruct{
-		"",
-		username,
-		"",
-		"",
-	}
-
-	// Connect to SQLite database
-	db, errOpen := sql.Open("sqlite3", "./database/core.db")
-	if errOpen != nil {
-		log.Fatal(errOpen)
-	}
-	defer db.Close()
-
-	query := `SELECT id, email, usergroup FROM user WHERE username = ?`
-	err := db.QueryRow(query, data.Username).Scan(&data.Id, &data.Email, &data.Usergroup)
-
-	if err == sql.ErrNoRows {
-		fmt.Println("serious error")
-		//return false
-	} else if err != nil {
-		log.Fatal(err)
-		//return false
-	}
-
-	return data
-}
\ No newline at end of file
+// function to get basic user info from db based on username, sql.ErrNoRows if there is no such user
+func ReadUserAccount(username string) (PageAccountStruct, error) {
+	return defaultStore.Users.Account(username)
+}
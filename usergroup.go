@@ -1,6 +1,18 @@
 // user group definition, rights, policies & access control
+// usergroups (roles) and the permissions granted to them are stored in core.db (tables usergroup and
+// usergroup_permission) and kept in memory, so checking a permission does not touch the database
 package main
 
+import (
+	"log"
+	"sync"
+	"errors"
+	"regexp"
+	"net/http"
+	"database/sql"
+	"github.com/gorilla/mux"
+)
+
 // standard terms...
 // CREATE = new, add
 // READ = get
@@ -13,77 +25,439 @@ type GroupPermission interface {
 	UserPermission() bool
 }
 
+// permission checked somewhere in the code, only these can be granted
+type Permission struct {
+	Name		string
+	Description	string
+}
+
+var permissions = []Permission{
+	{"update_own_password", "update own account password"},
+	{"update_user_password", "update other user's password"},
+	{"access_admin", "access admin pages"},
+	{"access_itdb", "access itdb system"},
+	{"itdb_read_sibu", "view Sibu PCs and printers"},
+	{"itdb_write_sibu", "add and edit Sibu PCs and printers"},
+	{"itdb_delete_sibu", "delete Sibu PCs"},
+	{"itdb_read_kapit", "view Kapit PCs and printers"},
+	{"itdb_write_kapit", "add and edit Kapit PCs and printers"},
+	{"itdb_delete_kapit", "delete Kapit PCs"},
+}
+
+type Usergroup struct {
+	Name		string
+	Description	string
+	Permissions	map[string]bool
+	Members		int
+}
+
+// granted permissions per usergroup, loaded on first use and dropped whenever grants change
+var (
+	usergroupMutex	sync.RWMutex
+	usergroupCache	map[string]map[string]bool
+)
+
+var usergroupNamePattern = regexp.MustCompile(`^[a-z0-9_-]{1,32}$`)
+
+var ErrUsergroupInUse = errors.New("usergroup still has users")
+
+type PageUsergroupStruct struct {
+	Username	string
+	Usergroup	string
+	Usergroups	[]Usergroup
+	Permissions	[]Permission
+	Message		string
+}
+
+func UsergroupHandler(admin *mux.Router) {
+	admin.HandleFunc("/usergroup", PageAdminUsergroup)
+	admin.HandleFunc("/usergroup/new", AdminUsergroupNew).Methods("POST")
+	admin.HandleFunc("/usergroup/update/{name}", AdminUsergroupUpdate).Methods("POST")
+	admin.HandleFunc("/usergroup/delete/{name}", AdminUsergroupDelete).Methods("POST")
+}
+
+func (p PageUsergroupStruct) UserPermission(permission string, usergroup string) bool {
+	return UsergroupPermission(permission, usergroup)
+}
+
+// "/admin/usergroup"
+func PageAdminUsergroup(w http.ResponseWriter, r *http.Request) {
+	user, _ := GetCurrentUser(r)
+	renderAdminUsergroup(w, r, user.Username, user.Usergroup, "")
+}
+
+// handle the new usergroup form on "/admin/usergroup"
+func AdminUsergroupNew(w http.ResponseWriter, r *http.Request) {
+	user, _ := GetCurrentUser(r)
+	name := r.FormValue("name")
+	description := r.FormValue("description")
+
+	message := ""
+	if !usergroupNamePattern.MatchString(name) {
+		message = "Error. Name must be 1 to 32 lowercase letters, digits, - or _."
+	} else if err := CreateUsergroup(name, description); err != nil {
+		log.Println("AdminUsergroupNew() ", err)
+		message = "Error. Unable to create usergroup, the name may already exist."
+	} else {
+		after, err := AuditUsergroup(name)
+		if err != nil {
+			HTTPError(w, r, err)
+			return
+		}
+		if err := AuditLog(r, user.Username, auditEntityUsergroup, name, auditActionCreate, nil, after); err != nil {
+			HTTPError(w, r, err)
+			return
+		}
+		message = "Usergroup " + name + " created"
+	}
+
+	renderAdminUsergroup(w, r, user.Username, user.Usergroup, message)
+}
+
+// handle the permission checkboxes of one usergroup
+func AdminUsergroupUpdate(w http.ResponseWriter, r *http.Request) {
+	user, _ := GetCurrentUser(r)
+	name := mux.Vars(r)["name"]
+	r.ParseForm()
+
+	granted := map[string]bool{}
+	for _, p := range r.PostForm["permission"] {
+		granted[p] = true
+	}
+
+	// an admin grants only what its own usergroup holds, and leaves alone usergroups holding more
+	exceeds := !UsergroupCovers(user.Usergroup, name)
+	for _, p := range permissions {
+		if granted[p.Name] && !UsergroupPermission(p.Name, user.Usergroup) {
+			exceeds = true
+		}
+	}
+
+	admins := 1
+	if AccessAdmin(name) && !granted["access_admin"] {
+		var err error
+		admins, err = ActiveAdminCountOutside(name)
+		if err != nil {
+			HTTPError(w, r, err)
+			return
+		}
+	}
+
+	message := ""
+	if name == user.Usergroup && !granted["access_admin"] {
+		// would lock the admin out of this very page
+		message = "Error. Cannot remove access_admin from your own usergroup."
+	} else if exceeds {
+		message = "Error. " + ErrPermissionExceeded.Error() + "."
+	} else if admins == 0 {
+		message = "Error. " + ErrLastAdmin.Error() + "."
+	} else {
+		before, err := AuditUsergroup(name)
+		if err != nil {
+			HTTPError(w, r, err)
+			return
+		}
+		if err := SetUsergroupPermissions(name, r.FormValue("description"), granted); err != nil {
+			log.Println("AdminUsergroupUpdate() ", err)
+			message = "Error. Unable to update usergroup " + name + "."
+		} else {
+			after, err := AuditUsergroup(name)
+			if err != nil {
+				HTTPError(w, r, err)
+				return
+			}
+			if err := AuditLog(r, user.Username, auditEntityUsergroup, name, auditActionUpdate, before, after); err != nil {
+				HTTPError(w, r, err)
+				return
+			}
+			message = "Usergroup " + name + " updated"
+		}
+	}
+
+	renderAdminUsergroup(w, r, user.Username, user.Usergroup, message)
+}
+
+// handle deletion of a usergroup, only allowed when nobody belongs to it
+func AdminUsergroupDelete(w http.ResponseWriter, r *http.Request) {
+	user, _ := GetCurrentUser(r)
+	name := mux.Vars(r)["name"]
+
+	message := ""
+	before, err := AuditUsergroup(name)
+	if err != nil {
+		HTTPError(w, r, err)
+		return
+	}
+	if err := DeleteUsergroup(name); err == ErrUsergroupInUse {
+		message = "Error. " + err.Error() + "."
+	} else if err != nil {
+		HTTPError(w, r, err)
+		return
+	} else if err := AuditLog(r, user.Username, auditEntityUsergroup, name, auditActionDelete, before, nil); err != nil {
+		HTTPError(w, r, err)
+		return
+	} else {
+		message = "Usergroup " + name + " deleted"
+	}
+
+	renderAdminUsergroup(w, r, user.Username, user.Usergroup, message)
+}
+
+func renderAdminUsergroup(w http.ResponseWriter, r *http.Request, username string, usergroup string, message string) {
+	usergroups, err := GetUsergroups()
+	if err != nil {
+		HTTPError(w, r, err)
+		return
+	}
+	data := PageUsergroupStruct{
+		username,
+		usergroup,
+		usergroups,
+		permissions,
+		message,
+	}
+	tmpl := ParseTemplate(w, r, "admin/usergroup.html")
+	tmpl.Execute(w, data)
+}
+
+// Functions that handles process and procedures and does not involve returning HTML page
+//
+//
+
+// a permission which cannot be looked up is denied, the failure is logged
 func UsergroupPermission(permission string, usergroup string) bool {
-	switch permission {
-	case "update_own_password":
-		return UpdateOwnPassword(usergroup)
-	case "update_user_password":
-		return UpdateUserPassword(usergroup)
-	case "access_admin":
-		return AccessAdmin(usergroup)
-	case "access_itdb":
-		return AccessITDB(usergroup)
-	default:
-		return false
+	usergroupMutex.RLock()
+	cache := usergroupCache
+	usergroupMutex.RUnlock()
+
+	if cache == nil {
+		var err error
+		cache, err = loadUsergroupCache()
+		if err != nil {
+			log.Println("UsergroupPermission() ", err)
+			return false
+		}
 	}
+
+	return cache[usergroup][permission]
+}
+
+// function to tell whether usergroup holds every permission other holds, so that acting as, assigning or
+// granting other does not give an admin of usergroup more than it already has
+func UsergroupCovers(usergroup string, other string) bool {
+	for _, p := range permissions {
+		if UsergroupPermission(p.Name, other) && !UsergroupPermission(p.Name, usergroup) {
+			return false
+		}
+	}
+	return true
+}
+
+func loadUsergroupCache() (map[string]map[string]bool, error) {
+	usergroupMutex.Lock()
+	defer usergroupMutex.Unlock()
+
+	if usergroupCache != nil {
+		return usergroupCache, nil
+	}
+
+	db := coreDB()
+
+	cache := map[string]map[string]bool{}
+
+	row, err := db.Query(`SELECT usergroup, permission FROM usergroup_permission`)
+	if err != nil {
+		return nil, err
+	}
+
+	defer row.Close()
+	for row.Next() {
+		var usergroup, permission string
+		if err := row.Scan(&usergroup, &permission); err != nil {
+			return nil, err
+		}
+		if cache[usergroup] == nil {
+			cache[usergroup] = map[string]bool{}
+		}
+		cache[usergroup][permission] = true
+	}
+	if err := row.Err(); err != nil {
+		return nil, err
+	}
+
+	usergroupCache = cache
+	return cache, nil
+}
+
+// function to drop cached grants, the next permission check reloads them
+func UsergroupCacheReset() {
+	usergroupMutex.Lock()
+	usergroupCache = nil
+	usergroupMutex.Unlock()
 }
 
 // returns brief description about usergroup
-func UsergroupDefinition(usergroup string) string {
-	switch usergroup {
-	case "normal":
-		return "Common user and is allowed to access most features that does not involve users management and system management"
-	case "admin":
-		return "Powerful user with extended privileges and able to manage other users, subsystem, and many more"
-	default:
-		return "No usergroup is defined for this " + usergroup
+func UsergroupDefinition(usergroup string) (string, error) {
+	usergroups, err := GetUsergroups()
+	if err != nil {
+		return "", err
+	}
+	for _, g := range usergroups {
+		if g.Name == usergroup {
+			return g.Description, nil
+		}
+	}
+	return "No usergroup is defined for this " + usergroup, nil
+}
+
+// function to list every usergroup with its grants and number of users
+func GetUsergroups() ([]Usergroup, error) {
+	db := coreDB()
+
+	var usergroups []Usergroup
+
+	query := `SELECT g.name, g.description, (SELECT COUNT(*) FROM user u WHERE u.usergroup = g.name) FROM usergroup g ORDER BY g.name`
+	row, err := db.Query(query)
+	if err != nil {
+		return nil, err
+	}
+
+	defer row.Close()
+	for row.Next() {
+		g := Usergroup{Permissions: map[string]bool{}}
+		if err := row.Scan(&g.Name, &g.Description, &g.Members); err != nil {
+			return nil, err
+		}
+		for _, p := range permissions {
+			g.Permissions[p.Name] = UsergroupPermission(p.Name, g.Name)
+		}
+		usergroups = append(usergroups, g)
+	}
+
+	return usergroups, row.Err()
+}
+
+// determines whether usergroup exists
+func UsergroupExist(usergroup string) (bool, error) {
+	exists := false
+	err := coreDB().QueryRow(`SELECT EXISTS (SELECT 1 FROM usergroup WHERE name = ?)`, usergroup).Scan(&exists)
+	return exists, err
+}
+
+// function to create a usergroup without any permission
+func CreateUsergroup(name string, description string) error {
+	db := coreDB()
+
+	_, err := db.Exec(`INSERT INTO usergroup (name, description) VALUES (?, ?)`, name, description)
+	return err
+}
+
+// function to replace description and permissions of usergroup, unknown permissions are ignored
+func SetUsergroupPermissions(name string, description string, granted map[string]bool) error {
+	db := coreDB()
+	defer UsergroupCacheReset()
+
+	tx, err := db.Begin()
+	if err != nil {
+		return err
 	}
+	defer tx.Rollback()
+
+	result, err := tx.Exec(`UPDATE usergroup SET description = ? WHERE name = ?`, description, name)
+	if err != nil {
+		return err
+	}
+	if affected, _ := result.RowsAffected(); affected == 0 {
+		return sql.ErrNoRows
+	}
+
+	if _, err := tx.Exec(`DELETE FROM usergroup_permission WHERE usergroup = ?`, name); err != nil {
+		return err
+	}
+	for _, p := range permissions {
+		if granted[p.Name] {
+			if _, err := tx.Exec(`INSERT INTO usergroup_permission (usergroup, permission) VALUES (?, ?)`, name, p.Name); err != nil {
+				return err
+			}
+		}
+	}
+
+	return tx.Commit()
+}
+
+// function to delete a usergroup nobody belongs to, sql.ErrNoRows if there is no such usergroup
+func DeleteUsergroup(name string) error {
+	db := coreDB()
+	defer UsergroupCacheReset()
+
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	members := 0
+	if err := tx.QueryRow(`SELECT COUNT(*) FROM user WHERE usergroup = ?`, name).Scan(&members); err != nil {
+		return err
+	}
+	if members > 0 {
+		return ErrUsergroupInUse
+	}
+
+	result, err := tx.Exec(`DELETE FROM usergroup WHERE name = ?`, name)
+	if err != nil {
+		return err
+	}
+	if affected, _ := result.RowsAffected(); affected == 0 {
+		return sql.ErrNoRows
+	}
+	if _, err := tx.Exec(`DELETE FROM usergroup_permission WHERE usergroup = ?`, name); err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+// function to return the audited values of usergroup, nil if there is no such usergroup
+func AuditUsergroup(name string) (interface{}, error) {
+	usergroups, err := GetUsergroups()
+	if err != nil {
+		return nil, err
+	}
+	for _, g := range usergroups {
+		if g.Name == name {
+			var granted []string
+			for _, p := range permissions {
+				if g.Permissions[p.Name] {
+					granted = append(granted, p.Name)
+				}
+			}
+			return map[string]interface{}{
+				"name": g.Name,
+				"description": g.Description,
+				"permissions": granted,
+			}, nil
+		}
+	}
+	return nil, nil
 }
 
 // determines eligibility to update own account password
 func UpdateOwnPassword(usergroup string) bool {
-	switch usergroup {
-	case "normal":
-		return true
-	case "admin":
-		return true
-	default:
-		return false
-	}
+	return UsergroupPermission("update_own_password", usergroup)
 }
 
 // determines eligibility to update other user's password
 func UpdateUserPassword(usergroup string) bool {
-	switch usergroup {
-	case "normal":
-		return false
-	case "admin":
-		return true
-	default:
-		return false
-	}
+	return UsergroupPermission("update_user_password", usergroup)
 }
 
 // determines eligibility to access admin pages
 func AccessAdmin(usergroup string) bool {
-	switch usergroup {
-	case "normal":
-		return false
-	case "admin":
-		return true
-	default:
-		return false
-	}
+	return UsergroupPermission("access_admin", usergroup)
 }
 
 // determines the eligibility to access itdb system
 func AccessITDB(usergroup string) bool {
-	switch usergroup {
-	case "normal":
-		return false
-	case "admin":
-		return true
-	default:
-		return false
-	}
-}
\ No newline at end of file
+	return UsergroupPermission("access_itdb", usergroup)
+}
@@ -0,0 +1,168 @@
+// queries on table user of core.db
+package main
+
+import (
+	"time"
+	"database/sql"
+)
+
+type UserRepository struct {
+	db	*sql.DB
+}
+
+// function to determine whether username exists
+func (u *UserRepository) Exists(username string) (bool, error) {
+	var count int
+	err := u.db.QueryRow(`SELECT COUNT(*) FROM user WHERE username = ?`, username).Scan(&count)
+	return count > 0, err
+}
+
+// function to get id of username, sql.ErrNoRows if there is no such user
+func (u *UserRepository) Id(username string) (string, error) {
+	id := ""
+	err := u.db.QueryRow(`SELECT id FROM user WHERE username = ?`, username).Scan(&id)
+	return id, err
+}
+
+// function to get username of id, empty if the user no longer exists
+func (u *UserRepository) Username(id string) (string, error) {
+	username := ""
+	err := u.db.QueryRow(`SELECT username FROM user WHERE id = ?`, id).Scan(&username)
+	if err == sql.ErrNoRows {
+		return "", nil
+	}
+	return username, err
+}
+
+// function to get usergroup of id, sql.ErrNoRows if there is no such user
+func (u *UserRepository) Usergroup(id string) (string, error) {
+	usergroup := ""
+	err := u.db.QueryRow(`SELECT usergroup FROM user WHERE id = ?`, id).Scan(&usergroup)
+	return usergroup, err
+}
+
+// function to get the stored password hash of username, empty if there is no such user
+func (u *UserRepository) PasswordHash(username string) (string, error) {
+	hash := ""
+	err := u.db.QueryRow(`SELECT password FROM user WHERE username = ?`, username).Scan(&hash)
+	if err == sql.ErrNoRows {
+		return "", nil
+	}
+	return hash, err
+}
+
+// determines whether the account of id has been disabled, false if there is no such user
+func (u *UserRepository) Disabled(id string) (bool, error) {
+	disabled := false
+	err := u.db.QueryRow(`SELECT disabled FROM user WHERE id = ?`, id).Scan(&disabled)
+	if err == sql.ErrNoRows {
+		return false, nil
+	}
+	return disabled, err
+}
+
+// function to get the account details of username shown on "/user/account"
+func (u *UserRepository) Account(username string) (PageAccountStruct, error) {
+	data := PageAccountStruct{Username: username}
+
+	query := `SELECT id, email, usergroup, display_name, phone_ext, auth_source FROM user WHERE username = ?`
+	err := u.db.QueryRow(query, username).Scan(&data.Id, &data.Email, &data.Usergroup, &data.DisplayName, &data.PhoneExt, &data.AuthSource)
+
+	return data, err
+}
+
+// function to get user id, sql.ErrNoRows if there is no such user
+func (u *UserRepository) ById(id string) (UserStruct, error) {
+	user := UserStruct{}
+
+	query := `SELECT id, username, email, password, usergroup, auth_source, disabled FROM user WHERE id = ?`
+	err := u.db.QueryRow(query, id).Scan(&user.Id, &user.Username, &user.Email, &user.Password, &user.Usergroup, &user.AuthSource, &user.Disabled)
+	return user, err
+}
+
+// function to list every user together with its last successful login
+func (u *UserRepository) All() ([]UserStruct, error) {
+	var users []UserStruct
+
+	query := `SELECT id, username, email, password, usergroup, auth_source, disabled,
+		(SELECT COALESCE(MAX(created), 0) FROM login_events WHERE user_id = user.id AND success = 1) FROM user`
+	row, err := u.db.Query(query)
+	if err != nil {
+		return nil, err
+	}
+
+	defer row.Close()
+	for row.Next() {
+		user := UserStruct{}
+		var lastLogin int64
+		err := row.Scan(&user.Id, &user.Username, &user.Email, &user.Password, &user.Usergroup, &user.AuthSource, &user.Disabled, &lastLogin)
+		if err != nil {
+			return nil, err
+		}
+		if lastLogin > 0 {
+			user.LastLogin = time.Unix(lastLogin, 0)
+		}
+		users = append(users, user)
+	}
+
+	return users, row.Err()
+}
+
+// function to add a local user without password, returns the new id
+// the password is set afterwards with SetPassword(), which also keeps its history
+func (u *UserRepository) Create(username string, email string, usergroup string) (int64, error) {
+	result, err := u.db.Exec(`INSERT INTO user (username, email, password, usergroup) VALUES (?, ?, '', ?)`, username, email, usergroup)
+	if err != nil {
+		return 0, err
+	}
+	return result.LastInsertId()
+}
+
+// function to update the details of user id an admin may edit
+func (u *UserRepository) Update(id string, username string, email string, usergroup string) error {
+	_, err := u.db.Exec(`UPDATE user SET username = ?, email = ?, usergroup = ? WHERE id = ?`, username, email, usergroup, id)
+	return err
+}
+
+// function to update the details of user id the user may edit
+func (u *UserRepository) UpdateProfile(id string, displayName string, phoneExt string) error {
+	_, err := u.db.Exec(`UPDATE user SET display_name = ?, phone_ext = ? WHERE id = ?`, displayName, phoneExt, id)
+	return err
+}
+
+// function to set email of user id
+func (u *UserRepository) SetEmail(id string, email string) error {
+	_, err := u.db.Exec(`UPDATE user SET email = ? WHERE id = ?`, email, id)
+	return err
+}
+
+// function to set disabled status of user id
+func (u *UserRepository) SetDisabled(id string, disabled bool) error {
+	_, err := u.db.Exec(`UPDATE user SET disabled = ? WHERE id = ?`, disabled, id)
+	return err
+}
+
+// tables holding credentials of a user, removed together with it
+var userCredentialTables = []string{"api_token", "user_totp", "user_recovery_code", "password_history", "password_reset", "email_change"}
+
+// function to delete user id together with its API tokens, two-factor secret, recovery codes, old password hashes
+// and pending reset and email links
+// user ids may be reused, none of these must carry over to a future account
+func (u *UserRepository) Delete(id string) error {
+	tx, err := u.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if _, err := tx.Exec(`DELETE FROM user WHERE id = ?`, id); err != nil {
+		return err
+	}
+	for _, table := range userCredentialTables {
+		if _, err := tx.Exec(`DELETE FROM ` + table + ` WHERE user_id = ?`, id); err != nil {
+			return err
+		}
+	}
+
+	return tx.Commit()
+}
@@ -0,0 +1,118 @@
+package main
+
+import (
+	"fmt"
+	"testing"
+	"database/sql"
+)
+
+func TestUserRepository(t *testing.T) {
+	users := testOpenStore(t).Users
+
+	created, err := users.Create("alice", "alice@example.com", "normal")
+	if err != nil {
+		t.Fatal(err)
+	}
+	id := fmt.Sprint(created)
+
+	if exists, err := users.Exists("alice"); err != nil || !exists {
+		t.Errorf("Exists(alice) = %v, %v", exists, err)
+	}
+	if got, err := users.Id("alice"); err != nil || got != id {
+		t.Errorf("Id(alice) = %q, %v, want %q", got, err, id)
+	}
+	if _, err := users.Id("nobody"); err != sql.ErrNoRows {
+		t.Errorf("Id(nobody) error = %v, want sql.ErrNoRows", err)
+	}
+	if got, err := users.Username("999"); err != nil || got != "" {
+		t.Errorf("Username(999) = %q, %v, want empty", got, err)
+	}
+	if hash, err := users.PasswordHash("alice"); err != nil || hash != "" {
+		t.Errorf("PasswordHash(alice) = %q, %v, want empty until SetPassword", hash, err)
+	}
+
+	if err := users.Update(id, "alice2", "a2@example.com", "admin"); err != nil {
+		t.Fatal(err)
+	}
+	if err := users.UpdateProfile(id, "Alice", "1234"); err != nil {
+		t.Fatal(err)
+	}
+	if err := users.SetEmail(id, "alice@example.org"); err != nil {
+		t.Fatal(err)
+	}
+	account, err := users.Account("alice2")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if account.Id != id || account.Usergroup != "admin" || account.DisplayName != "Alice" || account.PhoneExt != "1234" ||
+		account.Email != "alice@example.org" || account.AuthSource != authSourceLocal {
+		t.Errorf("Account(alice2) = %+v", account)
+	}
+
+	if err := users.SetDisabled(id, true); err != nil {
+		t.Fatal(err)
+	}
+	if disabled, err := users.Disabled(id); err != nil || !disabled {
+		t.Errorf("Disabled() = %v, %v after SetDisabled(true)", disabled, err)
+	}
+
+	all, err := users.All()
+	if err != nil {
+		t.Fatal(err)
+	}
+	// the first admin is created by MigrateDatabases()
+	if len(all) != 2 {
+		t.Errorf("All() returned %d users, want 2", len(all))
+	}
+}
+
+func TestUserRepositoryCreateDuplicate(t *testing.T) {
+	users := testOpenStore(t).Users
+
+	if _, err := users.Create("alice", "", "normal"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := users.Create("alice", "", "normal"); err == nil {
+		t.Errorf("second user alice created")
+	}
+}
+
+func TestUserRepositoryDelete(t *testing.T) {
+	s := testOpenStore(t)
+
+	created, err := s.Users.Create("alice", "", "normal")
+	if err != nil {
+		t.Fatal(err)
+	}
+	id := fmt.Sprint(created)
+	rows := []string{
+		`INSERT INTO api_token (user_id, name, token_hash, created) VALUES (?, 'ci', 'x', 0)`,
+		`INSERT INTO user_totp (user_id, secret, last_step, created) VALUES (?, 'x', 0, 0)`,
+		`INSERT INTO user_recovery_code (user_id, code_hash) VALUES (?, 'x')`,
+		`INSERT INTO password_history (user_id, password_hash, created) VALUES (?, 'x', 0)`,
+		`INSERT INTO password_reset (nonce_hash, user_id, expires) VALUES ('x', ?, 0)`,
+		`INSERT INTO email_change (nonce_hash, user_id, email, expires) VALUES ('x', ?, 'x', 0)`,
+	}
+	for _, query := range rows {
+		if _, err := s.Core.Exec(query, id); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if err := s.Users.Delete(id); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s.Users.ById(id); err != sql.ErrNoRows {
+		t.Errorf("ById() after Delete() error = %v, want sql.ErrNoRows", err)
+	}
+
+	for _, table := range userCredentialTables {
+		var count int
+		if err := s.Core.QueryRow(`SELECT COUNT(*) FROM ` + table + ` WHERE user_id = ?`, id).Scan(&count); err != nil {
+			t.Fatal(err)
+		}
+		if count != 0 {
+			t.Errorf("%d rows of %s left after Delete()", count, table)
+		}
+	}
+}
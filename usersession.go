@@ -0,0 +1,309 @@
+// server-side registry of logged in sessions (table user_session)
+// each login gets a row, referenced from the cookie session as "sid". a session is only
+// valid while its row exists, is not revoked and has not passed the idle or absolute timeout
+package main
+
+import (
+	"log"
+	"time"
+	"os"
+	"strings"
+	"net/http"
+	"path/filepath"
+	"database/sql"
+	"github.com/gorilla/mux"
+)
+
+// last_seen is only written when older than this, to avoid a database write on every request
+const sessionTouchInterval = time.Minute
+
+type UserSession struct {
+	Id			string
+	UserId		string
+	Username	string
+	Ip			string
+	UserAgent	string
+	Created		time.Time
+	LastSeen	time.Time
+	Current		bool
+}
+
+type PageSessionStruct struct {
+	Username	string
+	Usergroup	string
+	Sessions	[]UserSession
+	Message		string
+}
+
+func UserSessionHandler(user *mux.Router, admin *mux.Router) {
+	user.HandleFunc("/account/sessions", SessionOnly(PageUserSessions))
+	user.HandleFunc("/account/sessions/revoke/{sid}", SessionOnly(UserSessionRevoke)).Methods("POST")
+	user.HandleFunc("/account/sessions/revokeall", SessionOnly(UserSessionRevokeAll)).Methods("POST")
+	admin.HandleFunc("/sessions", PageAdminSessions)
+	admin.HandleFunc("/sessions/revoke/{sid}", AdminSessionRevoke).Methods("POST")
+	admin.HandleFunc("/sessions/revokeuser/{id}", AdminSessionRevokeUser).Methods("POST")
+}
+
+func (p PageSessionStruct) UserPermission(permission string, usergroup string) bool {
+	return UsergroupPermission(permission, usergroup)
+}
+
+func (s UserSession) Idle() time.Duration {
+	return time.Since(s.LastSeen).Round(time.Minute)
+}
+
+// "/user/account/sessions"
+func PageUserSessions(w http.ResponseWriter, r *http.Request) {
+	user, _ := GetCurrentUser(r)
+	sessions, err := GetUserSessions(user.Id, CurrentSessionId(r))
+	if err != nil {
+		HTTPError(w, r, err)
+		return
+	}
+	data := PageSessionStruct{
+		user.Username,
+		user.Usergroup,
+		sessions,
+		"",
+	}
+	tmpl := ParseTemplate(w, r, "user/sessions.html")
+	tmpl.Execute(w, data)
+}
+
+// handle sign out of one of own sessions
+func UserSessionRevoke(w http.ResponseWriter, r *http.Request) {
+	user, _ := GetCurrentUser(r)
+	sid := mux.Vars(r)["sid"]
+
+	// only sessions belonging to the user
+	sessions, err := GetUserSessions(user.Id, "")
+	if err != nil {
+		HTTPError(w, r, err)
+		return
+	}
+	for _, s := range sessions {
+		if s.Id != sid {
+			continue
+		}
+		if err := RevokeSession(sid); err != nil {
+			HTTPError(w, r, err)
+			return
+		}
+	}
+
+	http.Redirect(w, r, "/user/account/sessions", 302)
+}
+
+// handle sign out everywhere, except the current session
+func UserSessionRevokeAll(w http.ResponseWriter, r *http.Request) {
+	user, _ := GetCurrentUser(r)
+	if err := RevokeUserSessions(user.Id, CurrentSessionId(r)); err != nil {
+		HTTPError(w, r, err)
+		return
+	}
+	http.Redirect(w, r, "/user/account/sessions", 302)
+}
+
+// "/admin/sessions"
+func PageAdminSessions(w http.ResponseWriter, r *http.Request) {
+	user, _ := GetCurrentUser(r)
+	sessions, err := GetUserSessions("", CurrentSessionId(r))
+	if err != nil {
+		HTTPError(w, r, err)
+		return
+	}
+	data := PageSessionStruct{
+		user.Username,
+		user.Usergroup,
+		sessions,
+		"",
+	}
+	tmpl := ParseTemplate(w, r, "admin/sessions.html")
+	tmpl.Execute(w, data)
+}
+
+// handle admin killing a single session
+func AdminSessionRevoke(w http.ResponseWriter, r *http.Request) {
+	if err := RevokeSession(mux.Vars(r)["sid"]); err != nil {
+		HTTPError(w, r, err)
+		return
+	}
+	http.Redirect(w, r, "/admin/sessions", 302)
+}
+
+// handle admin killing every session of a user
+func AdminSessionRevokeUser(w http.ResponseWriter, r *http.Request) {
+	if err := RevokeUserSessions(mux.Vars(r)["id"], ""); err != nil {
+		HTTPError(w, r, err)
+		return
+	}
+	http.Redirect(w, r, "/admin/sessions", 302)
+}
+
+// Functions that handles process and procedures and does not involve returning HTML page
+//
+//
+
+func sessionIdleTimeout() time.Duration {
+	return time.Duration(config.SessionIdleMinutes) * time.Minute
+}
+
+func sessionAbsoluteTimeout() time.Duration {
+	return time.Duration(config.SessionAbsoluteHours) * time.Hour
+}
+
+// function to return registry id of the current session
+func CurrentSessionId(r *http.Request) string {
+	session, _ := store.Get(r, "cookie-name")
+	sid, _ := session.Values["sid"].(string)
+	return sid
+}
+
+// function to record a new login, returns the registry id to be kept in the cookie session
+func CreateSession(r *http.Request, id string, username string) (string, error) {
+	db := coreDB()
+
+	sid := randomToken()
+	now := time.Now().Unix()
+
+	query := `INSERT INTO user_session (id, user_id, username, ip, user_agent, created, last_seen) VALUES (?, ?, ?, ?, ?, ?, ?)`
+	_, err := db.Exec(query, sid, id, username, ClientIP(r), r.UserAgent(), now, now)
+	if err != nil {
+		return "", err
+	}
+
+	return sid, nil
+}
+
+// determines whether the registry entry is still valid, refreshing its last seen time
+func SessionValid(sid string) (bool, error) {
+	if sid == "" {
+		return false, nil
+	}
+
+	db := coreDB()
+
+	var created, lastSeen int64
+	err := db.QueryRow(`SELECT created, last_seen FROM user_session WHERE id = ?`, sid).Scan(&created, &lastSeen)
+	if err == sql.ErrNoRows {
+		return false, nil
+	} else if err != nil {
+		return false, err
+	}
+
+	now := time.Now()
+	if config.SessionIdleMinutes > 0 && now.Sub(time.Unix(lastSeen, 0)) > sessionIdleTimeout() {
+		return false, nil
+	}
+	if config.SessionAbsoluteHours > 0 && now.Sub(time.Unix(created, 0)) > sessionAbsoluteTimeout() {
+		return false, nil
+	}
+
+	if now.Sub(time.Unix(lastSeen, 0)) > sessionTouchInterval {
+		_, err = db.Exec(`UPDATE user_session SET last_seen = ? WHERE id = ?`, now.Unix(), sid)
+		if err != nil {
+			return false, err
+		}
+	}
+
+	return true, nil
+}
+
+// function to list sessions of a user, or of everyone when id is empty
+// current marks the session of the viewer
+func GetUserSessions(id string, current string) ([]UserSession, error) {
+	db := coreDB()
+
+	var sessions []UserSession
+
+	query := `SELECT id, user_id, username, ip, user_agent, created, last_seen FROM user_session`
+	args := []interface{}{}
+	if id != "" {
+		query += ` WHERE user_id = ?`
+		args = append(args, id)
+	}
+	query += ` ORDER BY last_seen DESC`
+
+	row, err := db.Query(query, args...)
+	if err != nil {
+		return nil, err
+	}
+
+	defer row.Close()
+	for row.Next() {
+		s := UserSession{}
+		var created, lastSeen int64
+		err := row.Scan(&s.Id, &s.UserId, &s.Username, &s.Ip, &s.UserAgent, &created, &lastSeen)
+		if err != nil {
+			return nil, err
+		}
+		s.Created = time.Unix(created, 0)
+		s.LastSeen = time.Unix(lastSeen, 0)
+		s.Current = s.Id == current
+		sessions = append(sessions, s)
+	}
+
+	return sessions, row.Err()
+}
+
+// function to end a session, the cookie holding it stops working on next request
+func RevokeSession(sid string) error {
+	db := coreDB()
+
+	_, err := db.Exec(`DELETE FROM user_session WHERE id = ?`, sid)
+	return err
+}
+
+// function to end every session of a user, except the one given
+func RevokeUserSessions(id string, except string) error {
+	db := coreDB()
+
+	_, err := db.Exec(`DELETE FROM user_session WHERE user_id = ? AND id != ?`, id, except)
+	return err
+}
+
+// function to periodically remove expired registry rows and stale session files
+func SessionCleanup(interval time.Duration) {
+	for {
+		sessionCleanupOnce()
+		time.Sleep(interval)
+	}
+}
+
+func sessionCleanupOnce() {
+	db := coreDB()
+
+	now := time.Now()
+	if config.SessionIdleMinutes > 0 {
+		_, err := db.Exec(`DELETE FROM user_session WHERE last_seen < ?`, now.Add(-sessionIdleTimeout()).Unix())
+		if err != nil {
+			log.Println("sessionCleanupOnce() ", err)
+		}
+	}
+	if config.SessionAbsoluteHours > 0 {
+		_, err := db.Exec(`DELETE FROM user_session WHERE created < ?`, now.Add(-sessionAbsoluteTimeout()).Unix())
+		if err != nil {
+			log.Println("sessionCleanupOnce() ", err)
+		}
+	}
+
+	// session files not written for longer than the cookie lifetime are useless
+	maxAge := time.Duration(store.Options.MaxAge) * time.Second
+	entries, err := os.ReadDir(SessionDirectory())
+	if err != nil {
+		log.Println("sessionCleanupOnce() ", err)
+		return
+	}
+	for _, entry := range entries {
+		if entry.IsDir() || !strings.HasPrefix(entry.Name(), "session_") {
+			continue
+		}
+		info, err := entry.Info()
+		if err != nil {
+			continue
+		}
+		if now.Sub(info.ModTime()) > maxAge {
+			os.Remove(filepath.Join(SessionDirectory(), entry.Name()))
+		}
+	}
+}